@@ -1,8 +1,31 @@
 module github.com/networkimprov/mnm-hammer
 
-go 1.13
+go 1.20
 
 require (
 	github.com/blevesearch/bleve v1.0.10
 	github.com/gorilla/websocket v1.4.2
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+)
+
+require (
+	github.com/RoaringBitmap/roaring v0.4.23 // indirect
+	github.com/blevesearch/go-porterstemmer v1.0.3 // indirect
+	github.com/blevesearch/mmap-go v1.0.2 // indirect
+	github.com/blevesearch/segment v0.9.0 // indirect
+	github.com/blevesearch/snowballstem v0.9.0 // indirect
+	github.com/blevesearch/zap/v11 v11.0.10 // indirect
+	github.com/blevesearch/zap/v12 v12.0.10 // indirect
+	github.com/blevesearch/zap/v13 v13.0.2 // indirect
+	github.com/blevesearch/zap/v14 v14.0.1 // indirect
+	github.com/couchbase/vellum v1.0.2 // indirect
+	github.com/glycerine/go-unsnap-stream v0.0.0-20181221182339-f9677308dec2 // indirect
+	github.com/golang/protobuf v1.3.2 // indirect
+	github.com/golang/snappy v0.0.1 // indirect
+	github.com/philhofer/fwd v1.0.0 // indirect
+	github.com/steveyen/gtreap v0.1.0 // indirect
+	github.com/tinylib/msgp v1.1.0 // indirect
+	github.com/willf/bitset v1.1.10 // indirect
+	go.etcd.io/bbolt v1.3.5 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 )
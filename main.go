@@ -9,6 +9,7 @@ package main
 
 import (
    "runtime/debug"
+   "bufio"
    "flag"
    "fmt"
    "net/http"
@@ -59,9 +60,18 @@ var sServicesDoor sync.RWMutex
 var sServices = make(map[string]tService)
 var sServiceTmpl *template.Template
 var sNetAddr string
+var sCryptEnable, sCryptRekey bool
+var sScanSpec string
+var sUploadExpiry, sUploadSentExpiry time.Duration
 
 func init() {
    flag.StringVar(&sHttpSrvr.Addr, "http", sHttpSrvr.Addr, "[host]:port of http server")
+   flag.BoolVar(&sCryptEnable, "encrypt", false, "encrypt the store with a new passphrase and quit")
+   flag.BoolVar(&sCryptRekey, "rekey", false, "rotate the store's key and passphrase and quit")
+   flag.DurationVar(&sUploadExpiry, "upload-expiry", 48 * time.Hour, "drop partial uploads idle for this long")
+   flag.DurationVar(&sUploadSentExpiry, "upload-sent-expiry", 30 * 24 * time.Hour,
+                    "drop unpinned uploads this long after sending; 0 to keep")
+   flag.StringVar(&sScanSpec, "scan", "", "scan received attachments & uploads via exec:command or unix:socket")
 }
 
 func main() {
@@ -82,6 +92,7 @@ func mainResult() int {
    defer func() { if err != nil { fmt.Fprintf(os.Stderr, "mainResult: %v\n", err) } }()
 
    sServices["local"] = tService{ccs: newClientConns()}
+   pSl.SetNotifyStream(notifyStream)
 
    if sTestHost != "" && sHttpSrvr.Addr == ":http" {
       sHttpSrvr.Addr = ":8123"
@@ -107,6 +118,18 @@ func mainResult() int {
          err = os.Chdir(path.Dir(os.Args[0]))
          if err != nil { return 1 }
       }
+      var aQuit bool
+      aQuit, err = _unlockStore()
+      if err != nil { return 1 }
+      if aQuit { return 0 }
+      pSl.SetPartExpiryUpload(sUploadExpiry)
+      pSl.SetSentExpiryUpload(sUploadSentExpiry)
+      if sScanSpec != "" {
+         var aScan pSl.Scanner
+         aScan, err = pSl.NewScanner(sScanSpec)
+         if err != nil { return 1 }
+         pSl.SetScanner(aScan)
+      }
       pSl.Init(StartService, MsgToSelf, crashTest)
    }
 
@@ -118,7 +141,9 @@ func mainResult() int {
    http.HandleFunc("/l/", runNodeListen)
    http.HandleFunc("/n/", runNodeRecv)
    http.HandleFunc("/t/", runGlobal)
+   http.HandleFunc("/p/", runUploadPart)
    http.HandleFunc("/f/", runGlobal)
+   http.HandleFunc("/m/", runGlobal)
    http.HandleFunc("/v/", runGlobal)
    http.HandleFunc("/g/", runTag)
    http.HandleFunc("/s/", runWebsocket)
@@ -132,6 +157,51 @@ func mainResult() int {
    return 0
 }
 
+// _unlockStore reads passphrases from stdin; $MNM_PASSPHRASE may give the one to unlock
+func _unlockStore() (bool, error) {
+   aRd := bufio.NewReader(os.Stdin)
+   fRead := func(cPrompt string) string {
+      fmt.Print(cPrompt)
+      cLine, err := aRd.ReadString('\n')
+      if err != nil && err != io.EOF { return "" }
+      return strings.TrimRight(cLine, "\r\n")
+   }
+   fReadNew := func() (string, error) {
+      cNew := fRead("new passphrase: ")
+      if cNew == "" {
+         return "", tError("passphrase required")
+      }
+      if fRead("repeat new passphrase: ") != cNew {
+         return "", tError("passphrases differ")
+      }
+      return cNew, nil
+   }
+   if sCryptEnable {
+      if pSl.HasKeyCrypt() {
+         return true, tError("store already encrypted")
+      }
+      aNew, err := fReadNew()
+      if err != nil { return true, err }
+      return true, pSl.EnableCrypt(aNew)
+   }
+   if !pSl.HasKeyCrypt() {
+      if sCryptRekey {
+         return true, tError("store not encrypted")
+      }
+      return false, nil
+   }
+   aPass := os.Getenv("MNM_PASSPHRASE")
+   if aPass == "" || sCryptRekey {
+      aPass = fRead("passphrase: ")
+   }
+   if sCryptRekey {
+      aNew, err := fReadNew()
+      if err != nil { return true, err }
+      return true, pSl.RotateCrypt(aPass, aNew)
+   }
+   return false, pSl.UnlockCrypt(aPass)
+}
+
 func _getNetAddress() string {
    aLink, err := net.Dial("udp", "1.1.1.1:11") // doesn't cause network activity
    if err != nil {
@@ -168,6 +238,22 @@ func getService(iSvcId string) tService {
    return sServices[iSvcId]
 }
 
+func notifyStream(iSvcId string) {
+   notifyClients(iSvcId, []string{"ar"})
+}
+
+func notifyClients(iSvcId string, iMsg []string) {
+   aSvc := getService(iSvcId)
+   if aSvc.ccs == nil {
+      return
+   }
+   aSvc.ccs.Range(func(cC *tWsConn) {
+      if !cC.test {
+         cC.WriteJSON(iMsg)
+      }
+   })
+}
+
 func toAllClients(iMsg interface{}) {
    aJson, err := json.Marshal(iMsg)
    if err != nil { panic(err) }
@@ -263,7 +349,10 @@ func runTmtpSend(o *tQueue) {
       err := pSl.SendService(aConn, o.service, aSrec)
       o.connSrc <- aConn
       if err != nil { //todo retry transient error
-         if err.Error() == "already sent" {
+         if err.Error() == "already sent" || err.Error() == "not queued" {
+            aSrec = o._waitForSrec()
+         } else if pSl.IsDroppedSend(err) {
+            notifyClients(o.service, []string{"ml", "_e", err.Error()})
             aSrec = o._waitForSrec()
          } else {
             fmt.Fprintf(os.Stderr, "runTmtpSend %s: send error %s\n", o.service, err.Error())
@@ -542,6 +631,7 @@ func (o *tTmtpInput) Read(iOut []byte) (int, error) {
 
 var kStateOp = map[string]bool{
    "cs":true, "cl":true, "al":true, "ml":true, "tl":true, "mo":true, "mn":true, "an":true, "ad":true,
+   "at":true, "as":true, "mq":true,
 }
 
 func runService(iResp http.ResponseWriter, iReq *http.Request) {
@@ -604,6 +694,10 @@ func runService(iResp http.ResponseWriter, iReq *http.Request) {
    case "nl": aResult = pSl.GetIdxNotice(aSvcId)
    case "fl": aResult = pSl.GetIdxFilledForm(aSvcId)
    case "ps": aResult = pSl.GetDraftAdrsbk(aSvcId)
+   case "sl": aResult = pSl.GetSchedQueue(aSvcId)
+   case "rp": aResult = pSl.GetRetainPreview(aSvcId)
+   case "us": aResult = pSl.GetUsageQuota(aSvcId)
+   case "ar": aResult = pSl.GetIdxStream(aSvcId)
    case "pt": aResult = pSl.GetSentAdrsbk(aSvcId)
    case "pf": aResult = pSl.GetReceivedAdrsbk(aSvcId)
    case "gl": aResult = pSl.GetGroupAdrsbk(aSvcId)
@@ -612,8 +706,13 @@ func runService(iResp http.ResponseWriter, iReq *http.Request) {
    case "cl": aResult = pSl.GetCcThread(aSvcId, aState)
    case "al": aResult = pSl.GetIdxAttach(aSvcId, aState)
    case "ml": aResult = pSl.GetIdxThread(aSvcId, aState)
+   case "hl": aResult = pSl.GetRevsThread(aSvcId, aOp_Id[1])
+   case "hd":
+      aResult, err = pSl.GetRevDiffThread(aSvcId, aOp_Id[1])
+   case "mq":
+      aResult, err = pSl.GetQuoteThread(aSvcId, aState, aOp_Id[1])
    case "tl":
-      err = pSl.WriteResultSearch(iResp, aSvcId, aState)
+      err = pSl.WriteResultSearch(iResp, aSvcId, aState, aOp_Id[1])
    case "mo":
       err = pSl.WriteMessagesThread(iResp, aSvcId, aState, "")
    case "mn":
@@ -622,6 +721,32 @@ func runService(iResp http.ResponseWriter, iReq *http.Request) {
          break
       }
       err = pSl.WriteMessagesThread(iResp, aSvcId, aState, aOp_Id[1])
+   case "at": // id is msgid_name, or upload/name
+      aMid_File := []string{"", aOp_Id[1]}
+      if !strings.HasPrefix(aOp_Id[1], "upload/") {
+         aMid_File = strings.SplitN(aOp_Id[1], "_", 2)
+         if len(aMid_File) < 2 || len(aMid_File[1]) < 3 {
+            err = tError("invalid id")
+            break
+         }
+      }
+      aPath := pSl.GetPathThumbAttach(aSvcId, aState, aMid_File[0], aMid_File[1])
+      if aPath == "" {
+         http.NotFound(iResp, iReq) // not an image
+         break
+      }
+      iResp.Header().Del("Content-Type") // let ServeContent() infer type
+      iResp.Header().Set("Cache-Control", "private, max-age=0, no-cache") // revalidate via Last-Modified
+      pSl.ServeFile(iResp, iReq, aPath)
+   case "as": // id is msgid_name
+      aDelim := strings.IndexByte(aOp_Id[1], '_')
+      if aDelim < 0 || len(aOp_Id[1]) <= aDelim+3 {
+         err = tError("invalid id")
+         break
+      }
+      iResp.Header().Del("Content-Type") // set by ServeStreamAttach()
+      iResp.Header().Set("Cache-Control", "private, max-age=0, no-cache")
+      pSl.ServeStreamAttach(iResp, iReq, aSvcId, aState, aOp_Id[1][:aDelim], aOp_Id[1][aDelim+1:])
    case "an", "ad":
       aDelim := strings.IndexByte(aOp_Id[1], '_')
       if aDelim < 0 || len(aOp_Id[1]) <= aDelim+3 {
@@ -632,10 +757,14 @@ func runService(iResp http.ResponseWriter, iReq *http.Request) {
          iResp.Header().Set("Content-Disposition",
                             "attachment; filename*=UTF-8''" + escapeFile(aOp_Id[1][aDelim+3:]))
       }
-      iResp.Header().Del("Content-Type") // let ServeFile() infer type
+      aPath := pSl.GetPathAttach(aSvcId, aState, aOp_Id[1][:aDelim], aOp_Id[1][aDelim+1:])
+      if aPath == "" {
+         http.NotFound(iResp, iReq) // quarantined or awaiting scan
+         break
+      }
+      iResp.Header().Del("Content-Type") // let ServeContent() infer type
       iResp.Header().Set("Cache-Control", "private, max-age=0, no-cache") //todo compare checksums
-      http.ServeFile(iResp, iReq, pSl.GetPathAttach(aSvcId, aState, aOp_Id[1][:aDelim],
-                                                                    aOp_Id[1][aDelim+1:]))
+      pSl.ServeFile(iResp, iReq, aPath)
    default:
       if err == nil {
          err = tError("unknown op")
@@ -722,6 +851,7 @@ func runGlobal(iResp http.ResponseWriter, iReq *http.Request) {
    var aSet pSl.GlobalSet
    switch iReq.URL.Path[1] {
    case 'f': aSet = pSl.BlankForm
+   case 'm': aSet = pSl.Template
    case 't': aSet = pSl.Upload
    case 'v': aSet = pSl.Service
    }
@@ -762,6 +892,12 @@ func runGlobal(iResp http.ResponseWriter, iReq *http.Request) {
             fErr(http.StatusNotAcceptable, "drop: " + err.Error())
             return
          }
+      } else if (aId[0] == '!' || aId[0] == '~') && iReq.URL.Path[1] == 't' {
+         err := pSl.Upload.Pin(aId[1:], aId[0] == '!')
+         if err != nil {
+            fErr(http.StatusNotAcceptable, "pin: " + err.Error())
+            return
+         }
       } else {
          fErr(http.StatusNotAcceptable, "missing +/- operator")
          return
@@ -783,8 +919,66 @@ func runGlobal(iResp http.ResponseWriter, iReq *http.Request) {
          return
       }
       iResp.Header().Set("Cache-Control", "private, max-age=0, no-cache") //todo compare checksums
-      http.ServeFile(iResp, iReq, aPath)
+      pSl.ServeFile(iResp, iReq, aPath)
+   }
+}
+
+// runUploadPart handles resumable uploads:
+//   POST   /p/+name?size=n    open session; size optional
+//   PUT    /p/id?offset=n     write chunk
+//   GET    /p/id              get progress
+//   POST   /p/id?sha256=hex   finish
+//   DELETE /p/id              abort
+func runUploadPart(iResp http.ResponseWriter, iReq *http.Request) {
+   if sTestHost == "" {
+      fmt.Printf("runUploadPart %s %s\n", iReq.Method, iReq.URL.Path)
+   }
+   fErr := func(cSt int, cMsg string) { iResp.WriteHeader(cSt); iResp.Write([]byte(cMsg)) }
+   fInt := func(cKey string) (int64, error) {
+      cStr := iReq.URL.Query().Get(cKey)
+      if cStr == "" { return 0, nil }
+      return strconv.ParseInt(cStr, 10, 64)
+   }
+   aId := iReq.URL.Path[3:]
+   if aId == "" {
+      fErr(http.StatusNotAcceptable, "upload: missing name or session id")
+      return
+   }
+   var aResult interface{}
+   var err error
+   switch {
+   case iReq.Method == "POST" && aId[0] == '+':
+      var aSize int64
+      aSize, err = fInt("size")
+      if err == nil {
+         aResult, err = pSl.Upload.OpenPart(aId[1:], aSize)
+      }
+   case iReq.Method == "PUT":
+      var aOffset int64
+      aOffset, err = fInt("offset")
+      if err == nil {
+         aResult, err = pSl.Upload.WritePart(aId, aOffset, iReq.Body)
+      }
+   case iReq.Method == "GET":
+      aResult, err = pSl.Upload.GetPart(aId)
+   case iReq.Method == "POST":
+      err = pSl.Upload.FinishPart(aId, iReq.URL.Query().Get("sha256"))
+      if err == nil {
+         toAllClients([]string{"/t"})
+         aResult = "ok"
+      }
+   case iReq.Method == "DELETE":
+      err = pSl.Upload.DropPart(aId)
+      aResult = "ok"
+   default:
+      err = tError("unknown method "+ iReq.Method)
+   }
+   if err != nil {
+      fErr(http.StatusNotAcceptable, "upload: " + err.Error())
+      return
    }
+   err = json.NewEncoder(iResp).Encode(aResult)
+   if err != nil { fmt.Fprintf(os.Stderr, "runUploadPart: %s\n", err.Error()) }
 }
 
 func runTag(iResp http.ResponseWriter, iReq *http.Request) {
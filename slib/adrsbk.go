@@ -315,6 +315,20 @@ func storeReceivedAdrsbk(iSvc string, iHead *Header, iR io.Reader) error {
       return err
    }
    aFromSelf := iHead.From == GetConfigService(iSvc).Uid
+   var aPub, aSignPub string
+   if iHead.SubHead != nil && iHead.SubHead.E2e != nil {
+      aPub = iHead.SubHead.E2e.PubKey
+   }
+   if iHead.SubHead != nil && iHead.SubHead.Sign != nil {
+      aSignPub = iHead.SubHead.Sign.Key
+   }
+   if iHead.SubHead != nil && !aFromSelf {
+      defer addAcceptCodec(iSvc, iHead.From, iHead.SubHead.Accept) // after aSvc.Unlock()
+   }
+   defer func() { // after aSvc.Unlock()
+      addPeerE2e(iSvc, iHead.From, aPub)
+      addPeerSign(iSvc, iHead.From, aSignPub)
+   }()
    aSvc := _loadAdrsbk(iSvc)
    aSvc.Lock(); defer aSvc.Unlock()
    aLog := aSvc.pingFromIdx[iHead.From]; if aFromSelf { aLog = aSvc.pingToIdx[iHead.To] }
@@ -334,6 +348,7 @@ func storeReceivedAdrsbk(iSvc string, iHead *Header, iR io.Reader) error {
    if aUid != "" && aUid != kUidUnknown && aUid != iHead.From {
       fmt.Fprintf(os.Stderr, "storeReceivedAdrsbk %s: blocked ping from %s aka %s\n",
                              iSvc, iHead.From, aUid)
+      aPub, aSignPub = "", ""
       return nil
    }
    aEl := tAdrsbkEl{Date:iHead.Posted, Gid:iHead.Gid, Text:string(aBuf),
@@ -475,7 +490,7 @@ func _storeAdrsbkQid(iSvc string, iEls []tAdrsbkEl, iQid string) {
    var err error
    aFi, err := os.Lstat(fileAdrs(iSvc))
    if err != nil && !os.IsNotExist(err) { quit(err) }
-   aPos := int64(2); if err == nil { aPos = aFi.Size() }
+   aPos := int64(2); if err == nil { aPos = sizeFile(fileAdrs(iSvc), aFi) }
    aTempOk := ftmpAdrsbk(iSvc, fmt.Sprint(aPos), iQid)
    aTemp := aTempOk + ".tmp"
 
@@ -502,7 +517,7 @@ func _completeAdrsbk(iSvc string, iTmp string, iEls []tAdrsbkEl) {
       addPingNotice(iSvc, iEls[0].MsgId, iEls[0].Alias, iEls[0].Gid, iEls[0].Text)
    }
    aRec := strings.SplitN(iTmp, "_", 3)
-   aFd, err := os.OpenFile(fileAdrs(iSvc), os.O_WRONLY|os.O_CREATE, 0600)
+   aFd, err := openFileFlags(fileAdrs(iSvc), os.O_WRONLY|os.O_CREATE, 0600)
    if err != nil { quit(err) }
    defer aFd.Close()
    aPos, err := strconv.ParseInt(aRec[1], 10, 64)
@@ -609,14 +624,24 @@ func sendDraftAdrsbk(iW io.Writer, iSvc string, iQid, iId string) error {
       return tError("already sent")
    }
    aData := []byte(aEl.Text)
-   aMsg := Msg{"Op":9, "Id":iId, "To":aEl.Alias, "From":aEl.MyAlias, "DataLen": len(aData)}
+   aSubHead := tHeader2{Accept: kCodecAccept}
+   if aPub := pubKeyE2e(iSvc); aPub != "" {
+      aSubHead.E2e = &tE2eHead{PubKey: aPub}
+   }
+   if aPub := pubKeySign(iSvc); aPub != "" {
+      aSubHead.Sign = &tSignHead{Key: aPub}
+   }
+   aSub, err := json.Marshal(aSubHead)
+   if err != nil { quit(err) }
+   aMsg := Msg{"Op":9, "Id":iId, "To":aEl.Alias, "From":aEl.MyAlias,
+               "DataHead": len(aSub), "DataLen": len(aSub) + len(aData)}
    if aEl.Gid != "" {
       aMsg["Op"] = 5
       aMsg["Gid"] = aEl.Gid
    }
    aHead, err := json.Marshal(aMsg)
    if err != nil { quit(err) }
-   err = writeHeaders(iW, aHead, nil)
+   err = writeHeaders(iW, aHead, aSub)
    if err != nil { return err }
    _, err = iW.Write(aData)
    return err
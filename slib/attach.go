@@ -24,7 +24,8 @@ const kSuffixSent = "_sent" // must be same length
 type tFfnIndex map[string]string
 
 func GetIdxAttach(iSvc string, iState *ClientState) interface{} {
-   type tAttachEl struct { Id, File, MsgId, Date, Who string; Size int64 }
+   type tAttachEl struct { Id, File, MsgId, Date, Who string; Size int64; Thumb bool `json:",omitempty"`
+                           Quarantine string `json:",omitempty"` }
 
    aId := iState.getThread()
    if aId == "" {
@@ -36,14 +37,17 @@ func GetIdxAttach(iSvc string, iState *ClientState) interface{} {
    if err != nil {
       return []tAttachEl{}
    }
+   aQuar := getQuarantine(iSvc, aId)
    aSend := make([]tAttachEl, 0, len(aDir))
    for _, aFi := range aDir {
       if aFi.Name() == "ffnindex" { continue }
       aFile := unescapeFile(aFi.Name())
       aPair := strings.SplitN(aFile, "_", 2)
-      aEl := tAttachEl{Id: aFile, Size: aFi.Size(),
+      aEl := tAttachEl{Id: aFile, Size: sizeFile(dirAttach(iSvc) + aId +"/"+ aFi.Name(), aFi),
                        MsgId: aPair[0], File: aPair[1][2:], // omit x: tag
-                       Date: aFi.ModTime().UTC().Format(time.RFC3339)}
+                       Date: aFi.ModTime().UTC().Format(time.RFC3339), Thumb: _isThumb(aFile),
+                       Quarantine: aQuar[aFi.Name()].Verdict}
+      aEl.Thumb = aEl.Thumb && aEl.Quarantine == ""
       if aId[0] == '_' {
          aEl.MsgId = aId
       } else if len(aPair[0]) == 12 { //todo codify
@@ -62,7 +66,11 @@ func GetIdxAttach(iSvc string, iState *ClientState) interface{} {
 }
 
 func GetPathAttach(iSvc string, iState *ClientState, iMsgId string, iFile string) string {
-   return fileAtc(iSvc, iState.getThread(), iMsgId, iFile)
+   aPath := fileAtc(iSvc, iState.getThread(), iMsgId, iFile)
+   if isQuarantined(iSvc, aPath) {
+      return ""
+   }
+   return aPath
 }
 
 func sizeDraftAttach(iSvc string, iSubHead *tHeader2, iId tLocalId) int64 {
@@ -74,22 +82,23 @@ func sizeDraftAttach(iSvc string, iSubHead *tHeader2, iId tLocalId) int64 {
          iSubHead.Attach[a].AllowAnyData = false
       } else {
          iSubHead.Attach[a].IsNew = false
-         aFi, err := os.Lstat(fileAtc(iSvc, aTid, iId.lms(), aFile.Name))
+         aPath := fileAtc(iSvc, aTid, iId.lms(), aFile.Name)
+         aFi, err := os.Lstat(aPath)
          if err != nil { quit(err) }
-         iSubHead.Attach[a].Size = aFi.Size()
+         iSubHead.Attach[a].Size = sizeFile(aPath, aFi)
       }
       aTotal += iSubHead.Attach[a].Size
    }
    return aTotal
 }
 
-func writeDraftAttach(iW io.Writer, iSvc string, iSubHead *tHeader2, iId tLocalId, iFd *os.File) error {
+func writeDraftAttach(iW io.Writer, iSvc string, iSubHead *tHeader2, iId tLocalId, iFd *tFile) error {
    var err error
    aTid := iId.tid(); if aTid == "" { aTid = "_" + iId.lms() }
    for _, aFile := range iSubHead.Attach {
       aXd := iFd
       if !_isFormFill(aFile.Name) {
-         aXd, err = os.Open(fileAtc(iSvc, aTid, iId.lms(), aFile.Name))
+         aXd, err = openFile(fileAtc(iSvc, aTid, iId.lms(), aFile.Name))
          if err != nil { quit(err) }
          defer aXd.Close()
          var aFi os.FileInfo
@@ -97,7 +106,11 @@ func writeDraftAttach(iW io.Writer, iSvc string, iSubHead *tHeader2, iId tLocalI
          if err != nil { quit(err) }
          if aFi.Size() != aFile.Size { quit(tError("file size mismatch")) }
       }
-      _, err = io.CopyN(iW, aXd, aFile.Size)
+      if aFile.Codec != "" {
+         err = writeWireAttach(iW, iSvc, iId, &aFile)
+      } else {
+         _, err = io.CopyN(iW, aXd, aFile.Size)
+      }
       if err != nil { return err } //todo only return net errors
    }
    return nil
@@ -123,11 +136,27 @@ func tempReceivedAttach(iSvc string, iHead *Header, iR io.Reader) error {
          continue
       }
       aPath := ftmpAtc(iSvc, iHead.Id, aFile.Name)
-      var aFd *os.File
-      aFd, err = os.OpenFile(aPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+      var aFd *tFile
+      aFd, err = openFileFlags(aPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
       if err != nil { quit(err) }
       defer aFd.Close()
-      _, err = io.CopyN(aFd, iR, aFile.Size)
+      aStream := beginStream(iSvc, iHead, &aFile, aPath)
+      if aFile.Codec == kCodecDelta {
+         var aOk bool
+         aOk, err = readDelta(aFd, iR, iSvc, iHead.SubHead.ThreadId, &aFile)
+         if err == nil && !aOk {
+            endStream(aStream, false)
+            aFd.Close()
+            err = os.Remove(aPath) // requested from author after message is stored
+            if err != nil { quit(err) }
+            continue
+         }
+      } else if aFile.Codec != "" {
+         err = readCodec(aFd, iR, &aFile)
+      } else {
+         _, err = io.CopyN(aFd, iR, aFile.Size)
+      }
+      endStream(aStream, err == nil)
       if err != nil {
          return err //todo only network errors
       }
@@ -147,6 +176,7 @@ func tempReceivedAttach(iSvc string, iHead *Header, iR io.Reader) error {
 
 func removeReceivedAttach(iSvc string, iHead *Header) {
    var err error
+   defer dropStream(iSvc, iHead.Id)
    for _, aFile := range iHead.SubHead.Attach {
       if _isFormFill(aFile.Name) {
          removeTempFilledForm(iSvc, iHead.Id, &aFile)
@@ -184,11 +214,15 @@ func storeReceivedAttach(iSvc string, iSubHead *tHeader2, iRec tComplete) {
       err = syncDir(dirAttach(iSvc) + iRec.tid())
       if err != nil { quit(err) }
       if aDoFfn { _updateFfnIndex(iSvc, iRec, aFfnIdx, iSubHead) }
+      storeBlobAttach(iSvc, iSubHead, iRec)
+      scanAttach(iSvc, iSubHead, iRec)
+      makeThumbAttach(iSvc, iSubHead, iRec)
+      storeStream(iSvc, iRec)
    }
    _storeFormAttach(iSvc, iSubHead, iRec)
 }
 
-func tempSentAttach(iSvc string, iHead *Header, iSd *os.File) {
+func tempSentAttach(iSvc string, iHead *Header, iSd *tFile) {
    var err error
    aFftSize := map[string]int64{}
    aDoSync := false
@@ -214,6 +248,9 @@ func storeSentAttach(iSvc string, iSubHead *tHeader2, iRec tComplete) {
       if err != nil && !os.IsNotExist(err) { quit(err) }
       err = syncDir(dirAttach(iSvc))
       if err != nil { quit(err) }
+      dropThumbAttach(iSvc, "_"+ iRec.lms(), "")
+   } else {
+      dropThumbAttach(iSvc, iRec.tid(), iRec.lms() +"_")
    }
    aDoSync, aDoFfn := false, false
    for _, aFile := range iSubHead.Attach {
@@ -230,6 +267,8 @@ func storeSentAttach(iSvc string, iSubHead *tHeader2, iRec tComplete) {
       err = syncDir(dirAttach(iSvc) + iRec.tid())
       if err != nil { quit(err) }
       if aDoFfn { _updateFfnIndex(iSvc, iRec, aFfnIdx, iSubHead) }
+      storeBlobAttach(iSvc, iSubHead, iRec)
+      makeThumbAttach(iSvc, iSubHead, iRec)
    }
    _storeFormAttach(iSvc, iSubHead, iRec)
 }
@@ -283,10 +322,11 @@ func _storeFormAttach(iSvc string, iSubHead *tHeader2, iRec tComplete) {
    }
 }
 
-func validateDraftAttach(iSvc string, iSubHead *tHeader2, iId tLocalId, iFd *os.File) error {
+func validateDraftAttach(iSvc string, iSubHead *tHeader2, iId tLocalId, iFd *tFile, iBodyLen int64) error {
    var err error
    aTid := iId.tid(); if aTid == "" { aTid = "_" + iId.lms() }
-   for _, aFile := range iSubHead.Attach {
+   aSized := append([]tHeader2Attach{}, iSubHead.Attach...) // sizes may be stale
+   for a, aFile := range iSubHead.Attach {
       if _isFormFill(aFile.Name) {
          if aFile.Ffn == "" {
             return tError(fmt.Sprintf("%s missing Ffn", aFile.Name))
@@ -301,13 +341,17 @@ func validateDraftAttach(iSvc string, iSubHead *tHeader2, iId tLocalId, iFd *os.
       if _isForm(aFile.Name) && aFile.Ffn[0] == '#' {
          return tError(aFile.Ffn[1:])
       }
-      _, err = os.Lstat(fileAtc(iSvc, aTid, iId.lms(), aFile.Name))
+      aPath := fileAtc(iSvc, aTid, iId.lms(), aFile.Name)
+      aFi, err := os.Lstat(aPath)
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
          return tError(fmt.Sprintf("%s missing %s", aTid, aFile.Name))
       }
+      aSized[a].Size = sizeFile(aPath, aFi)
+      err = validateDeltaAttach(iSvc, iId.tid(), &aFile)
+      if err != nil { return err }
    }
-   return nil
+   return checkQuota(iSvc, aSized, iBodyLen)
 }
 
 func setupDraftAttach(iSvc string, iTid string, i *Update) []tHeader2Attach {
@@ -351,7 +395,7 @@ func _lookupFfn(iSvc string, iName string) string {
    return aFfn
 }
 
-func writeFormFillAttach(iFd *os.File, iSubHead *tHeader2, iMap map[string]string, iEl *tIndexEl) {
+func writeFormFillAttach(iFd *tFile, iSubHead *tHeader2, iMap map[string]string, iEl *tIndexEl) {
    var err error
    aCw := tCrcWriter{sum:iEl.Checksum}
    aTee := io.MultiWriter(iFd, &aCw)
@@ -387,6 +431,7 @@ func updateDraftAttach(iSvc string, iSubHeadOld, iSubHeadNew *tHeader2, iRec tCo
    aTid := iRec.tid(); if aTid == "" { aTid = "_" + iRec.lms() }
 
    if aHasOld {
+      dropThumbAttach(iSvc, aTid, iRec.lms() +"_")
       for _, aFile := range iSubHeadOld.Attach {
          if _isFormFill(aFile.Name) { continue }
          err = os.Remove(fileAtc(iSvc, aTid, iRec.lms(), aFile.Name))
@@ -430,6 +475,56 @@ func updateDraftAttach(iSvc string, iSubHeadOld, iSubHeadNew *tHeader2, iRec tCo
    }
 }
 
+func deleteMsgAttach(iSvc string, iTid, iMid string) {
+   aDir, err := readDirNames(dirAttach(iSvc) + iTid)
+   if err != nil {
+      if os.IsNotExist(err) { return }
+      quit(err)
+   }
+   aDoSync, aDoFfn := false, false
+   for _, aFile := range aDir {
+      aDoFfn = aDoFfn || aFile == "ffnindex"
+      if !strings.HasPrefix(aFile, iMid +"_") { continue }
+      aDoSync = true
+      err = os.Remove(dirAttach(iSvc) + iTid +"/"+ aFile)
+      if err != nil { quit(err) }
+   }
+   if !aDoSync {
+      return
+   }
+   dropBlobAttach(iSvc, iTid +"/"+ iMid +"_")
+   dropThumbAttach(iSvc, iTid, iMid +"_")
+   dropExtractAttach(iSvc, iTid, iMid +"_")
+   dropQuarantine(iSvc, iTid +"/"+ iMid +"_")
+   if !aDoFfn {
+      err = syncDir(dirAttach(iSvc) + iTid)
+      if err != nil { quit(err) }
+      return
+   }
+   aRec := tComplete{"", iTid, iMid}
+   aFfnIdx := _loadFfnIndex(iSvc, aRec)
+   err = syncDir(dirAttach(iSvc) + iTid)
+   if err != nil { quit(err) }
+   aN := len(aFfnIdx)
+   for aK := range aFfnIdx {
+      if strings.HasPrefix(aK, iMid +"_") { delete(aFfnIdx, aK) }
+   }
+   if len(aFfnIdx) != aN {
+      _updateFfnIndex(iSvc, aRec, aFfnIdx, &tHeader2{})
+   }
+}
+
+func deleteThreadAttach(iSvc string, iTid string) {
+   err := os.RemoveAll(dirAttach(iSvc) + iTid)
+   if err != nil { quit(err) }
+   dropBlobAttach(iSvc, iTid +"/")
+   dropThumbAttach(iSvc, iTid, "")
+   dropExtractAttach(iSvc, iTid, "")
+   dropQuarantine(iSvc, iTid +"/")
+   err = syncDir(dirAttach(iSvc))
+   if err != nil { quit(err) }
+}
+
 func writeStoredAttach(iW io.Writer, iSvc string, iSubHead *tHeader2) error {
    var aLen int64
    var err error
@@ -437,8 +532,8 @@ func writeStoredAttach(iW io.Writer, iSvc string, iSubHead *tHeader2) error {
       if _isFormFill(aFile.Name) {
          aLen, err = writeRowFilledForm(iW, iSvc, aFile.Ffn+kSuffixSent, iSubHead.ConfirmId, aFile.Name)
       } else {
-         var aFd *os.File
-         aFd, err = os.Open(fileAtc(iSvc, iSubHead.ThreadId, iSubHead.ConfirmId, aFile.Name))
+         var aFd *tFile
+         aFd, err = openFile(fileAtc(iSvc, iSubHead.ThreadId, iSubHead.ConfirmId, aFile.Name))
          if err != nil { quit(err) }
          aLen, err = io.Copy(iW, aFd)
          aFd.Close()
@@ -457,7 +552,7 @@ func writeStoredAttach(iW io.Writer, iSvc string, iSubHead *tHeader2) error {
 func totalAttach(iSubHead *tHeader2) int64 {
    if iSubHead.noAttachSize { return 0 }
    var aLen int64
-   for _, aFile := range iSubHead.Attach { aLen += aFile.Size }
+   for a := range iSubHead.Attach { aLen += iSubHead.Attach[a].wireSize() }
    return aLen
 }
 
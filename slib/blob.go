@@ -0,0 +1,194 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "crypto/sha256"
+   "encoding/hex"
+   "fmt"
+   "io"
+   "os"
+   "path"
+   "strings"
+)
+
+// Stored attachments are content-addressed: attach/blob/<sha256> holds one copy of each file,
+// and each attach/<tid>/<mid>_<name> is a hardlink to it. The blob-ref file maps each link
+// "tid/mid_name" to its checksum; a blob is removed when it has no refs.
+
+type tBlobRef map[string]string // "tid/file" -> checksum
+
+func _sumBlob(iPath string) string {
+   aFd, err := openFile(iPath)
+   if err != nil { quit(err) }
+   defer aFd.Close()
+   aH := sha256.New()
+   _, err = io.Copy(aH, aFd)
+   if err != nil { quit(err) }
+   return hex.EncodeToString(aH.Sum(nil))
+}
+
+// _linkBlob makes iPath a link to the blob for iSum, creating it if necessary
+// caller must hold aSvc lock and sync dirBlob() & path.Dir(iPath)
+func _linkBlob(iSvc string, iPath string, iSum string) {
+   aBlob := dirBlob(iSvc) + iSum
+   err := os.Link(iPath, aBlob)
+   if err == nil {
+      return
+   }
+   if !os.IsExist(err) { quit(err) }
+   aFi, err := os.Stat(iPath)
+   if err != nil { quit(err) }
+   aBi, err := os.Stat(aBlob)
+   if err != nil { quit(err) }
+   if os.SameFile(aFi, aBi) {
+      return
+   }
+   aTemp := dirTemp(iSvc) +"blob_"+ path.Base(iPath) +".tmp"
+   err = os.Remove(aTemp)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   err = os.Link(aBlob, aTemp)
+   if err != nil { quit(err) }
+   err = os.Rename(aTemp, iPath)
+   if err != nil { quit(err) }
+}
+
+func _makeDirBlob(iSvc string) {
+   err := os.Mkdir(dirBlob(iSvc), 0700)
+   if err != nil {
+      if !os.IsExist(err) { quit(err) }
+      return
+   }
+   err = syncDir(dirAttach(iSvc))
+   if err != nil { quit(err) }
+}
+
+// storeBlobAttach links the stored attachments of a message to blobs
+func storeBlobAttach(iSvc string, iSubHead *tHeader2, iRec tComplete) {
+   aSums := map[string]string{}
+   for _, aFile := range iSubHead.Attach {
+      if _isFormFill(aFile.Name) { continue }
+      aPath := fileAtc(iSvc, iRec.tid(), iRec.mid(), aFile.Name)
+      if _, err := os.Lstat(aPath); err != nil {
+         if !os.IsNotExist(err) { quit(err) }
+         continue
+      }
+      aSums[iRec.tid() +"/"+ path.Base(aPath)] = _sumBlob(aPath)
+   }
+   if len(aSums) == 0 {
+      return
+   }
+   _makeDirBlob(iSvc)
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   for aRef, aSum := range aSums {
+      _linkBlob(iSvc, dirAttach(iSvc) + aRef, aSum)
+      aSvc.blobRef[aRef] = aSum
+   }
+   err := syncDir(dirBlob(iSvc))
+   if err != nil { quit(err) }
+   err = syncDir(dirAttach(iSvc) + iRec.tid())
+   if err != nil { quit(err) }
+   err = storeFile(fileBlobRef(iSvc), aSvc.blobRef)
+   if err != nil { quit(err) }
+}
+
+// dropBlobAttach removes the refs starting with iPrefix, and any blobs left without refs
+func dropBlobAttach(iSvc string, iPrefix string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aDrop := map[string]bool{}
+   for aRef, aSum := range aSvc.blobRef {
+      if strings.HasPrefix(aRef, iPrefix) {
+         delete(aSvc.blobRef, aRef)
+         aDrop[aSum] = true
+      }
+   }
+   if len(aDrop) == 0 {
+      return
+   }
+   err := storeFile(fileBlobRef(iSvc), aSvc.blobRef)
+   if err != nil { quit(err) }
+   for _, aSum := range aSvc.blobRef {
+      delete(aDrop, aSum)
+   }
+   for aSum := range aDrop {
+      err = os.Remove(dirBlob(iSvc) + aSum)
+      if err != nil && !os.IsNotExist(err) { quit(err) }
+   }
+   err = syncDir(dirBlob(iSvc))
+   if err != nil { quit(err) }
+}
+
+// initBlobAttach converts an attach/ tree created before blobs; call before _openService()
+func initBlobAttach(iSvc string) {
+   err := resolveTmpFile(fileBlobRef(iSvc) + ".tmp")
+   if err != nil { quit(err) }
+   _, err = os.Lstat(fileBlobRef(iSvc))
+   if err == nil {
+      return
+   }
+   if !os.IsNotExist(err) { quit(err) }
+   _makeDirBlob(iSvc)
+   aRefs := tBlobRef{}
+   aDir, err := readDirNames(dirAttach(iSvc))
+   if err != nil { quit(err) }
+   for _, aSub := range aDir {
+      if aSub[0] == '_' || aSub == "blob" { continue } // draft-owned
+      var aFiles []string
+      aFiles, err = readDirNames(dirAttach(iSvc) + aSub)
+      if err != nil { quit(err) }
+      for _, aFile := range aFiles {
+         if aFile == "ffnindex" || strings.IndexByte(aFile, '_') == 12 { continue } // draft-owned
+         aPath := dirAttach(iSvc) + aSub +"/"+ aFile
+         aSum := _sumBlob(aPath)
+         _linkBlob(iSvc, aPath, aSum)
+         aRefs[aSub +"/"+ aFile] = aSum
+      }
+      err = syncDir(dirAttach(iSvc) + aSub)
+      if err != nil { quit(err) }
+   }
+   err = syncDir(dirBlob(iSvc))
+   if err != nil { quit(err) }
+   aTemp := fileBlobRef(iSvc) + ".tmp"
+   err = os.Remove(aTemp)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   err = writeJsonFile(aTemp, aRefs)
+   if err != nil { quit(err) }
+   err = os.Rename(aTemp, fileBlobRef(iSvc))
+   if err != nil { quit(err) }
+   err = syncDir(dirSvc(iSvc))
+   if err != nil { quit(err) }
+   fmt.Printf("initBlobAttach %s: converted %d attachments\n", iSvc, len(aRefs))
+}
+
+// sweepBlobAttach drops blobs without refs, e.g. after a crash; call after _openService()
+func sweepBlobAttach(iSvc string) {
+   aDir, err := readDirNames(dirBlob(iSvc))
+   if err != nil {
+      if os.IsNotExist(err) { return }
+      quit(err)
+   }
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aHas := make(map[string]bool, len(aSvc.blobRef))
+   for _, aSum := range aSvc.blobRef {
+      aHas[aSum] = true
+   }
+   aDoSync := false
+   for _, aSum := range aDir {
+      if aHas[aSum] { continue }
+      err = os.Remove(dirBlob(iSvc) + aSum)
+      if err != nil { quit(err) }
+      aDoSync = true
+   }
+   if aDoSync {
+      err = syncDir(dirBlob(iSvc))
+      if err != nil { quit(err) }
+   }
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "compress/flate"
+   "fmt"
+   "io"
+   "io/ioutil"
+   "os"
+   "path"
+   "strings"
+)
+
+// Attachments are compressed on the wire if every recipient accepts the codec. Pings & messages
+// give the codecs accepted by the sender in tHeader2.Accept. A compressed attachment has
+// tHeader2Attach.Codec and .WireSize; .Size remains the original length. The wire form of a
+// draft's attachments is made once at send, in temp files; see writeWireAttach().
+
+const kCodecDeflate = "deflate"
+const kCodecMin = 1024 // smaller files aren't compressed
+
+var kCodecAccept = []string{kCodecDeflate, kCodecDelta}
+
+var kCodecSkipExt = map[string]bool{ // already compressed
+   ".jpg":true, ".jpeg":true, ".png":true, ".gif":true, ".webp":true, ".heic":true,
+   ".mp3":true, ".mp4":true, ".m4a":true, ".mov":true, ".mkv":true, ".webm":true, ".ogg":true,
+   ".zip":true, ".gz":true, ".tgz":true, ".bz2":true, ".xz":true, ".zst":true, ".7z":true,
+   ".rar":true, ".jar":true, ".apk":true, ".pdf":true,
+   ".docx":true, ".xlsx":true, ".pptx":true, ".odt":true, ".ods":true, ".odp":true,
+}
+
+// wireSize gives the length of an attachment in a message
+func (o *tHeader2Attach) wireSize() int64 {
+   if o.Codec != "" {
+      return o.WireSize
+   }
+   return o.Size
+}
+
+// addAcceptCodec records the codecs accepted by a uid, and replicates a change to our other nodes
+func addAcceptCodec(iSvc string, iUid string, iAccept []string) {
+   if iUid == "" || iUid == GetConfigService(iSvc).Uid {
+      return
+   }
+   aSvc := getService(iSvc)
+   aSvc.RLock()
+   aSame := strings.Join(aSvc.accept[iUid], ",") == strings.Join(iAccept, ",")
+   aSvc.RUnlock()
+   if aSame {
+      return
+   }
+   aSvc.updt.RLock(); defer aSvc.updt.RUnlock()
+   aUpdt := Update{Op: "accept_codec", Codec: &UpdateCodec{Uid: iUid, Accept: iAccept}}
+   aState := ClientState{id: "addAcceptCodec", History: []string{""}}
+   syncUpdtNode(iSvc, &aUpdt, &aState, func() error {
+      if !setAcceptCodec(iSvc, iUid, iAccept) { return tError("") } // no sync
+      return nil
+   })
+}
+
+// setAcceptCodec stores the codecs accepted by a uid; false if unchanged
+func setAcceptCodec(iSvc string, iUid string, iAccept []string) bool {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   if strings.Join(aSvc.accept[iUid], ",") == strings.Join(iAccept, ",") {
+      return false
+   }
+   if iAccept == nil {
+      delete(aSvc.accept, iUid)
+   } else {
+      aSvc.accept[iUid] = iAccept
+   }
+   err := storeFile(fileAccept(iSvc), aSvc.accept)
+   if err != nil { quit(err) }
+   return true
+}
+
+// _acceptCodec checks whether every recipient accepts a codec; our other nodes are assumed to
+func _acceptCodec(iSvc string, iCc []tCcEl, iCodec string) bool {
+   aUid := GetConfigService(iSvc).Uid
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   for _, aCc := range iCc {
+      if aCc.WhoUid == aUid { continue }
+      aOk := false
+      for _, aC := range aSvc.accept[aCc.WhoUid] {
+         aOk = aOk || aC == iCodec
+      }
+      if !aOk {
+         return false
+      }
+   }
+   return true
+}
+
+// compressDraftAttach sets Codec & WireSize for draft attachments which compress;
+// the compressed data is stored in a temp file
+func compressDraftAttach(iSvc string, iSubHead *tHeader2, iId tLocalId, iCc []tCcEl) {
+   if !_acceptCodec(iSvc, iCc, kCodecDeflate) {
+      return
+   }
+   aTid := iId.tid(); if aTid == "" { aTid = "_" + iId.lms() }
+   for a := range iSubHead.Attach {
+      aFile := &iSubHead.Attach[a]
+      if _isFormFill(aFile.Name) || aFile.Size < kCodecMin || aFile.Codec != "" ||
+         kCodecSkipExt[strings.ToLower(path.Ext(aFile.Name))] { continue }
+      aFd, err := openFile(fileAtc(iSvc, aTid, iId.lms(), aFile.Name))
+      if err != nil { quit(err) }
+      aWire := ftmpWire(iSvc, iId.lms(), aFile.Name)
+      aWd, err := openFileFlags(aWire, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+      if err != nil { quit(err) }
+      aCw := tCountWriter{w: aWd}
+      err = _writeCodec(&aCw, aFd, aFile.Size)
+      aFd.Close(); aWd.Close()
+      if err != nil { quit(err) }
+      if aCw.n >= aFile.Size {
+         err = os.Remove(aWire) // not worth it
+         if err != nil { quit(err) }
+         continue
+      }
+      aFile.Codec, aFile.WireSize = kCodecDeflate, aCw.n
+   }
+}
+
+// writeWireAttach sends an attachment's wire form, made by compressDraftAttach() or
+// deltaDraftAttach() so that it's computed once, and a delta's base needn't exist at this point
+func writeWireAttach(iW io.Writer, iSvc string, iId tLocalId, iFile *tHeader2Attach) error {
+   aWd, err := openFile(ftmpWire(iSvc, iId.lms(), iFile.Name))
+   if err != nil { quit(err) }
+   defer aWd.Close()
+   aLen, err := io.Copy(iW, aWd)
+   if err != nil { return err }
+   if aLen != iFile.WireSize {
+      quit(tError(fmt.Sprintf("wire size changed for %s", iFile.Name)))
+   }
+   return nil
+}
+
+// dropWireAttach removes the temp files made for a draft's attachments with a Codec
+func dropWireAttach(iSvc string, iSubHead *tHeader2, iId tLocalId) {
+   for _, aFile := range iSubHead.Attach {
+      if aFile.Codec == "" { continue }
+      err := os.Remove(ftmpWire(iSvc, iId.lms(), aFile.Name))
+      if err != nil && !os.IsNotExist(err) { quit(err) }
+   }
+}
+
+func _writeCodec(iW io.Writer, iR io.Reader, iLen int64) error {
+   aZw, err := flate.NewWriter(iW, flate.DefaultCompression)
+   if err != nil { quit(err) }
+   _, err = io.CopyN(aZw, iR, iLen)
+   if err != nil { return err }
+   return aZw.Close()
+}
+
+// readCodec stores an attachment received per iFile.Codec; it always consumes WireSize bytes
+func readCodec(iW io.Writer, iR io.Reader, iFile *tHeader2Attach) error {
+   aLr := &io.LimitedReader{R: iR, N: iFile.WireSize}
+   if iFile.Codec != kCodecDeflate {
+      _, err := io.Copy(ioutil.Discard, aLr)
+      if err != nil { return err }
+      return tError("unknown codec "+ iFile.Codec +" for "+ iFile.Name)
+   }
+   aZr := flate.NewReader(aLr)
+   aLen, err := io.Copy(iW, io.LimitReader(aZr, iFile.Size + 1))
+   aZr.Close()
+   if aLr.N > 0 {
+      _, errDrain := io.Copy(ioutil.Discard, aLr)
+      if errDrain != nil { return errDrain }
+   }
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "readCodec: %s %v\n", iFile.Name, err)
+      return tError("invalid compressed data for "+ iFile.Name)
+   }
+   if aLen != iFile.Size {
+      return tError("decompressed size mismatch for "+ iFile.Name)
+   }
+   return nil
+}
+
+type tCountWriter struct {
+   w io.Writer
+   n int64
+}
+
+func (o *tCountWriter) Write(iBuf []byte) (int, error) {
+   aLen, err := o.w.Write(iBuf)
+   o.n += int64(aLen)
+   return aLen, err
+}
@@ -0,0 +1,612 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "crypto/aes"
+   "crypto/cipher"
+   "crypto/hmac"
+   "crypto/rand"
+   "crypto/sha256"
+   "encoding/binary"
+   "encoding/json"
+   "fmt"
+   "io"
+   "io/ioutil"
+   "net/http"
+   "os"
+   "path"
+   "path/filepath"
+
+   pPbkdf2 "golang.org/x/crypto/pbkdf2"
+)
+
+// Encryption at rest: when store/key exists, every file opened via openFile*() starts with
+// a header giving the data key id and a random file id, followed by the contents in chunks,
+// each sealed with AES-256-GCM and a fresh nonce whenever it's written. A chunk's file id &
+// number are authenticated with it, so chunks can't be moved. Chunks permit the random-access
+// reads & rewrites used for thread files. Files without a valid header are refused, except
+// while _rekeyCrypt() runs. The search index (bleve) manages its own files, so it's kept in
+// memory; see openIndexSearch().
+
+const kCryptFile = kStorageDir + "key"
+const kCryptMagic = "mnmC"
+const kCryptHeadLen = int64(len(kCryptMagic) + 1 + kCryptIdLen + kCryptTagLen) // magic, key id, file id, tag
+const kCryptIdLen = 16
+const kCryptTagLen = 8
+const kCryptChunk = 4096 // contents per record
+const kCryptNonceLen = 12
+const kCryptSealLen = kCryptNonceLen + 16 // nonce, GCM tag
+const kCryptRecord = kCryptChunk + kCryptSealLen
+const kCryptIter = 200000
+
+type tCryptKeyfile struct {
+   Salt []byte
+   Iter int
+   Keys []tCryptKeyEl // last is current
+   Rekey bool // files may use a prior key
+}
+
+type tCryptKeyEl struct {
+   Id byte
+   Nonce []byte
+   Sealed []byte // data key, sealed with AES-GCM using key derived from passphrase
+}
+
+type tCryptKey struct {
+   gcm cipher.AEAD
+   data []byte
+}
+
+// set before Init(), then read-only
+var sCryptKeys = map[byte]*tCryptKey{}
+var sCryptCur byte
+var sCryptMixed bool // plaintext files are readable
+
+func HasKeyCrypt() bool {
+   _, err := os.Lstat(kCryptFile)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   return err == nil
+}
+
+func UnlockCrypt(iPass string) error {
+   aKf, err := _unlockCrypt(iPass)
+   if err != nil { return err }
+   if aKf.Rekey {
+      fmt.Printf("UnlockCrypt: resuming key rotation\n")
+      _rekeyCrypt(aKf)
+   }
+   return nil
+}
+
+// EnableCrypt creates a data key and encrypts all existing files
+func EnableCrypt(iNew string) error {
+   if HasKeyCrypt() {
+      return tError("store already encrypted")
+   }
+   err := os.MkdirAll(kTempDir, 0700)
+   if err != nil { quit(err) }
+   aKf := &tCryptKeyfile{Rekey: true}
+   _newKeyCrypt(aKf, 1, iNew)
+   _rekeyCrypt(aKf)
+   return nil
+}
+
+// RotateCrypt replaces the passphrase and data key, and re-encrypts all files
+func RotateCrypt(iPass, iNew string) error {
+   aKf, err := _unlockCrypt(iPass)
+   if err != nil { return err }
+   aKf.Rekey = true
+   _newKeyCrypt(aKf, aKf.Keys[len(aKf.Keys)-1].Id % 255 + 1, iNew)
+   _rekeyCrypt(aKf)
+   return nil
+}
+
+func _unlockCrypt(iPass string) (*tCryptKeyfile, error) {
+   aBuf, err := ioutil.ReadFile(kCryptFile)
+   if err != nil { quit(err) }
+   var aKf tCryptKeyfile
+   err = json.Unmarshal(aBuf, &aKf)
+   if err != nil { quit(err) }
+   aGcm := _gcmCrypt(_deriveCrypt(iPass, aKf.Salt, aKf.Iter))
+   for _, aEl := range aKf.Keys {
+      aData, err := aGcm.Open(nil, aEl.Nonce, aEl.Sealed, []byte{aEl.Id})
+      if err != nil {
+         return nil, tError("incorrect passphrase")
+      }
+      _addKeyCrypt(aEl.Id, aData)
+   }
+   sCryptCur = aKf.Keys[len(aKf.Keys)-1].Id
+   return &aKf, nil
+}
+
+// _newKeyCrypt adds a data key and re-seals all keys with a new passphrase
+func _newKeyCrypt(iKf *tCryptKeyfile, iId byte, iNew string) {
+   if sCryptKeys[iId] != nil { quit(tError("key id in use")) }
+   aData := _randCrypt(32)
+   _addKeyCrypt(iId, aData)
+   iKf.Keys = append(iKf.Keys, tCryptKeyEl{Id: iId, Sealed: aData})
+   for a := 0; a < len(iKf.Keys)-1; a++ {
+      iKf.Keys[a].Sealed = sCryptKeys[iKf.Keys[a].Id].data
+   }
+   iKf.Salt = _randCrypt(16)
+   iKf.Iter = kCryptIter
+   aGcm := _gcmCrypt(_deriveCrypt(iNew, iKf.Salt, iKf.Iter))
+   for a := range iKf.Keys {
+      iKf.Keys[a].Nonce = _randCrypt(aGcm.NonceSize())
+      iKf.Keys[a].Sealed = aGcm.Seal(nil, iKf.Keys[a].Nonce, iKf.Keys[a].Sealed, []byte{iKf.Keys[a].Id})
+   }
+   _storeKeyfileCrypt(iKf)
+   sCryptCur = iId
+}
+
+// _rekeyCrypt encrypts with the current key any file not using it, then drops prior keys
+func _rekeyCrypt(iKf *tCryptKeyfile) {
+   aTemp := kTempDir + "rekey"
+   aLinks := map[uint64]string{} // inode before rekey, rekeyed path
+   sCryptMixed = true
+   err := filepath.Walk(kStorageDir, func(cPath string, cFi os.FileInfo, cErr error) error {
+      if cErr != nil { quit(cErr) }
+      cPath = filepath.ToSlash(cPath)
+      if cFi.IsDir() {
+         if cFi.Name() == "index.bleve" { // see fileIndex()
+            err := os.RemoveAll(cPath) // replaced by a memory index
+            if err != nil { quit(err) }
+            return filepath.SkipDir
+         }
+         return nil
+      }
+      if !cFi.Mode().IsRegular() || cPath == kCryptFile || cPath == kCryptFile +".tmp" ||
+         cPath == aTemp { return nil }
+      if _keyIdCrypt(cPath) == sCryptCur { return nil }
+      cIno, err := getInode(path.Dir(cPath), cFi)
+      if err != nil { quit(err) }
+      err = os.Remove(aTemp)
+      if err != nil && !os.IsNotExist(err) { quit(err) }
+      if aLinks[cIno] != "" {
+         err = os.Link(aLinks[cIno], aTemp)
+         if err != nil { quit(err) }
+      } else {
+         cSd, err := openFile(cPath)
+         if err != nil { quit(err) }
+         cTd, err := openFileFlags(aTemp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, cFi.Mode().Perm())
+         if err != nil { quit(err) }
+         _, err = io.Copy(cTd, cSd)
+         if err != nil { quit(err) }
+         err = cTd.Sync()
+         if err != nil { quit(err) }
+         cTd.Close()
+         cSd.Close()
+         err = os.Chtimes(aTemp, cFi.ModTime(), cFi.ModTime())
+         if err != nil { quit(err) }
+      }
+      err = os.Rename(aTemp, cPath)
+      if err != nil { quit(err) }
+      err = syncDir(path.Dir(cPath))
+      if err != nil { quit(err) }
+      aLinks[cIno] = cPath
+      return nil
+   })
+   if err != nil { quit(err) }
+   for aK := range sCryptKeys {
+      if aK != sCryptCur {
+         delete(sCryptKeys, aK)
+      }
+   }
+   sCryptMixed = false
+   iKf.Keys = iKf.Keys[len(iKf.Keys)-1:]
+   iKf.Rekey = false
+   _storeKeyfileCrypt(iKf)
+   fmt.Printf("_rekeyCrypt: store encrypted with key %d\n", sCryptCur)
+}
+
+func _storeKeyfileCrypt(iKf *tCryptKeyfile) {
+   aBuf, err := json.Marshal(iKf)
+   if err != nil { quit(err) }
+   aTemp := kCryptFile + ".tmp"
+   aFd, err := os.OpenFile(aTemp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+   if err != nil { quit(err) }
+   _, err = aFd.Write(aBuf)
+   if err != nil { quit(err) }
+   err = aFd.Sync()
+   if err != nil { quit(err) }
+   aFd.Close()
+   err = os.Rename(aTemp, kCryptFile)
+   if err != nil { quit(err) }
+   err = syncDir(kStorageDir)
+   if err != nil { quit(err) }
+}
+
+func _addKeyCrypt(iId byte, iData []byte) {
+   sCryptKeys[iId] = &tCryptKey{gcm: _gcmCrypt(iData), data: iData}
+}
+
+func _deriveCrypt(iPass string, iSalt []byte, iIter int) []byte {
+   return pPbkdf2.Key([]byte(iPass), iSalt, iIter, 32, sha256.New)
+}
+
+func _gcmCrypt(iKey []byte) cipher.AEAD {
+   aBlock, err := aes.NewCipher(iKey)
+   if err != nil { quit(err) }
+   aGcm, err := cipher.NewGCM(aBlock)
+   if err != nil { quit(err) }
+   return aGcm
+}
+
+func _randCrypt(iLen int) []byte {
+   aBuf := make([]byte, iLen)
+   _, err := rand.Read(aBuf)
+   if err != nil { quit(err) }
+   return aBuf
+}
+
+func _tagCrypt(iKey *tCryptKey, iHead []byte) []byte {
+   aMac := hmac.New(sha256.New, iKey.data)
+   aMac.Write(iHead)
+   return aMac.Sum(nil)[:kCryptTagLen]
+}
+
+// _parseHeadCrypt returns the key for a valid header, or nil for a plaintext file
+func _parseHeadCrypt(iHead []byte) *tCryptKey {
+   if int64(len(iHead)) < kCryptHeadLen || string(iHead[:len(kCryptMagic)]) != kCryptMagic {
+      return nil
+   }
+   aKey := sCryptKeys[iHead[len(kCryptMagic)]]
+   if aKey == nil {
+      return nil
+   }
+   aTagPos := kCryptHeadLen - kCryptTagLen
+   if !hmac.Equal(_tagCrypt(aKey, iHead[:aTagPos]), iHead[aTagPos:kCryptHeadLen]) {
+      return nil
+   }
+   return aKey
+}
+
+func _keyIdCrypt(iPath string) byte {
+   aFd, err := os.Open(iPath)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return 0 // dropped
+   }
+   defer aFd.Close()
+   aHead := make([]byte, kCryptHeadLen)
+   _, err = io.ReadFull(aFd, aHead)
+   if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF { quit(err) }
+   if _parseHeadCrypt(aHead) == nil {
+      return 0
+   }
+   return aHead[len(kCryptMagic)]
+}
+
+// sizeFile gives the size of the contents of a file stat'd by path
+func sizeFile(iPath string, iFi os.FileInfo) int64 {
+   if len(sCryptKeys) == 0 || !iFi.Mode().IsRegular() || iFi.Size() < kCryptHeadLen {
+      return iFi.Size()
+   }
+   if _keyIdCrypt(iPath) == 0 {
+      return iFi.Size()
+   }
+   return _sizeCrypt(iFi.Size() - kCryptHeadLen)
+}
+
+// _sizeCrypt gives the size of the contents from the size of the records
+func _sizeCrypt(iLen int64) int64 {
+   aRem := iLen % kCryptRecord - kCryptSealLen
+   if aRem < 0 {
+      aRem = 0
+   }
+   return iLen / kCryptRecord * kCryptChunk + aRem
+}
+
+// ServeFile is http.ServeFile for files which may be encrypted
+func ServeFile(iResp http.ResponseWriter, iReq *http.Request, iPath string) {
+   aFd, err := openFile(iPath)
+   if err != nil {
+      if !os.IsNotExist(err) && !os.IsPermission(err) {
+         fmt.Fprintf(os.Stderr, "ServeFile: %v\n", err)
+      }
+      http.NotFound(iResp, iReq)
+      return
+   }
+   defer aFd.Close()
+   aFi, err := aFd.Stat()
+   if err != nil { quit(err) }
+   if aType := _mediaType(iPath); aType != "" {
+      iResp.Header().Set("Content-Type", aType)
+   }
+   http.ServeContent(iResp, iReq, path.Base(iPath), aFi.ModTime(), aFd)
+}
+
+// tFile wraps os.File, encrypting contents if a key is loaded.
+// It omits ReadFrom & WriteTo so io.Copy() can't bypass it.
+type tFile struct {
+   fd *os.File
+   key *tCryptKey // nil for plaintext
+   id []byte // from header
+   head int64
+   pos int64 // of contents
+   rec []byte // record buffer
+   text []byte // contents of a chunk
+   cache int64 // chunk number + 1 of a full chunk in text, or 0
+   empty bool // opened empty & read-only, so header may arrive later
+}
+
+type tFileInfo struct {
+   os.FileInfo
+   size int64
+}
+
+func (o tFileInfo) Size() int64 { return o.size }
+
+func openFile(iPath string) (*tFile, error) {
+   return openFileFlags(iPath, os.O_RDONLY, 0)
+}
+
+func openFileFlags(iPath string, iFlag int, iPerm os.FileMode) (*tFile, error) {
+   if len(sCryptKeys) > 0 && (iFlag & (os.O_WRONLY | os.O_RDWR | os.O_CREATE) != 0) {
+      iFlag = iFlag &^ os.O_WRONLY | os.O_RDWR // header & records may be read or written
+   }
+   aFd, err := os.OpenFile(iPath, iFlag, iPerm)
+   if err != nil { return nil, err }
+   aF := &tFile{fd: aFd}
+   if len(sCryptKeys) == 0 {
+      return aF, nil
+   }
+   aHead := make([]byte, kCryptHeadLen)
+   aLen, err := io.ReadFull(aFd, aHead)
+   if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+      aFd.Close()
+      return nil, err
+   }
+   if aLen == 0 {
+      if iFlag & os.O_RDWR == 0 {
+         aF.empty = true // e.g. attachment being received, see ServeStreamAttach()
+         return aF, nil
+      }
+      aKey := sCryptKeys[sCryptCur]
+      aHead = append(append(aHead[:0], kCryptMagic...), sCryptCur)
+      aHead = append(aHead, _randCrypt(kCryptIdLen)...)
+      aHead = append(aHead, _tagCrypt(aKey, aHead)...)
+      _, err = aFd.Write(aHead)
+      if err != nil {
+         aFd.Close()
+         return nil, err
+      }
+   }
+   err = aF._setHead(aHead)
+   if err != nil {
+      aFd.Close()
+      return nil, err
+   }
+   return aF, nil
+}
+
+func (o *tFile) _setHead(iHead []byte) error {
+   if o.key = _parseHeadCrypt(iHead); o.key == nil {
+      if !sCryptMixed {
+         return &os.PathError{Op: "open", Path: o.fd.Name(), Err: tError("not encrypted with a known key")}
+      }
+      _, err := o.fd.Seek(0, io.SeekStart) // plaintext during _rekeyCrypt()
+      return err
+   }
+   o.id = iHead[len(kCryptMagic)+1 : len(kCryptMagic)+1+kCryptIdLen]
+   o.head = kCryptHeadLen
+   o.rec = make([]byte, kCryptRecord)
+   o.text = make([]byte, 0, kCryptChunk)
+   return nil
+}
+
+// _probe reads the header of a file that was empty when opened
+func (o *tFile) _probe() error {
+   if !o.empty {
+      return nil
+   }
+   aHead := make([]byte, kCryptHeadLen)
+   aLen, err := o.fd.ReadAt(aHead, 0)
+   if aLen < len(aHead) {
+      if err == io.EOF { err = nil }
+      return err // header incomplete
+   }
+   o.empty = false
+   return o._setHead(aHead)
+}
+
+func (o *tFile) _errCrypt(iOp string) error {
+   return &os.PathError{Op: iOp, Path: o.fd.Name(), Err: tError("decryption failed")}
+}
+
+// _adCrypt binds a record to its file & position
+func (o *tFile) _adCrypt(iN int64) []byte {
+   aAd := make([]byte, kCryptIdLen + 8)
+   copy(aAd, o.id)
+   binary.BigEndian.PutUint64(aAd[kCryptIdLen:], uint64(iN))
+   return aAd
+}
+
+func (o *tFile) _size() (int64, error) {
+   aFi, err := o.fd.Stat()
+   if err != nil { return 0, err }
+   return _sizeCrypt(aFi.Size() - o.head), nil
+}
+
+// _readChunk returns the contents of chunk iN, which are empty past the end of file
+func (o *tFile) _readChunk(iN int64) ([]byte, error) {
+   if o.cache == iN+1 {
+      return o.text, nil
+   }
+   o.cache = 0
+   var err error
+   for aTry := 0; true; aTry++ { // a concurrent write of the last chunk may tear a read
+      var aLen int
+      aLen, err = o.fd.ReadAt(o.rec, o.head + iN * kCryptRecord)
+      if err != nil && err != io.EOF { return nil, err }
+      if aLen == 0 {
+         return o.text[:0], nil
+      }
+      if aLen > kCryptSealLen {
+         var aText []byte
+         aText, err = o.key.gcm.Open(o.text[:0], o.rec[:kCryptNonceLen], o.rec[kCryptNonceLen:aLen],
+                                     o._adCrypt(iN))
+         if err == nil {
+            o.text = aText
+            break
+         }
+      }
+      if aTry == 2 {
+         return nil, o._errCrypt("read")
+      }
+   }
+   if len(o.text) == kCryptChunk {
+      o.cache = iN+1
+   }
+   return o.text, nil
+}
+
+// _writeChunk seals the contents of chunk iN with a new nonce
+func (o *tFile) _writeChunk(iN int64, iText []byte) error {
+   o.cache = 0
+   aNonce := o.rec[:kCryptNonceLen]
+   _, err := rand.Read(aNonce)
+   if err != nil { quit(err) }
+   aRec := o.key.gcm.Seal(aNonce, aNonce, iText, o._adCrypt(iN))
+   _, err = o.fd.WriteAt(aRec, o.head + iN * kCryptRecord)
+   return err
+}
+
+func (o *tFile) Read(iBuf []byte) (int, error) {
+   if err := o._probe(); err != nil {
+      return 0, err
+   }
+   if o.key == nil {
+      return o.fd.Read(iBuf)
+   }
+   aDone := 0
+   for aDone < len(iBuf) {
+      aText, err := o._readChunk(o.pos / kCryptChunk)
+      if err != nil { return aDone, err }
+      aOff := int(o.pos % kCryptChunk)
+      if aOff >= len(aText) { break }
+      aLen := copy(iBuf[aDone:], aText[aOff:])
+      aDone += aLen
+      o.pos += int64(aLen)
+      if len(aText) < kCryptChunk { break } // last chunk
+   }
+   if aDone == 0 && len(iBuf) > 0 {
+      return 0, io.EOF
+   }
+   return aDone, nil
+}
+
+func (o *tFile) Write(iBuf []byte) (int, error) {
+   if o.key == nil {
+      return o.fd.Write(iBuf)
+   }
+   aLen, err := o.WriteAt(iBuf, o.pos)
+   o.pos += int64(aLen)
+   return aLen, err
+}
+
+func (o *tFile) WriteAt(iBuf []byte, iPos int64) (int, error) {
+   if o.key == nil {
+      return o.fd.WriteAt(iBuf, iPos)
+   }
+   aSize, err := o._size()
+   if err != nil { return 0, err }
+   if iPos > aSize {
+      _, err = o._writeText(make([]byte, iPos - aSize), aSize) // fill gap
+      if err != nil { return 0, err }
+   }
+   return o._writeText(iBuf, iPos)
+}
+
+// _writeText rewrites each chunk it touches; iPos must not exceed the contents size
+func (o *tFile) _writeText(iBuf []byte, iPos int64) (int, error) {
+   aDone := 0
+   for aDone < len(iBuf) {
+      aPos := iPos + int64(aDone)
+      aN, aOff := aPos / kCryptChunk, int(aPos % kCryptChunk)
+      aText, err := o._readChunk(aN)
+      if err != nil { return aDone, err }
+      aLen := kCryptChunk - aOff
+      if aLen > len(iBuf) - aDone {
+         aLen = len(iBuf) - aDone
+      }
+      if len(aText) < aOff + aLen {
+         aText = aText[:aOff + aLen]
+      }
+      copy(aText[aOff:], iBuf[aDone:aDone+aLen])
+      err = o._writeChunk(aN, aText)
+      if err != nil { return aDone, err }
+      aDone += aLen
+   }
+   return aDone, nil
+}
+
+func (o *tFile) Seek(iOffset int64, iWhence int) (int64, error) {
+   if err := o._probe(); err != nil {
+      return 0, err
+   }
+   if o.key == nil {
+      return o.fd.Seek(iOffset, iWhence)
+   }
+   switch iWhence {
+   case io.SeekStart:
+   case io.SeekCurrent:
+      iOffset += o.pos
+   case io.SeekEnd:
+      aSize, err := o._size()
+      if err != nil { return 0, err }
+      iOffset += aSize
+   default:
+      iOffset = -1
+   }
+   if iOffset < 0 {
+      return 0, &os.PathError{Op: "seek", Path: o.fd.Name(), Err: os.ErrInvalid}
+   }
+   o.pos = iOffset
+   return o.pos, nil
+}
+
+func (o *tFile) Truncate(iSize int64) error {
+   if o.key == nil {
+      return o.fd.Truncate(iSize)
+   }
+   aSize, err := o._size()
+   if err != nil { return err }
+   if iSize >= aSize {
+      if iSize > aSize {
+         _, err = o.WriteAt(nil, iSize)
+      }
+      return err
+   }
+   aN, aOff := iSize / kCryptChunk, int(iSize % kCryptChunk)
+   aEnd := o.head + aN * kCryptRecord
+   if aOff > 0 {
+      aText, err := o._readChunk(aN)
+      if err != nil { return err }
+      err = o._writeChunk(aN, aText[:aOff])
+      if err != nil { return err }
+      aEnd += int64(kCryptSealLen + aOff)
+   }
+   o.cache = 0
+   return o.fd.Truncate(aEnd)
+}
+
+func (o *tFile) Stat() (os.FileInfo, error) {
+   if err := o._probe(); err != nil {
+      return nil, err
+   }
+   aFi, err := o.fd.Stat()
+   if err != nil || (o.key == nil && !o.empty) { return aFi, err }
+   if o.empty { return tFileInfo{aFi, 0}, nil } // header incomplete
+   return tFileInfo{aFi, _sizeCrypt(aFi.Size() - o.head)}, nil
+}
+
+func (o *tFile) Sync() error  { return o.fd.Sync() }
+func (o *tFile) Close() error { return o.fd.Close() }
+func (o *tFile) Name() string { return o.fd.Name() }
@@ -0,0 +1,146 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "bytes"
+   "io"
+   "os"
+   "path/filepath"
+   "testing"
+)
+
+func _testKeyCrypt(i *testing.T) {
+   aKeys, aCur := sCryptKeys, sCryptCur
+   sCryptKeys = map[byte]*tCryptKey{}
+   sCryptCur = 1
+   _addKeyCrypt(sCryptCur, _randCrypt(32))
+   i.Cleanup(func() { sCryptKeys, sCryptCur = aKeys, aCur })
+}
+
+func _testDataCrypt(iLen int) []byte {
+   aBuf := make([]byte, iLen)
+   for a := range aBuf {
+      aBuf[a] = byte(a * 7 + a / kCryptChunk)
+   }
+   return aBuf
+}
+
+func TestFileCrypt(i *testing.T) {
+   _testKeyCrypt(i)
+   for _, aLen := range []int{0, 1, kCryptChunk-1, kCryptChunk, kCryptChunk+1, 3*kCryptChunk + 100} {
+      aPath := filepath.Join(i.TempDir(), "f")
+      aData := _testDataCrypt(aLen)
+      aFd, err := openFileFlags(aPath, os.O_WRONLY|os.O_CREATE, 0600)
+      if err != nil { i.Fatal(err) }
+      for aPos := 0; aPos < aLen; aPos += 1000 { // writes straddle chunks
+         aEnd := aPos + 1000
+         if aEnd > aLen { aEnd = aLen }
+         _, err = aFd.Write(aData[aPos:aEnd])
+         if err != nil { i.Fatal(err) }
+      }
+      aFd.Close()
+
+      aFi, err := os.Stat(aPath)
+      if err != nil { i.Fatal(err) }
+      if aLen > 0 && aFi.Size() == int64(aLen) + kCryptHeadLen {
+         i.Errorf("len %d: file not encrypted", aLen)
+      }
+      if aSize := sizeFile(aPath, aFi); aSize != int64(aLen) {
+         i.Errorf("len %d: sizeFile() = %d", aLen, aSize)
+      }
+      aFd, err = openFile(aPath)
+      if err != nil { i.Fatal(err) }
+      aOut, err := io.ReadAll(aFd)
+      if err != nil || !bytes.Equal(aOut, aData) {
+         i.Errorf("len %d: read back %d bytes, %v", aLen, len(aOut), err)
+      }
+      if aLen >= kCryptChunk + 10 {
+         _, err = aFd.Seek(kCryptChunk - 10, io.SeekStart)
+         if err != nil { i.Fatal(err) }
+         aOut = make([]byte, 20)
+         _, err = io.ReadFull(aFd, aOut)
+         if err != nil || !bytes.Equal(aOut, aData[kCryptChunk-10:kCryptChunk+10]) {
+            i.Errorf("len %d: seek & read %v", aLen, err)
+         }
+      }
+      aFd.Close()
+   }
+}
+
+func TestFileCryptRewrite(i *testing.T) {
+   _testKeyCrypt(i)
+   aPath := filepath.Join(i.TempDir(), "f")
+   aData := _testDataCrypt(2*kCryptChunk + 10)
+   aFd, err := openFileFlags(aPath, os.O_RDWR|os.O_CREATE, 0600)
+   if err != nil { i.Fatal(err) }
+   defer aFd.Close()
+   _, err = aFd.Write(aData)
+   if err != nil { i.Fatal(err) }
+
+   aPatch := bytes.Repeat([]byte{0xee}, 30)
+   _, err = aFd.WriteAt(aPatch, kCryptChunk - 15)
+   if err != nil { i.Fatal(err) }
+   copy(aData[kCryptChunk-15:], aPatch)
+
+   _, err = aFd.WriteAt([]byte("end"), int64(len(aData)) + 5) // leaves a gap of zeros
+   if err != nil { i.Fatal(err) }
+   aData = append(append(aData, make([]byte, 5)...), "end"...)
+
+   for _, aSize := range []int64{int64(len(aData)), kCryptChunk + 1, kCryptChunk, 5} {
+      err = aFd.Truncate(aSize)
+      if err != nil { i.Fatal(err) }
+      aData = aData[:aSize]
+      aFi, err := aFd.Stat()
+      if err != nil || aFi.Size() != aSize {
+         i.Errorf("Truncate(%d) then Stat() = %v", aSize, err)
+      }
+      _, err = aFd.Seek(0, io.SeekStart)
+      if err != nil { i.Fatal(err) }
+      aOut, err := io.ReadAll(aFd)
+      if err != nil || !bytes.Equal(aOut, aData) {
+         i.Errorf("Truncate(%d) then read %d bytes, %v", aSize, len(aOut), err)
+      }
+   }
+}
+
+func TestFileCryptTamper(i *testing.T) {
+   _testKeyCrypt(i)
+   aPath := filepath.Join(i.TempDir(), "f")
+   aFd, err := openFileFlags(aPath, os.O_WRONLY|os.O_CREATE, 0600)
+   if err != nil { i.Fatal(err) }
+   _, err = aFd.Write(_testDataCrypt(2*kCryptChunk))
+   aFd.Close()
+   if err != nil { i.Fatal(err) }
+   aOrig, err := os.ReadFile(aPath)
+   if err != nil { i.Fatal(err) }
+
+   fRead := func(cFile []byte) error {
+      err := os.WriteFile(aPath, cFile, 0600)
+      if err != nil { i.Fatal(err) }
+      cFd, err := openFile(aPath)
+      if err != nil { return err }
+      defer cFd.Close()
+      _, err = io.ReadAll(cFd)
+      return err
+   }
+   if err = fRead(aOrig); err != nil {
+      i.Fatalf("read original: %v", err)
+   }
+   aFlip := append([]byte{}, aOrig...)
+   aFlip[kCryptHeadLen + kCryptRecord + 100] ^= 1
+   aSwap := append(append(append([]byte{}, aOrig[:kCryptHeadLen]...),
+                   aOrig[kCryptHeadLen+kCryptRecord:]...), aOrig[kCryptHeadLen:kCryptHeadLen+kCryptRecord]...)
+   aHead := append([]byte{}, aOrig...)
+   aHead[len(kCryptMagic)+1] ^= 1 // file id, covered by tag
+   for aN, aFile := range [][]byte{aFlip, aSwap, aHead, []byte("plaintext contents")} {
+      if err = fRead(aFile); err == nil {
+         i.Errorf("case %d: read of altered file succeeded", aN)
+      }
+   }
+}
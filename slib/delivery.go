@@ -0,0 +1,200 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "fmt"
+   "encoding/json"
+   "io"
+   "os"
+   "strings"
+)
+
+// queued status is given by the Queued flag of a draft in GetIdxThread
+const ( _ int8 = iota; eDlvQueued; eDlvAccepted; eDlvDelivered; eDlvSeen )
+
+const ( eReceiptNone = ""; eReceiptDelivered = "delivered"; eReceiptSeen = "seen" )
+
+type tDlvEl struct {
+   Status int8 // values eDlv*
+   Date string
+}
+
+type tDlvSet map[string]*tDlvEl // key recipient uid
+
+type tReceipt struct {
+   MsgId string
+   Status int8 // eDlvDelivered or eDlvSeen
+}
+
+func getDlv(iSvc string, iMsgId string) tDlvSet {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   aSet := aSvc.delivery[iMsgId]
+   if aSet == nil {
+      return nil
+   }
+   aCopy := make(tDlvSet, len(aSet))
+   for aK, aV := range aSet {
+      aEl := *aV
+      aCopy[aK] = &aEl
+   }
+   return aCopy
+}
+
+// addSentDlv records server acceptance of a message for each recipient
+// called by _completeStoreSent, so it's repeated on recovery
+func addSentDlv(iSvc string, iMsgId string, iCc []tCcEl, iDate string) {
+   aUid := GetConfigService(iSvc).Uid
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aSet := aSvc.delivery[iMsgId]
+   aChg := false
+   for _, aCc := range iCc {
+      if aCc.WhoUid == aUid || aSet[aCc.WhoUid] != nil { continue }
+      if aSet == nil {
+         aSet = tDlvSet{}
+         aSvc.delivery[iMsgId] = aSet
+      }
+      aSet[aCc.WhoUid] = &tDlvEl{Status: eDlvAccepted, Date: iDate}
+      aChg = true
+   }
+   if !aChg {
+      return // no recipients, or completed before a crash
+   }
+   err := storeFile(fileDlv(iSvc), aSvc.delivery)
+   if err != nil { quit(err) }
+}
+
+// _setDlv advances the status for a recipient; never regresses it
+func _setDlv(iSvc string, iMsgId string, iWho string, iStatus int8, iDate string) bool {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aSet := aSvc.delivery[iMsgId]
+   if aSet == nil {
+      aSet = tDlvSet{}
+      aSvc.delivery[iMsgId] = aSet
+   }
+   if aSet[iWho] != nil && aSet[iWho].Status >= iStatus {
+      return false
+   }
+   aSet[iWho] = &tDlvEl{Status: iStatus, Date: iDate}
+   err := storeFile(fileDlv(iSvc), aSvc.delivery)
+   if err != nil { quit(err) }
+   return true
+}
+
+func dropThreadDlv(iSvc string, iMsgIds []string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aChg := false
+   for _, aId := range iMsgIds {
+      if aSvc.delivery[aId] != nil {
+         delete(aSvc.delivery, aId)
+         aChg = true
+      }
+   }
+   if !aChg {
+      return
+   }
+   err := storeFile(fileDlv(iSvc), aSvc.delivery)
+   if err != nil { quit(err) }
+}
+
+// queueReceiptDlv queues a receipt to the author of a received message, if enabled
+// delivered receipts are sent only by the lead node, as every node receives the message
+func queueReceiptDlv(iSvc string, iTid, iMsgId string, iStatus int8) {
+   aWant := GetConfigService(iSvc).Receipts
+   if iTid[0] == '_' || aWant == eReceiptNone || aWant == eReceiptDelivered && iStatus == eDlvSeen {
+      return
+   }
+   if iStatus == eDlvDelivered && !isLeadNode(iSvc) {
+      return
+   }
+   addQueue(iSvc, eSrecRcpt, fmt.Sprintf("%s_%s_%d", iTid, iMsgId, iStatus))
+}
+
+func sendReceiptDlv(iW io.Writer, iSvc string, iRcptId, iId string) error {
+   const ( eTid = iota; eMid; eStatus )
+   aRec := strings.SplitN(iRcptId, "_", eStatus+1)
+   aFrom := ""
+   func() {
+      cDoor := _getThreadDoor(iSvc, aRec[eTid])
+      cDoor.RLock(); defer cDoor.RUnlock()
+      if cDoor.renamed { return }
+      cFd, err := openFile(dirThread(iSvc) + aRec[eTid])
+      if err != nil {
+         if !os.IsNotExist(err) { quit(err) }
+         return
+      }
+      defer cFd.Close()
+      var cIdx []tIndexEl
+      _readIndex(cFd, &cIdx, nil)
+      for a := range cIdx {
+         if cIdx[a].Id == aRec[eMid] {
+            aFrom = cIdx[a].From
+            break
+         }
+      }
+   }()
+   if aFrom == "" || aFrom == GetConfigService(iSvc).Uid {
+      return tError("already sent") // msg gone, or no receipt needed
+   }
+   aSub := tHeader2{ThreadId: aRec[eTid], Receipt: &tReceipt{MsgId: aRec[eMid]}}
+   if aRec[eStatus] == fmt.Sprint(eDlvSeen) {
+      aSub.Receipt.Status = eDlvSeen
+   } else {
+      aSub.Receipt.Status = eDlvDelivered
+   }
+   aBufSub, err := json.Marshal(aSub)
+   if err != nil { quit(err) }
+   aHead := Msg{"Op":7, "Id":iId, "For":[]tHeaderFor{{Id:aFrom, Type:eForUser}},
+                "DataHead":len(aBufSub), "DataLen":len(aBufSub)}
+   aBufHead, err := json.Marshal(aHead)
+   if err != nil { quit(err) }
+   err = writeHeaders(iW, aBufHead, aBufSub)
+   return err
+}
+
+// storeReceiptDlv applies a receipt for a message we sent
+func storeReceiptDlv(iSvc string, iHead *Header, iR io.Reader) (bool, error) {
+   err := discardTmtp(iHead, iR)
+   if err != nil { return false, err }
+   aRcpt := iHead.SubHead.Receipt
+   if iHead.SubHead.ThreadId == "" || iHead.SubHead.ThreadId[0] == '_' {
+      return false, tError("invalid receipt thread id")
+   }
+   if aRcpt.Status != eDlvDelivered && aRcpt.Status != eDlvSeen {
+      return false, tError(fmt.Sprintf("invalid receipt status %d", aRcpt.Status))
+   }
+   aOk := false
+   func() {
+      cDoor := _getThreadDoor(iSvc, iHead.SubHead.ThreadId)
+      cDoor.RLock(); defer cDoor.RUnlock()
+      if cDoor.renamed { return }
+      cFd, err := openFile(dirThread(iSvc) + iHead.SubHead.ThreadId)
+      if err != nil {
+         if !os.IsNotExist(err) { quit(err) }
+         return
+      }
+      defer cFd.Close()
+      var cIdx []tIndexEl
+      _readIndex(cFd, &cIdx, nil)
+      for a := range cIdx {
+         if cIdx[a].Id == aRcpt.MsgId {
+            aOk = cIdx[a].From == GetConfigService(iSvc).Uid
+            break
+         }
+      }
+   }()
+   if !aOk {
+      fmt.Fprintf(os.Stderr, "storeReceiptDlv %s: msg %s not sent by us\n", iSvc, aRcpt.MsgId)
+      return false, nil
+   }
+   return _setDlv(iSvc, aRcpt.MsgId, iHead.From, aRcpt.Status, iHead.Posted), nil
+}
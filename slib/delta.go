@@ -0,0 +1,534 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "bufio"
+   "crypto/sha256"
+   "encoding/binary"
+   "encoding/hex"
+   "encoding/json"
+   "fmt"
+   "io"
+   "io/ioutil"
+   "os"
+   "strings"
+)
+
+// An attachment which revises one already in the thread is sent as a delta against it, with
+// Codec kCodecDelta. The base is given by tHeader2Attach.Base in the draft, else it's the latest
+// attachment in the thread with the same name. The delta is a series of ops: 'c' copies blocks of
+// the base, 'l' gives literal data. A recipient lacking the base requests the full file from the
+// author via a Resend message; the author replies with a Refill message.
+
+const kCodecDelta = "delta"
+const kDeltaMin = 64 * 1024 // smaller files are sent whole
+const kDeltaBlock = 4096
+const kDeltaLitMax = 64 * 1024
+
+type tDeltaAttach struct {
+   Base string // "msgid_name" of attachment in thread
+   BaseSum string // sha256 of base
+   Sum string // sha256 of result
+}
+
+type tRefill struct {
+   MsgId string
+   Name string
+}
+
+// _pathDelta gives the stored path for a "msgid_name" attachment reference
+func _pathDelta(iSvc string, iTid string, iRef string) string {
+   aPair := strings.SplitN(iRef, "_", 2)
+   if len(aPair) != 2 || aPair[0] == "" || aPair[1] == "" || strings.ContainsRune(aPair[0], '/') {
+      return ""
+   }
+   return fileAtc(iSvc, iTid, aPair[0], aPair[1])
+}
+
+func validateDeltaAttach(iSvc string, iTid string, iFile *tHeader2Attach) error {
+   if iFile.Base == "" {
+      return nil
+   }
+   aPath := ""; if iTid != "" { aPath = _pathDelta(iSvc, iTid, iFile.Base) }
+   if aPath == "" {
+      return tError(fmt.Sprintf("%s invalid base %s", iFile.Name, iFile.Base))
+   }
+   _, err := os.Lstat(aPath)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return tError(fmt.Sprintf("%s missing base %s", iFile.Name, iFile.Base))
+   }
+   return nil
+}
+
+// _findBaseDelta returns the "msgid_name" of the latest stored attachment named iName
+func _findBaseDelta(iSvc string, iTid string, iName string) string {
+   aDir, err := readDirFis(dirAttach(iSvc) + iTid)
+   if err != nil {
+      if os.IsNotExist(err) { return "" }
+      quit(err)
+   }
+   aSfx := "_"+ escapeFile(iName)
+   aRef, aDate := "", ""
+   for _, aFi := range aDir {
+      aFn := aFi.Name()
+      if !strings.HasSuffix(aFn, aSfx) || strings.IndexByte(aFn, '_') != len(aFn) - len(aSfx) ||
+         len(aFn) - len(aSfx) == 12 { continue } // draft-owned
+      aD := aFi.ModTime().UTC().Format("2006-01-02T15:04:05.000000000")
+      if aD > aDate {
+         aRef, aDate = aFn[:len(aFn) - len(aSfx)] +"_"+ iName, aD
+      }
+   }
+   return aRef
+}
+
+// deltaDraftAttach sets Codec, WireSize & Delta for draft attachments which revise another,
+// if every recipient accepts deltas. The delta is stored in a temp file; see writeWireAttach().
+func deltaDraftAttach(iSvc string, iSubHead *tHeader2, iId tLocalId, iCc []tCcEl) {
+   if !_acceptCodec(iSvc, iCc, kCodecDelta) {
+      return
+   }
+   aTid := iId.tid()
+   for a := range iSubHead.Attach {
+      aFile := &iSubHead.Attach[a]
+      aBase := aFile.Base
+      aFile.Base = ""
+      if aTid == "" || _isFormFill(aFile.Name) || aFile.Size < kDeltaMin || aFile.Codec != "" {
+         continue
+      }
+      if aBase == "" {
+         aBase = _findBaseDelta(iSvc, aTid, aFile.Name)
+      }
+      aBasePath := ""; if aBase != "" { aBasePath = _pathDelta(iSvc, aTid, aBase) }
+      if aBasePath == "" { continue }
+      aBfd, err := openFile(aBasePath)
+      if err != nil {
+         if !os.IsNotExist(err) { quit(err) }
+         continue
+      }
+      aPath := fileAtc(iSvc, "_"+ iId.lms(), iId.lms(), aFile.Name); if aTid != "" {
+         aPath = fileAtc(iSvc, aTid, iId.lms(), aFile.Name)
+      }
+      aFd, err := openFile(aPath)
+      if err != nil { quit(err) }
+      aWire := ftmpWire(iSvc, iId.lms(), aFile.Name)
+      aWd, err := openFileFlags(aWire, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+      if err != nil { quit(err) }
+      aBsum, aSum := sha256.New(), sha256.New()
+      aCw := tCountWriter{w: aWd}
+      err = _writeDelta(&aCw, io.TeeReader(aBfd, aBsum), io.TeeReader(aFd, aSum), aFile.Size)
+      aFd.Close(); aBfd.Close(); aWd.Close()
+      if err != nil { quit(err) }
+      if aCw.n > aFile.Size - aFile.Size / 10 {
+         err = os.Remove(aWire) // not worth it
+         if err != nil { quit(err) }
+         continue
+      }
+      aFile.Codec, aFile.WireSize = kCodecDelta, aCw.n
+      aFile.Delta = &tDeltaAttach{Base: aBase, BaseSum: hex.EncodeToString(aBsum.Sum(nil)),
+                                  Sum: hex.EncodeToString(aSum.Sum(nil))}
+   }
+}
+
+type tDeltaSum [16]byte
+
+func _strongDelta(iBuf []byte) tDeltaSum {
+   var aSum tDeltaSum
+   aFull := sha256.Sum256(iBuf)
+   copy(aSum[:], aFull[:])
+   return aSum
+}
+
+// _weakDelta computes the rsync rolling checksum
+func _weakDelta(iBuf []byte) (uint32, uint32) {
+   var aA, aB uint32
+   for a := range iBuf {
+      aA += uint32(iBuf[a])
+      aB += uint32(len(iBuf) - a) * uint32(iBuf[a])
+   }
+   return aA & 0xFFFF, aB & 0xFFFF
+}
+
+func _writeDelta(iW io.Writer, iBase io.Reader, iR io.Reader, iLen int64) error {
+   aWeak := map[uint32][]int32{}
+   var aStrong []tDeltaSum
+   aBlock := make([]byte, kDeltaBlock)
+   for aN := int32(0); true; aN++ {
+      _, err := io.ReadFull(iBase, aBlock)
+      if err == io.EOF || err == io.ErrUnexpectedEOF { break } // partial block not indexed
+      if err != nil { quit(err) }
+      aA, aB := _weakDelta(aBlock)
+      aWeak[aA | aB << 16] = append(aWeak[aA | aB << 16], aN)
+      aStrong = append(aStrong, _strongDelta(aBlock))
+   }
+
+   aBw := bufio.NewWriter(iW)
+   aVar := make([]byte, binary.MaxVarintLen64)
+   aCopyStart, aCopyN := int32(-1), int32(0)
+   fFlushCopy := func() error {
+      if aCopyN == 0 { return nil }
+      aBw.WriteByte('c')
+      aBw.Write(aVar[:binary.PutUvarint(aVar, uint64(aCopyStart))])
+      _, err := aBw.Write(aVar[:binary.PutUvarint(aVar, uint64(aCopyN))])
+      aCopyStart, aCopyN = -1, 0
+      return err
+   }
+   fFlushLit := func(cLit []byte) error {
+      if len(cLit) == 0 { return nil }
+      err := fFlushCopy()
+      if err != nil { return err }
+      aBw.WriteByte('l')
+      aBw.Write(aVar[:binary.PutUvarint(aVar, uint64(len(cLit)))])
+      _, err = aBw.Write(cLit)
+      return err
+   }
+
+   aLr := &io.LimitedReader{R: iR, N: iLen}
+   aBuf := make([]byte, 0, kDeltaLitMax + 2*kDeltaBlock)
+   aLit, aPos := 0, 0 // aBuf[aLit:aPos] is literal, aBuf[aPos:aPos+kDeltaBlock] is window
+   aEof := false
+   var aA, aB uint32
+   aRoll := false
+   for {
+      if !aEof && len(aBuf) - aPos < kDeltaBlock {
+         aBuf = aBuf[:copy(aBuf, aBuf[aLit:])]
+         aPos -= aLit; aLit = 0
+         aLen, err := io.ReadFull(aLr, aBuf[len(aBuf):cap(aBuf)])
+         aBuf = aBuf[:len(aBuf) + aLen]
+         if err == io.EOF || err == io.ErrUnexpectedEOF {
+            aEof = true
+         } else if err != nil {
+            return err
+         }
+      }
+      if len(aBuf) - aPos < kDeltaBlock {
+         break
+      }
+      aWin := aBuf[aPos:aPos+kDeltaBlock]
+      if !aRoll {
+         aA, aB = _weakDelta(aWin)
+         aRoll = true
+      }
+      aMatch := int32(-1)
+      if aList := aWeak[aA | aB << 16]; aList != nil {
+         aSum := _strongDelta(aWin)
+         for _, aN := range aList {
+            if aStrong[aN] == aSum { aMatch = aN; break }
+         }
+      }
+      if aMatch >= 0 {
+         err := fFlushLit(aBuf[aLit:aPos])
+         if err != nil { return err }
+         if aCopyN > 0 && aCopyStart + aCopyN != aMatch {
+            err = fFlushCopy()
+            if err != nil { return err }
+         }
+         if aCopyN == 0 { aCopyStart = aMatch }
+         aCopyN++
+         aPos += kDeltaBlock
+         aLit = aPos
+         aRoll = false
+         continue
+      }
+      if aPos - aLit >= kDeltaLitMax {
+         err := fFlushLit(aBuf[aLit:aPos])
+         if err != nil { return err }
+         aLit = aPos
+      }
+      if aPos + kDeltaBlock < len(aBuf) {
+         aOut, aIn := uint32(aBuf[aPos]), uint32(aBuf[aPos+kDeltaBlock])
+         aA = (aA - aOut + aIn) & 0xFFFF
+         aB = (aB - kDeltaBlock * aOut + aA) & 0xFFFF
+      } else {
+         aRoll = false
+      }
+      aPos++
+   }
+   err := fFlushLit(aBuf[aLit:])
+   if err == nil {
+      err = fFlushCopy()
+   }
+   if err != nil { return err }
+   if aLr.N != 0 {
+      return tError("file shorter than size")
+   }
+   return aBw.Flush()
+}
+
+// readDelta rebuilds an attachment from a delta; it always consumes WireSize bytes.
+// It returns false if the base is missing or the result doesn't match.
+func readDelta(iW io.Writer, iR io.Reader, iSvc string, iTid string, iFile *tHeader2Attach) (bool, error) {
+   aLr := &io.LimitedReader{R: iR, N: iFile.WireSize}
+   fDrain := func(cMsg string) (bool, error) {
+      _, err := io.Copy(ioutil.Discard, aLr)
+      if err != nil { return false, err }
+      fmt.Fprintf(os.Stderr, "readDelta: %s %s\n", iFile.Name, cMsg)
+      return false, nil
+   }
+   if iFile.Delta == nil || iFile.Codec != kCodecDelta {
+      return fDrain("invalid codec")
+   }
+   aPath := _pathDelta(iSvc, iTid, iFile.Delta.Base)
+   if aPath == "" {
+      return fDrain("invalid base")
+   }
+   aBfd, err := openFile(aPath)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return fDrain("base missing")
+   }
+   defer aBfd.Close()
+   if _sumBlob(aPath) != iFile.Delta.BaseSum {
+      return fDrain("base differs")
+   }
+   aFi, err := os.Stat(aPath)
+   if err != nil { quit(err) }
+   aBaseN := uint64(sizeFile(aPath, aFi) / kDeltaBlock) // whole blocks
+   aH := sha256.New()
+   aW := io.MultiWriter(iW, aH)
+   aBr := bufio.NewReader(aLr)
+   var aLen int64
+   for {
+      aOp, err := aBr.ReadByte()
+      if err == io.EOF { break }
+      if err != nil { return false, err }
+      var aN, aCount uint64
+      aN, err = binary.ReadUvarint(aBr)
+      if err == nil && aOp == 'c' {
+         aCount, err = binary.ReadUvarint(aBr)
+      }
+      if err != nil {
+         if aLr.N == 0 { return fDrain("invalid delta") }
+         return false, err
+      }
+      var aCopied int64
+      switch aOp {
+      case 'c':
+         if aN > aBaseN || aCount > aBaseN - aN || aCount > uint64(iFile.Size - aLen) / kDeltaBlock {
+            return fDrain("invalid delta") // would read past base or write past iFile.Size
+         }
+         _, err = aBfd.Seek(int64(aN) * kDeltaBlock, io.SeekStart)
+         if err != nil { quit(err) }
+         aCopied, err = io.CopyN(aW, aBfd, int64(aCount) * kDeltaBlock)
+         if err == io.EOF { return fDrain("invalid delta") }
+      case 'l':
+         if aLen + int64(aN) > iFile.Size { return fDrain("invalid delta") }
+         aCopied, err = io.CopyN(aW, aBr, int64(aN))
+         if err == io.EOF && aLr.N == 0 { return fDrain("invalid delta") }
+      default:
+         return fDrain("invalid delta")
+      }
+      if err != nil { return false, err }
+      aLen += aCopied
+      if aLen > iFile.Size { return fDrain("invalid delta") }
+   }
+   if aLen != iFile.Size || fmt.Sprintf("%x", aH.Sum(nil)) != iFile.Delta.Sum {
+      return fDrain("result differs")
+   }
+   return true, nil
+}
+
+// queueResendDelta requests from the author any attachments which couldn't be rebuilt
+func queueResendDelta(iSvc string, iHead *Header, iTid string) {
+   if iHead.From == GetConfigService(iSvc).Uid {
+      return // our other node lacks the base; it can't request from itself
+   }
+   for _, aFile := range iHead.SubHead.Attach {
+      if aFile.Codec != kCodecDelta { continue }
+      _, err := os.Lstat(fileAtc(iSvc, iTid, iHead.Id, aFile.Name))
+      if err == nil { continue }
+      if !os.IsNotExist(err) { quit(err) }
+      addQueue(iSvc, eSrecResend, iTid +"_"+ iHead.Id +"_"+ escapeFile(aFile.Name))
+   }
+}
+
+func sendResendDelta(iW io.Writer, iSvc string, iQid, iId string) error {
+   const ( eTid = iota; eMid; eName )
+   aRec := strings.SplitN(iQid, "_", eName+1)
+   aName := unescapeFile(aRec[eName])
+   aFrom := ""
+   for _, aEl := range getIndexThread(iSvc, aRec[eTid]) {
+      if aEl.Id == aRec[eMid] {
+         aFrom = aEl.From
+         break
+      }
+   }
+   if aFrom == "" || aFrom == GetConfigService(iSvc).Uid {
+      return tError("already sent") // msg gone
+   }
+   _, err := os.Lstat(fileAtc(iSvc, aRec[eTid], aRec[eMid], aName))
+   if err == nil {
+      return tError("already sent") // refilled
+   }
+   aSub := tHeader2{ThreadId: aRec[eTid], Resend: &tRefill{MsgId: aRec[eMid], Name: aName}}
+   aBufSub, err := json.Marshal(aSub)
+   if err != nil { quit(err) }
+   aHead := Msg{"Op":7, "Id":iId, "For":[]tHeaderFor{{Id:aFrom, Type:eForUser}},
+                "DataHead":len(aBufSub), "DataLen":len(aBufSub)}
+   aBufHead, err := json.Marshal(aHead)
+   if err != nil { quit(err) }
+   err = writeHeaders(iW, aBufHead, aBufSub)
+   return err
+}
+
+// storeResendDelta queues a Refill for a request from a thread member
+func storeResendDelta(iSvc string, iHead *Header, iR io.Reader) error {
+   err := discardTmtp(iHead, iR)
+   if err != nil { return err }
+   aRs := iHead.SubHead.Resend
+   aTid := iHead.SubHead.ThreadId
+   if aTid == "" || aTid[0] == '_' || strings.ContainsRune(aTid, '/') ||
+      strings.ContainsRune(aRs.MsgId, '_') || strings.ContainsRune(aRs.MsgId, '/') {
+      return tError("invalid resend ids")
+   }
+   aUid := GetConfigService(iSvc).Uid
+   aOk := false
+   for _, aEl := range getIndexThread(iSvc, aTid) {
+      if aEl.Id == aRs.MsgId {
+         aOk = aEl.From == aUid
+         break
+      }
+   }
+   if aOk {
+      aOk = false
+      aDoor := _getThreadDoor(iSvc, aTid)
+      aDoor.RLock()
+      var aCc []tCcEl
+      aFd, err := openFile(dirThread(iSvc) + aTid)
+      if err == nil {
+         _readCc(aFd, &aCc)
+         aFd.Close()
+      } else if !os.IsNotExist(err) {
+         quit(err)
+      }
+      aDoor.RUnlock()
+      for _, aC := range aCc {
+         aOk = aOk || aC.WhoUid == iHead.From
+      }
+   }
+   if !aOk {
+      fmt.Fprintf(os.Stderr, "storeResendDelta %s: invalid request from %s for %s_%s\n",
+                             iSvc, iHead.From, aTid, aRs.MsgId)
+      return nil
+   }
+   addQueue(iSvc, eSrecRefill, aTid +"_"+ aRs.MsgId +"_"+ iHead.From +"_"+ escapeFile(aRs.Name))
+   return nil
+}
+
+func sendRefillDelta(iW io.Writer, iSvc string, iQid, iId string) error {
+   const ( eTid = iota; eMid; eUid; eName )
+   aRec := strings.SplitN(iQid, "_", eName+1)
+   aName := unescapeFile(aRec[eName])
+   aFd, err := openFile(fileAtc(iSvc, aRec[eTid], aRec[eMid], aName))
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return tError("already sent") // msg gone
+   }
+   defer aFd.Close()
+   aFi, err := aFd.Stat()
+   if err != nil { quit(err) }
+   aSub := tHeader2{ThreadId: aRec[eTid], Refill: &tRefill{MsgId: aRec[eMid], Name: aName},
+                    Attach: []tHeader2Attach{{Name: aName, Size: aFi.Size()}}}
+   aBufSub, err := json.Marshal(aSub)
+   if err != nil { quit(err) }
+   aHead := Msg{"Op":7, "Id":iId, "For":[]tHeaderFor{{Id:aRec[eUid], Type:eForUser}},
+                "DataHead":len(aBufSub), "DataLen":int64(len(aBufSub)) + aFi.Size()}
+   aBufHead, err := json.Marshal(aHead)
+   if err != nil { quit(err) }
+   err = writeHeaders(iW, aBufHead, aBufSub)
+   if err != nil { return err }
+   _, err = io.CopyN(iW, aFd, aFi.Size()) //todo only return network errors
+   return err
+}
+
+// storeRefillDelta stores an attachment which couldn't be rebuilt from a delta
+func storeRefillDelta(iSvc string, iHead *Header, iR io.Reader) (bool, error) {
+   aRf := iHead.SubHead.Refill
+   aTid := iHead.SubHead.ThreadId
+   if aTid == "" || aTid[0] == '_' || strings.ContainsRune(aTid, '/') ||
+      strings.ContainsRune(aRf.MsgId, '_') || strings.ContainsRune(aRf.MsgId, '/') ||
+      len(iHead.SubHead.Attach) != 1 || iHead.SubHead.Attach[0].Name != aRf.Name ||
+      iHead.SubHead.Attach[0].Size != iHead.DataLen || _isFormFill(aRf.Name) {
+      return false, tError("invalid refill")
+   }
+   err := checkQuota(iSvc, iHead.SubHead.Attach, 0)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "storeRefillDelta %s: refill refused, %v\n", iSvc, err)
+      return false, discardTmtp(iHead, iR)
+   }
+   aDoor := _getThreadDoor(iSvc, aTid)
+   aDoor.Lock(); defer aDoor.Unlock()
+   aOk := false
+   aSubHead := &tHeader2{Attach: iHead.SubHead.Attach}
+   if !aDoor.renamed {
+      aIdx := []tIndexEl{}
+      aFd, err := openFile(dirThread(iSvc) + aTid)
+      if err == nil {
+         _readIndex(aFd, &aIdx, nil)
+         aFd.Close()
+      } else if !os.IsNotExist(err) {
+         quit(err)
+      }
+      for _, aEl := range aIdx {
+         if aEl.Id == aRf.MsgId {
+            aOk = aEl.From == iHead.From
+            aSubHead.Alias, aSubHead.Subject = aEl.Alias, aEl.Subject // for scan notice
+            break
+         }
+      }
+   }
+   aPath := fileAtc(iSvc, aTid, aRf.MsgId, aRf.Name)
+   if aOk {
+      _, err := os.Lstat(aPath)
+      if err == nil {
+         aOk = false
+      } else if !os.IsNotExist(err) {
+         quit(err)
+      }
+   }
+   if !aOk {
+      fmt.Fprintf(os.Stderr, "storeRefillDelta %s: unneeded refill from %s for %s_%s\n",
+                             iSvc, iHead.From, aTid, aRf.MsgId)
+      return false, discardTmtp(iHead, iR)
+   }
+   aTemp := ftmpAtc(iSvc, aRf.MsgId, aRf.Name)
+   err = os.Remove(aTemp)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   aTd, err := openFileFlags(aTemp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+   if err != nil { quit(err) }
+   _, err = io.CopyN(aTd, iR, iHead.DataLen)
+   if err != nil {
+      aTd.Close()
+      os.Remove(aTemp)
+      return false, err //todo only network errors
+   }
+   err = aTd.Sync()
+   if err != nil { quit(err) }
+   aTd.Close()
+   err = os.Mkdir(dirAttach(iSvc) + aTid, 0700)
+   if err != nil {
+      if !os.IsExist(err) { quit(err) }
+   } else {
+      err = syncDir(dirAttach(iSvc))
+      if err != nil { quit(err) }
+   }
+   err = renameRemove(aTemp, aPath)
+   if err != nil { quit(err) }
+   err = syncDir(dirAttach(iSvc) + aTid)
+   if err != nil { quit(err) }
+   aRec := tComplete{"", aTid, aRf.MsgId}
+   storeBlobAttach(iSvc, aSubHead, aRec)
+   scanAttach(iSvc, aSubHead, aRec)
+   makeThumbAttach(iSvc, aSubHead, aRec)
+   aFd, err := openFile(dirThread(iSvc) + aTid)
+   if err != nil { quit(err) }
+   defer aFd.Close()
+   _updateSearchDoc(iSvc, nil, aTid, aFd, nil) // omits text of attachments awaiting scan
+   return true, nil
+}
@@ -0,0 +1,121 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "fmt"
+   "strings"
+)
+
+const kDiffCellsMax = 1 << 22 // bounds lcs table; larger inputs yield a single hunk
+const kDiffContext = 3
+
+type tDiffEl struct {
+   Pos int // line in source
+   Del int // lines dropped from source
+   Ins []string `json:",omitempty"`
+}
+
+func splitLines(i string) []string {
+   aList := strings.SplitAfter(i, "\n")
+   if aList[len(aList)-1] == "" {
+      aList = aList[:len(aList)-1]
+   }
+   return aList
+}
+
+// diffLines returns the edits which transform iA into iB
+func diffLines(iA, iB []string) []tDiffEl {
+   aPre := 0
+   for aPre < len(iA) && aPre < len(iB) && iA[aPre] == iB[aPre] { aPre++ }
+   aSuf := 0
+   for aSuf < len(iA)-aPre && aSuf < len(iB)-aPre &&
+       iA[len(iA)-1-aSuf] == iB[len(iB)-1-aSuf] { aSuf++ }
+   aA, aB := iA[aPre:len(iA)-aSuf], iB[aPre:len(iB)-aSuf]
+   if len(aA) == 0 && len(aB) == 0 {
+      return nil
+   }
+   if len(aA) == 0 || len(aB) == 0 || len(aA) * len(aB) > kDiffCellsMax {
+      return []tDiffEl{{Pos:aPre, Del:len(aA), Ins:append([]string{}, aB...)}}
+   }
+   aW := len(aB)+1
+   aLcs := make([]int32, (len(aA)+1) * aW)
+   for a := len(aA)-1; a >= 0; a-- {
+      for a1 := len(aB)-1; a1 >= 0; a1-- {
+         if aA[a] == aB[a1] {
+            aLcs[a*aW+a1] = aLcs[(a+1)*aW+a1+1] + 1
+         } else if aLcs[(a+1)*aW+a1] >= aLcs[a*aW+a1+1] {
+            aLcs[a*aW+a1] = aLcs[(a+1)*aW+a1]
+         } else {
+            aLcs[a*aW+a1] = aLcs[a*aW+a1+1]
+         }
+      }
+   }
+   var aDiff []tDiffEl
+   aOpen := false
+   for a, a1 := 0, 0; a < len(aA) || a1 < len(aB); {
+      if a < len(aA) && a1 < len(aB) && aA[a] == aB[a1] {
+         aOpen = false
+         a++; a1++
+         continue
+      }
+      if !aOpen {
+         aDiff = append(aDiff, tDiffEl{Pos:aPre+a})
+         aOpen = true
+      }
+      aEl := &aDiff[len(aDiff)-1]
+      if a1 >= len(aB) || a < len(aA) && aLcs[(a+1)*aW+a1] >= aLcs[a*aW+a1+1] {
+         aEl.Del++
+         a++
+      } else {
+         aEl.Ins = append(aEl.Ins, aB[a1])
+         a1++
+      }
+   }
+   return aDiff
+}
+
+// patchLines applies edits from diffLines; returns nil if they don't fit iA
+func patchLines(iA []string, iDiff []tDiffEl) []string {
+   aOut := make([]string, 0, len(iA))
+   aPos := 0
+   for _, aEl := range iDiff {
+      if aEl.Pos < aPos || aEl.Del < 0 || aEl.Pos + aEl.Del > len(iA) {
+         return nil
+      }
+      aOut = append(aOut, iA[aPos:aEl.Pos]...)
+      aOut = append(aOut, aEl.Ins...)
+      aPos = aEl.Pos + aEl.Del
+   }
+   return append(aOut, iA[aPos:]...)
+}
+
+// formatDiff renders edits of iA in unified format, with kDiffContext lines around each hunk
+func formatDiff(iA []string, iDiff []tDiffEl) []string {
+   aOut := []string{}
+   fLine := func(cMark byte, cLine string) {
+      aOut = append(aOut, string(cMark) + strings.TrimSuffix(cLine, "\n"))
+   }
+   for a := 0; a < len(iDiff); {
+      aEnd := a + 1 // merge hunks with overlapping context
+      for aEnd < len(iDiff) &&
+          iDiff[aEnd].Pos - (iDiff[aEnd-1].Pos + iDiff[aEnd-1].Del) <= 2 * kDiffContext { aEnd++ }
+      aStart := iDiff[a].Pos - kDiffContext; if aStart < 0 { aStart = 0 }
+      aStop := iDiff[aEnd-1].Pos + iDiff[aEnd-1].Del + kDiffContext
+      if aStop > len(iA) { aStop = len(iA) }
+      aOut = append(aOut, fmt.Sprintf("@@ %d @@", aStart+1))
+      aPos := aStart
+      for ; a < aEnd; a++ {
+         for ; aPos < iDiff[a].Pos; aPos++ { fLine(' ', iA[aPos]) }
+         for ; aPos < iDiff[a].Pos + iDiff[a].Del; aPos++ { fLine('-', iA[aPos]) }
+         for _, aIns := range iDiff[a].Ins { fLine('+', aIns) }
+      }
+      for ; aPos < aStop; aPos++ { fLine(' ', iA[aPos]) }
+   }
+   return aOut
+}
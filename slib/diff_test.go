@@ -0,0 +1,106 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "reflect"
+   "strconv"
+   "strings"
+   "testing"
+)
+
+var kTestDiffText = []string{
+   "",
+   "one\n",
+   "one\ntwo\nthree\n",
+   "one\nthree\n",
+   "zero\none\nthree\nfour",
+   "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\n",
+   "a\nB\nc\nd\ne\nf\ng\nh\nI\nj\nk\n",
+   "j\ni\nh\ng\nf\ne\nd\nc\nb\na\n",
+}
+
+func TestSplitLines(i *testing.T) {
+   for _, aEl := range []struct { text string; want []string }{
+      {"", []string{}},
+      {"a", []string{"a"}},
+      {"a\n", []string{"a\n"}},
+      {"a\n\nb", []string{"a\n", "\n", "b"}},
+   } {
+      if aList := splitLines(aEl.text); !reflect.DeepEqual(aList, aEl.want) {
+         i.Errorf("splitLines(%q) = %q", aEl.text, aList)
+      }
+   }
+}
+
+func TestDiffLines(i *testing.T) {
+   for _, aA := range kTestDiffText {
+      for _, aB := range kTestDiffText {
+         aDiff := diffLines(splitLines(aA), splitLines(aB))
+         if aA == aB && aDiff != nil {
+            i.Errorf("diffLines(%q, same) = %v", aA, aDiff)
+         }
+         aOut := patchLines(splitLines(aA), aDiff)
+         if aOut == nil || strings.Join(aOut, "") != aB {
+            i.Errorf("patchLines(%q, diffLines(to %q)) = %q", aA, aB, aOut)
+         }
+      }
+   }
+   aDiff := diffLines(splitLines(kTestDiffText[5]), splitLines(kTestDiffText[6]))
+   aWant := []tDiffEl{{Pos:1, Del:1, Ins:[]string{"B\n"}}, {Pos:8, Del:1, Ins:[]string{"I\n"}},
+                      {Pos:10, Ins:[]string{"k\n"}}}
+   if !reflect.DeepEqual(aDiff, aWant) {
+      i.Errorf("diffLines() = %+v", aDiff)
+   }
+}
+
+func TestPatchLinesMisfit(i *testing.T) {
+   aA := splitLines("one\ntwo\n")
+   for _, aDiff := range [][]tDiffEl{
+      {{Pos:3}},
+      {{Pos:1, Del:2}},
+      {{Pos:1, Del:-1}},
+      {{Pos:1, Del:1}, {Pos:0, Del:1}},
+   } {
+      if aOut := patchLines(aA, aDiff); aOut != nil {
+         i.Errorf("patchLines(%+v) = %q", aDiff, aOut)
+      }
+   }
+}
+
+func TestWalkRevThread(i *testing.T) {
+   // revisions are stored newest first, each restoring the prior text from the newer one
+   aSaved := kTestDiffText[2:7]
+   var aRevs []tDraftRev
+   for a := 1; a < len(aSaved); a++ {
+      aRev := _newRevThread("", "subject"+ strconv.Itoa(a-1), aSaved[a-1], "subject"+ strconv.Itoa(a), aSaved[a])
+      aRevs = append([]tDraftRev{aRev}, aRevs...)
+   }
+   aLast := len(aSaved)-1
+   aSubject := "subject"+ strconv.Itoa(aLast)
+   for a := range aRevs {
+      aText, err := _walkRevThread(aSubject, aSaved[aLast], aRevs[:a+1])
+      if err != nil || aText != aSaved[aLast-1-a] {
+         i.Errorf("_walkRevThread(rev %d) = %q, %v", a, aText, err)
+      }
+      if aRevs[a].Subject != "subject"+ strconv.Itoa(aLast-1-a) {
+         i.Errorf("rev %d subject %s", a, aRevs[a].Subject)
+      }
+   }
+   if _, err := _walkRevThread("changed", aSaved[aLast], aRevs); err == nil {
+      i.Errorf("_walkRevThread() accepted a changed subject")
+   }
+   if _, err := _walkRevThread(aSubject, aSaved[aLast] +"x", aRevs); err == nil {
+      i.Errorf("_walkRevThread() accepted a changed text")
+   }
+   aBad := append([]tDraftRev{}, aRevs...)
+   aBad[1].Checksum++
+   if _, err := _walkRevThread(aSubject, aSaved[aLast], aBad); err == nil {
+      i.Errorf("_walkRevThread() accepted a damaged chain")
+   }
+}
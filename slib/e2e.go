@@ -0,0 +1,492 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "crypto/aes"
+   "crypto/cipher"
+   "crypto/ecdh"
+   "crypto/rand"
+   "crypto/sha256"
+   "encoding/base64"
+   "encoding/binary"
+   "encoding/hex"
+   "encoding/json"
+   "fmt"
+   "io"
+   "os"
+   "strings"
+)
+
+// End-to-end encryption: each node has a P-256 keypair. While the E2e option is set, its public
+// key goes in the sub-header of pings and messages; contacts trust a key on first use, and a
+// different key for that uid is held until the user accepts it via a notice.
+// A message is sealed with a random key, wrapped for each key of each Cc member (including our
+// other nodes) via ECDH with an ephemeral key. The parts (sub-header, body, each attachment) are
+// sealed with AES-GCM in chunks, so they may be streamed, and only verified data is released.
+//todo share node keys via syncUpdtNode; our other nodes can't read our messages until they've
+//     sent us one
+
+const kE2eKeyLen = 32 // AES-256 key
+const kE2eTagLen = 16
+const kE2eChunk = 64 * 1024 // plaintext per tag
+const kE2eFailed = "failed: " // prefix of tIndexElCore.E2e on error
+const eE2eOk = "ok"
+const kNoticeKeyE2e = "e2e:" // prefix of tNoticeEl.MsgId for a changed key
+
+type tE2eHead struct {
+   PubKey string `json:",omitempty"` // sender's node key
+   Eph string `json:",omitempty"` // ephemeral key of message
+   Keys map[string][]byte `json:",omitempty"` // key id -> wrapped message key
+   Head []byte `json:",omitempty"` // sealed sub-header
+}
+
+type tE2eKeyfile struct {
+   Private []byte
+}
+
+// _getKeyE2e returns this node's private key and public key, creating them if necessary
+func _getKeyE2e(iSvc string) (*ecdh.PrivateKey, string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   if aSvc.e2eKey == nil {
+      var aKf tE2eKeyfile
+      err := readJsonFile(&aKf, fileE2eKey(iSvc))
+      if err != nil {
+         if !os.IsNotExist(err) { quit(err) }
+         var aKey *ecdh.PrivateKey
+         aKey, err = ecdh.P256().GenerateKey(rand.Reader)
+         if err != nil { quit(err) }
+         aKf.Private = aKey.Bytes()
+         aTemp := fileE2eKey(iSvc) + ".tmp"
+         err = os.Remove(aTemp)
+         if err != nil && !os.IsNotExist(err) { quit(err) }
+         err = writeJsonFile(aTemp, &aKf)
+         if err != nil { quit(err) }
+         err = os.Rename(aTemp, fileE2eKey(iSvc))
+         if err != nil { quit(err) }
+         err = syncDir(dirSvc(iSvc))
+         if err != nil { quit(err) }
+      }
+      aSvc.e2eKey, err = ecdh.P256().NewPrivateKey(aKf.Private)
+      if err != nil { quit(err) }
+   }
+   return aSvc.e2eKey, base64.StdEncoding.EncodeToString(aSvc.e2eKey.PublicKey().Bytes())
+}
+
+// pubKeyE2e returns this node's public key if the E2e option is set
+func pubKeyE2e(iSvc string) string {
+   if !GetConfigService(iSvc).E2e {
+      return ""
+   }
+   _, aPub := _getKeyE2e(iSvc)
+   return aPub
+}
+
+func _idE2e(iPub *ecdh.PublicKey) string {
+   aSum := sha256.Sum256(iPub.Bytes())
+   return hex.EncodeToString(aSum[:8])
+}
+
+func _parseKeyE2e(iPub string) (*ecdh.PublicKey, error) {
+   aRaw, err := base64.StdEncoding.DecodeString(iPub)
+   if err != nil { return nil, err }
+   return ecdh.P256().NewPublicKey(aRaw) // checks point is on curve
+}
+
+// addPeerE2e pins the first key seen for a uid, unless it's this node's key.
+// A different key is held in a notice until the user accepts it; see pinPeerE2e().
+func addPeerE2e(iSvc string, iUid string, iPub string) {
+   if iPub == "" {
+      return
+   }
+   aKey, err := _parseKeyE2e(iPub)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "addPeerE2e %s: uid %s %v\n", iSvc, iUid, err)
+      return
+   }
+   if _, aPub := _getKeyE2e(iSvc); aPub == iPub {
+      return
+   }
+   aSvc := getService(iSvc)
+   aSvc.Lock()
+   aPinned := len(aSvc.e2ePeer[iUid]) > 0
+   for _, aK := range aSvc.e2ePeer[iUid] {
+      if aK == iPub {
+         aSvc.Unlock()
+         return
+      }
+   }
+   if !aPinned {
+      aSvc.e2ePeer[iUid] = []string{iPub}
+      err = storeFile(fileE2ePeer(iSvc), aSvc.e2ePeer)
+      if err != nil { quit(err) }
+   }
+   aSvc.Unlock()
+   if aPinned {
+      fmt.Fprintf(os.Stderr, "addPeerE2e %s: uid %s key changed\n", iSvc, iUid)
+      addKeyNotice(iSvc, kNoticeKeyE2e + _idE2e(aKey), iUid, iPub, "new encryption key")
+   }
+}
+
+// pinPeerE2e adds a key accepted by the user; it replaces a contact's key, but not our
+// other nodes' keys
+func pinPeerE2e(iSvc string, iUid string, iPub string) {
+   aUid := GetConfigService(iSvc).Uid // takes aSvc.RLock()
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   if iUid == aUid {
+      aSvc.e2ePeer[iUid] = append(aSvc.e2ePeer[iUid], iPub)
+   } else {
+      aSvc.e2ePeer[iUid] = []string{iPub}
+   }
+   err := storeFile(fileE2ePeer(iSvc), aSvc.e2ePeer)
+   if err != nil { quit(err) }
+}
+
+func _getPeerE2e(iSvc string, iUid string) []string {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   return aSvc.e2ePeer[iUid]
+}
+
+// checkCcE2e verifies that every recipient can be sent an encrypted message
+func checkCcE2e(iSvc string, iCc []tCcEl) error {
+   aUid := GetConfigService(iSvc).Uid
+   for _, aCc := range iCc {
+      if aCc.WhoUid == aUid { continue }
+      if aCc.WhoUid == aCc.Who {
+         return tError("end-to-end encryption unavailable for group "+ aCc.Who)
+      }
+      if len(_getPeerE2e(iSvc, aCc.WhoUid)) == 0 {
+         return tError("no encryption key for "+ aCc.Who +"; they must enable encryption and ping you")
+      }
+   }
+   return nil
+}
+
+// sealE2e returns the wire sub-header for iSubHead, given as iSub, and a writer to seal the body & attachments
+func sealE2e(iSvc string, iW io.Writer, iCc []tCcEl, iSubHead *tHeader2, iSub []byte, iBodyLen int64) (
+             []byte, *tE2eWriter, error) {
+   err := checkCcE2e(iSvc, iCc)
+   if err != nil { return nil, nil, err }
+   aKey := make([]byte, kE2eKeyLen)
+   _, err = rand.Read(aKey)
+   if err != nil { quit(err) }
+   aEph, err := ecdh.P256().GenerateKey(rand.Reader)
+   if err != nil { quit(err) }
+   aEphPub := aEph.PublicKey()
+   _, aPub := _getKeyE2e(iSvc)
+   aHead := tE2eHead{PubKey: aPub, Eph: base64.StdEncoding.EncodeToString(aEphPub.Bytes()),
+                     Keys: map[string][]byte{}}
+   aUid := GetConfigService(iSvc).Uid
+   aUids := []string{aUid} // for our other nodes
+   for _, aCc := range iCc {
+      if aCc.WhoUid != aUid { aUids = append(aUids, aCc.WhoUid) }
+   }
+   for _, aU := range aUids {
+      for _, aK := range _getPeerE2e(iSvc, aU) {
+         aRcpt, _ := _parseKeyE2e(aK)
+         aHead.Keys[_idE2e(aRcpt)] = _kekE2e(aEph, aRcpt, aEphPub, aRcpt).Seal(nil, make([]byte, 12), aKey, nil)
+      }
+   }
+   aGcm := _gcmE2e(aKey)
+   aHead.Head = aGcm.Seal(nil, _nonceE2e(0, 0), iSub, _adE2e(true))
+   aBuf, err := json.Marshal(tHeader2{E2e: &aHead})
+   if err != nil { quit(err) }
+   aParts := []int64{iBodyLen}
+   for a := range iSubHead.Attach {
+      aParts = append(aParts, iSubHead.Attach[a].wireSize())
+   }
+   aWr := &tE2eWriter{w: iW}
+   aWr.init(aGcm, aParts)
+   return aBuf, aWr, nil
+}
+
+// sizeE2e gives the length added to a message by sealing it
+func sizeE2e(iSubHead *tHeader2, iBodyLen int64) int64 {
+   aSum := _tagsE2e(iBodyLen)
+   for a := range iSubHead.Attach {
+      aSum += _tagsE2e(iSubHead.Attach[a].wireSize())
+   }
+   return aSum * kE2eTagLen
+}
+
+// _tagsE2e gives the number of chunks in a part; an empty part has one
+func _tagsE2e(iLen int64) int64 {
+   if iLen == 0 {
+      return 1
+   }
+   return (iLen + kE2eChunk - 1) / kE2eChunk
+}
+
+// _openSizeE2e gives the plaintext length of a sealed part, or -1 if invalid
+func _openSizeE2e(iWire int64) int64 {
+   aTags := (iWire + kE2eChunk + kE2eTagLen - 1) / (kE2eChunk + kE2eTagLen)
+   if aTags == 0 {
+      aTags = 1
+   }
+   aLen := iWire - aTags * kE2eTagLen
+   if aLen < 0 || _tagsE2e(aLen) != aTags {
+      return -1
+   }
+   return aLen
+}
+
+// _kekE2e derives the key which wraps a message key for a recipient key, via ECDH of
+// iPriv & iPeer, i.e. the ephemeral & recipient keys, or vice versa
+func _kekE2e(iPriv *ecdh.PrivateKey, iPeer *ecdh.PublicKey, iEphPub, iRcptPub *ecdh.PublicKey) cipher.AEAD {
+   aShared, err := iPriv.ECDH(iPeer)
+   if err != nil { quit(err) } // keys were validated
+   aH := sha256.New()
+   aH.Write(aShared)
+   aH.Write(iEphPub.Bytes())
+   aH.Write(iRcptPub.Bytes())
+   return _gcmE2e(aH.Sum(nil))
+}
+
+func _gcmE2e(iKey []byte) cipher.AEAD {
+   aBlock, err := aes.NewCipher(iKey)
+   if err != nil { quit(err) }
+   aGcm, err := cipher.NewGCM(aBlock)
+   if err != nil { quit(err) }
+   return aGcm
+}
+
+// _nonceE2e is fixed per chunk, as the message key is unique
+func _nonceE2e(iPart uint32, iChunk uint64) []byte {
+   aNonce := make([]byte, 12)
+   binary.BigEndian.PutUint32(aNonce, iPart)
+   binary.BigEndian.PutUint64(aNonce[4:], iChunk)
+   return aNonce
+}
+
+// _adE2e marks the last chunk of a part, so a truncated part fails
+func _adE2e(iLast bool) []byte {
+   if iLast {
+      return []byte{1}
+   }
+   return []byte{0}
+}
+
+// openE2e replaces iHead.SubHead with the decrypted one, and returns a reader of the plaintext.
+// On failure, it discards the data, and substitutes a placeholder message.
+func openE2e(iSvc string, iHead *Header, iR io.Reader) (*tE2eReader, error) {
+   aE := iHead.SubHead.E2e
+   addPeerE2e(iSvc, iHead.From, aE.PubKey)
+   var aSub tHeader2
+   var aGcm cipher.AEAD
+   aKey, aFail := _unwrapE2e(iSvc, aE)
+   if aFail == "" {
+      aGcm = _gcmE2e(aKey)
+      aBuf, err := aGcm.Open(nil, _nonceE2e(0, 0), aE.Head, _adE2e(true))
+      if err != nil || json.Unmarshal(aBuf, &aSub) != nil || aSub.E2e != nil {
+         aFail = "invalid sub-header"
+      }
+   }
+   var aBodyLen int64
+   if aFail == "" {
+      aWire := iHead.DataLen
+      for a := range aSub.Attach {
+         if aSub.Attach[a].wireSize() < 0 { aWire = -1; break }
+         aWire -= aSub.Attach[a].wireSize() + _tagsE2e(aSub.Attach[a].wireSize()) * kE2eTagLen
+      }
+      if aBodyLen = _openSizeE2e(aWire); aBodyLen < 0 {
+         aFail = "invalid data length"
+      }
+   }
+   if aFail != "" {
+      err := discardTmtp(iHead, iR)
+      if err != nil { return nil, err }
+      fmt.Fprintf(os.Stderr, "openE2e %s: msg %s from %s %s\n", iSvc, iHead.Id, iHead.From, aFail)
+      aText := "This message could not be decrypted: "+ aFail
+      *iHead.SubHead = tHeader2{Alias: lookupUidAdrsbk(iSvc, iHead.From), Subject: "(encrypted message)"}
+      iHead.DataLen = int64(len(aText))
+      return &tE2eReader{r: strings.NewReader(aText), fail: aFail}, nil
+   }
+   iHead.DataLen -= sizeE2e(&aSub, aBodyLen)
+   *iHead.SubHead = aSub
+   aParts := []int64{aBodyLen}
+   for a := range aSub.Attach {
+      aParts = append(aParts, aSub.Attach[a].wireSize())
+   }
+   aRd := &tE2eReader{r: iR}
+   aRd.init(aGcm, aParts)
+   err := aRd._endParts() // in case of empty parts
+   if err != nil { return nil, err }
+   return aRd, nil
+}
+
+func _unwrapE2e(iSvc string, iE *tE2eHead) ([]byte, string) {
+   aPriv, _ := _getKeyE2e(iSvc)
+   aPub := aPriv.PublicKey()
+   aWrap := iE.Keys[_idE2e(aPub)]
+   if aWrap == nil {
+      return nil, "not encrypted for this node's key"
+   }
+   aEphPub, err := _parseKeyE2e(iE.Eph)
+   if err != nil {
+      return nil, "invalid ephemeral key"
+   }
+   aKey, err := _kekE2e(aPriv, aEphPub, aEphPub, aPub).Open(nil, make([]byte, 12), aWrap, nil)
+   if err != nil || len(aKey) != kE2eKeyLen {
+      return nil, "cannot unwrap message key"
+   }
+   return aKey, ""
+}
+
+// tE2ePart tracks the chunks of a sequence of parts; part 0 is the sub-header
+type tE2ePart struct {
+   gcm cipher.AEAD
+   parts []int64 // lengths of parts after sub-header
+   n int // index in parts
+   left int64 // of part
+   chunk uint64 // index in part
+   buf []byte // chunk being sealed or opened
+}
+
+func (o *tE2ePart) init(iGcm cipher.AEAD, iParts []int64) {
+   o.gcm, o.parts = iGcm, iParts
+   o.buf = make([]byte, 0, kE2eChunk + kE2eTagLen)
+   o._start(0)
+}
+
+func (o *tE2ePart) _start(iN int) {
+   o.n, o.chunk = iN, 0
+   if o.n < len(o.parts) {
+      o.left = o.parts[o.n]
+   }
+}
+
+// _next gives the nonce & additional data of the current chunk, and advances to the next one
+func (o *tE2ePart) _next() ([]byte, []byte) {
+   aNonce, aAd := _nonceE2e(uint32(o.n + 1), o.chunk), _adE2e(o.left == 0)
+   o.chunk++
+   if o.left == 0 {
+      o._start(o.n + 1)
+   }
+   return aNonce, aAd
+}
+
+type tE2eWriter struct {
+   tE2ePart
+   w io.Writer
+}
+
+func (o *tE2eWriter) Write(iBuf []byte) (int, error) {
+   aTotal := 0
+   for len(iBuf) > 0 {
+      err := o._endParts()
+      if err != nil { return aTotal, err }
+      if o.n >= len(o.parts) {
+         return aTotal, tError("data exceeds parts")
+      }
+      aLen := kE2eChunk - len(o.buf)
+      if aLen > len(iBuf) { aLen = len(iBuf) }
+      if int64(aLen) > o.left { aLen = int(o.left) }
+      o.buf = append(o.buf, iBuf[:aLen]...)
+      o.left -= int64(aLen)
+      aTotal += aLen
+      iBuf = iBuf[aLen:]
+      if len(o.buf) == kE2eChunk && o.left > 0 {
+         err = o._seal()
+         if err != nil { return aTotal, err }
+      }
+   }
+   return aTotal, o._endParts()
+}
+
+func (o *tE2eWriter) _seal() error {
+   aNonce, aAd := o._next()
+   o.buf = o.gcm.Seal(o.buf[:0], aNonce, o.buf, aAd)
+   _, err := o.w.Write(o.buf)
+   o.buf = o.buf[:0]
+   return err
+}
+
+// _endParts seals the last chunk of each complete part
+func (o *tE2eWriter) _endParts() error {
+   for o.n < len(o.parts) && o.left == 0 {
+      err := o._seal()
+      if err != nil { return err }
+   }
+   return nil
+}
+
+func (o *tE2eWriter) close() error {
+   err := o._endParts()
+   if err != nil { return err }
+   if o.n < len(o.parts) {
+      quit(tError("sealed message incomplete"))
+   }
+   return nil
+}
+
+type tE2eReader struct {
+   tE2ePart
+   r io.Reader
+   text []byte // verified plaintext not yet read
+   fail string
+}
+
+func (o *tE2eReader) Read(iBuf []byte) (int, error) {
+   if o.gcm == nil {
+      return o.r.Read(iBuf)
+   }
+   for len(o.text) == 0 {
+      if o.n >= len(o.parts) {
+         return 0, io.EOF
+      }
+      err := o._open()
+      if err != nil { return 0, err }
+   }
+   aLen := copy(iBuf, o.text)
+   o.text = o.text[aLen:]
+   var err error
+   if len(o.text) == 0 {
+      err = o._endParts()
+   }
+   return aLen, err
+}
+
+// _endParts reads the tag of each empty part which follows
+func (o *tE2eReader) _endParts() error {
+   for o.n < len(o.parts) && o.left == 0 {
+      err := o._open()
+      if err != nil { return err }
+   }
+   return nil
+}
+
+// _open reads & verifies the next chunk; on failure its plaintext is replaced with zeros
+func (o *tE2eReader) _open() error {
+   aLen := int64(kE2eChunk); if aLen > o.left { aLen = o.left }
+   aBuf := o.buf[:aLen + kE2eTagLen]
+   _, err := io.ReadFull(o.r, aBuf)
+   if err != nil { return err }
+   o.left -= aLen
+   aN := o.n
+   aNonce, aAd := o._next()
+   o.text, err = o.gcm.Open(aBuf[:0], aNonce, aBuf, aAd)
+   if err != nil {
+      if o.fail == "" {
+         o.fail = fmt.Sprintf("integrity check failed on part %d", aN + 1)
+      }
+      o.text = aBuf[:aLen]
+      for a := range o.text { o.text[a] = 0 }
+   }
+   return nil
+}
+
+// status gives the value for tIndexElCore.E2e
+func (o *tE2eReader) status() string {
+   if o.fail != "" {
+      return kE2eFailed + o.fail
+   }
+   return eE2eOk
+}
@@ -0,0 +1,246 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "archive/zip"
+   "encoding/xml"
+   "fmt"
+   "html"
+   "io"
+   "io/ioutil"
+   "os"
+   "path"
+   "strings"
+)
+
+// The text of attachments of text-based types and of filled forms is extracted for the search
+// index, and cached in extract/ so it's extracted once. Formats which need more than a zip & XML
+// reader aren't supported. With an encrypted store, the cache is encrypted like other files, and
+// the index is kept in memory; see openIndexSearch().
+
+const kExtractMax = 1024 * 1024 // bytes of text per attachment
+
+var kExtractType = map[string]string{
+   ".txt":"text", ".text":"text", ".md":"text", ".markdown":"text", ".csv":"text", ".tsv":"text",
+   ".json":"text", ".log":"text", ".xml":"html", ".html":"html", ".htm":"html",
+   ".docx":"docx", ".odt":"odf", ".ods":"odf", ".odp":"odf",
+}
+
+var kExtractZipPart = map[string]string{"docx":"word/document.xml", "odf":"content.xml"}
+
+// getTextExtract returns the text of an attachment, or "" if its type isn't supported;
+// the cache iDst is refreshed if older than the attachment
+func getTextExtract(iSrc, iDst string, iName string) string {
+   if kExtractType[strings.ToLower(path.Ext(iName))] == "" {
+      return ""
+   }
+   aSi, err := os.Stat(iSrc)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return ""
+   }
+   aDi, err := os.Stat(iDst)
+   if err == nil && !aDi.ModTime().Before(aSi.ModTime()) {
+      return _readExtract(iDst)
+   }
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   aText := extractText(iSrc, iName)
+   _writeExtract(iDst, aText)
+   return aText
+}
+
+// getFormExtract returns the data of a filled form, via the cache iDst
+func getFormExtract(iSvc string, iFft string, iMsgId string, iName string, iDst string, iLive bool) string {
+   _, err := os.Stat(iDst)
+   if err == nil {
+      return _readExtract(iDst)
+   }
+   if !os.IsNotExist(err) { quit(err) }
+   aBuf := readRowFilledForm(iSvc, iFft, iMsgId, iName, iLive)
+   if aBuf == nil {
+      return ""
+   }
+   if len(aBuf) > kExtractMax {
+      aBuf = aBuf[:kExtractMax]
+   }
+   aText := strings.ToValidUTF8(string(aBuf), "")
+   _writeExtract(iDst, aText)
+   return aText
+}
+
+func _readExtract(iPath string) string {
+   aFd, err := openFile(iPath)
+   if err != nil { quit(err) }
+   defer aFd.Close()
+   aBuf, err := ioutil.ReadAll(aFd)
+   if err != nil { quit(err) }
+   return string(aBuf)
+}
+
+func _writeExtract(iPath string, iText string) {
+   err := os.MkdirAll(path.Dir(iPath), 0700)
+   if err != nil { quit(err) }
+   aTemp := iPath + ".tmp"
+   err = os.Remove(aTemp)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   aTd, err := openFileFlags(aTemp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+   if err != nil { quit(err) }
+   _, err = aTd.Write([]byte(iText))
+   if err != nil { quit(err) }
+   err = aTd.Sync()
+   if err != nil { quit(err) }
+   aTd.Close()
+   err = os.Rename(aTemp, iPath)
+   if err != nil { quit(err) }
+}
+
+// dropExtractAttach removes the cached text in extract/iSub/ starting with iPrefix, or all if empty
+func dropExtractAttach(iSvc string, iSub string, iPrefix string) {
+   if iPrefix == "" {
+      err := os.RemoveAll(dirExtract(iSvc) + iSub)
+      if err != nil { quit(err) }
+      return
+   }
+   aDir, err := readDirNames(dirExtract(iSvc) + iSub)
+   if err != nil {
+      if os.IsNotExist(err) { return }
+      quit(err)
+   }
+   for _, aFn := range aDir {
+      if !strings.HasPrefix(aFn, iPrefix) { continue }
+      err = os.Remove(dirExtract(iSvc) + iSub +"/"+ aFn)
+      if err != nil && !os.IsNotExist(err) { quit(err) }
+   }
+}
+
+// extractText returns the text of an attachment, or "" if its type isn't supported
+func extractText(iPath string, iName string) string {
+   aType := kExtractType[strings.ToLower(path.Ext(iName))]
+   if aType == "" {
+      return ""
+   }
+   var aText string
+   var err error
+   switch aType {
+   case "text", "html":
+      var aFd *tFile
+      aFd, err = openFile(iPath)
+      if err != nil {
+         if os.IsNotExist(err) { return "" }
+         quit(err)
+      }
+      defer aFd.Close()
+      var aBuf []byte
+      aBuf, err = ioutil.ReadAll(io.LimitReader(aFd, kExtractMax))
+      if err != nil { quit(err) }
+      aText = string(aBuf)
+      if aType == "html" {
+         aText = _stripTagsExtract(aText)
+      }
+   default:
+      aText, err = _readZipExtract(iPath, kExtractZipPart[aType])
+   }
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "extractText: %s %v\n", iPath, err)
+      return ""
+   }
+   return strings.ToValidUTF8(aText, "")
+}
+
+// _stripTagsExtract drops markup, comments, scripts & styles, and decodes entities
+func _stripTagsExtract(iText string) string {
+   var aOut strings.Builder
+   for len(iText) > 0 {
+      aLt := strings.IndexByte(iText, '<')
+      if aLt < 0 {
+         aOut.WriteString(iText)
+         break
+      }
+      aOut.WriteString(iText[:aLt])
+      aOut.WriteByte(' ')
+      iText = iText[aLt:]
+      aEnd := ">"
+      aLower := strings.ToLower(iText[:_minExtract(len(iText), 8)])
+      switch {
+      case strings.HasPrefix(aLower, "<!--"):     aEnd = "-->"
+      case strings.HasPrefix(aLower, "<script"): aEnd = "</script>"
+      case strings.HasPrefix(aLower, "<style"):  aEnd = "</style>"
+      }
+      aPos := strings.Index(strings.ToLower(iText), aEnd)
+      if aPos < 0 {
+         break
+      }
+      iText = iText[aPos + len(aEnd):]
+   }
+   return html.UnescapeString(aOut.String())
+}
+
+func _minExtract(iA, iB int) int { if iA < iB { return iA }; return iB }
+
+// _readZipExtract returns the character data of an XML file in a zip archive
+func _readZipExtract(iPath string, iPart string) (string, error) {
+   aFd, err := openFile(iPath)
+   if err != nil {
+      if os.IsNotExist(err) { return "", nil }
+      quit(err)
+   }
+   defer aFd.Close()
+   aFi, err := aFd.Stat()
+   if err != nil { quit(err) }
+   aZr, err := zip.NewReader(tReaderAtExtract{aFd}, aFi.Size())
+   if err != nil {
+      return "", err
+   }
+   for _, aZf := range aZr.File {
+      if aZf.Name != iPart { continue }
+      aRd, err := aZf.Open()
+      if err != nil {
+         return "", err
+      }
+      defer aRd.Close()
+      var aOut strings.Builder
+      aDec := xml.NewDecoder(io.LimitReader(aRd, 8 * kExtractMax))
+      for aOut.Len() < kExtractMax {
+         aTok, err := aDec.Token()
+         if err == io.EOF {
+            break
+         } else if err != nil {
+            return "", err
+         }
+         switch aT := aTok.(type) {
+         case xml.CharData:
+            aOut.Write(aT)
+         case xml.EndElement: // paragraph, heading, break
+            if aT.Name.Local == "p" || aT.Name.Local == "h" || aT.Name.Local == "br" {
+               aOut.WriteByte('\n')
+            }
+         case xml.StartElement:
+            if aT.Name.Local == "tab" || aT.Name.Local == "s" {
+               aOut.WriteByte(' ')
+            }
+         }
+      }
+      return aOut.String(), nil
+   }
+   return "", tError("missing "+ iPart)
+}
+
+type tReaderAtExtract struct { fd *tFile } // for zip.NewReader
+
+func (o tReaderAtExtract) ReadAt(iBuf []byte, iPos int64) (int, error) {
+   _, err := o.fd.Seek(iPos, io.SeekStart)
+   if err != nil {
+      return 0, err
+   }
+   aLen, err := io.ReadFull(o.fd, iBuf)
+   if err == io.ErrUnexpectedEOF {
+      err = io.EOF
+   }
+   return aLen, err
+}
@@ -96,8 +96,8 @@ func (tGlobalBlankForm) Add(iFileName, iDupeRev string, iR io.Reader) error {
    aTempOk := aPath + ".tok"
 
    if iDupeRev != "" {
-      var aDd *os.File
-      aDd, err = os.Open(kFormDir + iFileName)
+      var aDd *tFile
+      aDd, err = openFile(kFormDir + iFileName)
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
          return tError("source not found")
@@ -228,7 +228,7 @@ func writeTableFilledForm(iW io.Writer, iSvc string, iFft string) error {
    var err error
    aDoor := _getFormDoor(iSvc, iFft)
    aDoor.RLock(); defer aDoor.RUnlock()
-   aFd, err := os.Open(fileForm(iSvc, iFft))
+   aFd, err := openFile(fileForm(iSvc, iFft))
    if err != nil { return err }
    defer aFd.Close()
    _, err = io.Copy(iW, aFd)
@@ -237,47 +237,75 @@ func writeTableFilledForm(iW io.Writer, iSvc string, iFft string) error {
 
 func writeRowFilledForm(iW io.Writer, iSvc string, iFft string,
                         iMsgId string, iName string) (int64, error) {
-   var err error
    aDoor := _getFormDoor(iSvc, iFft)
    aDoor.RLock(); defer aDoor.RUnlock()
-   aFd, err := os.Open(fileForm(iSvc, iFft))
+   aFd, err := openFile(fileForm(iSvc, iFft))
    if err != nil { quit(err) }
    defer aFd.Close()
+   aLen, aOk, err := _writeRowFilledForm(iW, aFd, iMsgId, iName)
+   if !aOk {
+      quit(fmt.Errorf("%s formfill table %s lacks msgid %s\n", iSvc, iFft, iMsgId))
+   }
+   return aLen, err
+}
 
-   aDc := json.NewDecoder(aFd)
+// readRowFilledForm returns a row's data, or nil if not found.
+// iLive is false on reindex, when the service may not be open.
+func readRowFilledForm(iSvc string, iFft string, iMsgId string, iName string, iLive bool) []byte {
+   if iLive {
+      aDoor := _getFormDoor(iSvc, iFft)
+      aDoor.RLock(); defer aDoor.RUnlock()
+   }
+   aFd, err := openFile(fileForm(iSvc, iFft))
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return nil
+   }
+   defer aFd.Close()
+   var aBuf bytes.Buffer
+   _, aOk, err := _writeRowFilledForm(&aBuf, aFd, iMsgId, iName)
+   if err != nil { quit(err) }
+   if !aOk {
+      return nil
+   }
+   return aBuf.Bytes()
+}
+
+func _writeRowFilledForm(iW io.Writer, iFd *tFile, iMsgId string, iName string) (int64, bool, error) {
+   aDc := json.NewDecoder(iFd)
    aDc.UseNumber()
-   _, err = aDc.Token()
+   _, err := aDc.Token()
    if err != nil { quit(err) }
 
    var aRow Msg
    for aRow = nil; aDc.More(); aRow = nil {
       err = aDc.Decode(&aRow)
       if err != nil { quit(err) }
-      if aRow["$msgid"].(string) == iMsgId &&
+      if aId, _ := aRow["$msgid"].(string); aId == iMsgId && // not string if $deleted
          (aRow["$name"] == nil || aRow["$name"].(string) == iName) { // nil test for pre-0.8
          break
       }
    }
    if aRow == nil {
-      quit(fmt.Errorf("%s formfill table %s lacks msgid %s\n", iSvc, iFft, iMsgId))
+      return 0, false, nil
    }
    aLen, err := aRow["$size"].(json.Number).Int64()
    if err != nil { quit(err) }
    aTxt := aRow["$text"]
    if aTxt != nil {
       _, err = io.WriteString(iW, aTxt.(string))
-      return aLen, err
+      return aLen, true, err
    }
    aPos, err := aRow["$offset"].(json.Number).Int64()
    if err != nil { quit(err) }
 
-   _, err = aFd.Seek(aPos, io.SeekStart)
+   _, err = iFd.Seek(aPos, io.SeekStart)
    if err != nil { quit(err) }
-   _, err = io.CopyN(iW, aFd, aLen-1)
+   _, err = io.CopyN(iW, iFd, aLen-1)
    if err == nil {
       _, err = iW.Write([]byte{'}'})
    }
-   return aLen, err //todo only net errors
+   return aLen, true, err //todo only net errors
 }
 
 func validateFilledForm(iSvc string, iBuf []byte, iFfn string) error {
@@ -321,7 +349,7 @@ func _retrieveSpec(iFfn string) error {
    //todo download from registry
    aTd, err := os.Open("./formspec")
    if err != nil { quit(err) }
-   aFd, err := os.OpenFile(fileFormReg(iFfn), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+   aFd, err := openFileFlags(fileFormReg(iFfn), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
    if err != nil { quit(err) }
    _, err = io.Copy(aFd, aTd)
    if err != nil { quit(err) }
@@ -370,7 +398,7 @@ func _validateType(iResult *[]byte, iParent string, iField interface{}, iEl *tSp
 func tempFilledForm(iSvc string, iThreadId, iMsgId string, iSuffix string, iFile *tHeader2Attach,
                     iFftSize map[string]int64, iR io.Reader) error {
    aTemp := ftmpAtc(iSvc, iMsgId, iFile.Name)
-   aFd, err := os.OpenFile(aTemp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+   aFd, err := openFileFlags(aTemp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aFd.Close()
 
@@ -382,7 +410,7 @@ func tempFilledForm(iSvc string, iThreadId, iMsgId string, iSuffix string, iFile
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
       } else {
-         aPos = aFi.Size() - 1
+         aPos = sizeFile(fileForm(iSvc, iFile.Ffn + iSuffix), aFi) - 1
       }
    }
    _, err = aFd.Write([]byte(fmt.Sprintf("%016x%016x%s", aPos, aPos, iSuffix))) // 2 copies for safety
@@ -442,7 +470,7 @@ func removeTempFilledForm(iSvc string, iMsgId string, iFile *tHeader2Attach) {
 
 func storeFilledForm(iSvc string, iMsgId string, iFile *tHeader2Attach) bool {
    aTemp := ftmpAtc(iSvc, iMsgId, iFile.Name)
-   aTd, err := os.Open(aTemp)
+   aTd, err := openFile(aTemp)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
       fmt.Fprintf(os.Stderr, "storeFilledForm %s: missing %s, assume it was appended to %s\n",
@@ -473,7 +501,7 @@ func storeFilledForm(iSvc string, iMsgId string, iFile *tHeader2Attach) bool {
    _, err = os.Lstat(aPath)
    if err != nil && !os.IsNotExist(err) { quit(err) }
    aDoSync := err != nil
-   aFd, err := os.OpenFile(aPath, os.O_WRONLY|os.O_CREATE, 0600)
+   aFd, err := openFileFlags(aPath, os.O_WRONLY|os.O_CREATE, 0600)
    if err != nil { quit(err) }
    defer aFd.Close()
    if aPos[0] > 0 {
@@ -487,6 +515,61 @@ func storeFilledForm(iSvc string, iMsgId string, iFile *tHeader2Attach) bool {
    return aDoSync
 }
 
+// blankRowsFilledForm overwrites rows for iMsgIds in place, so table offsets don't change
+func blankRowsFilledForm(iSvc string, iMsgIds []string) {
+   if len(iMsgIds) == 0 {
+      return
+   }
+   aSet := make(map[string]bool, len(iMsgIds))
+   for _, aId := range iMsgIds {
+      aSet[aId] = true
+   }
+   aDir, err := readDirNames(dirForm(iSvc))
+   if err != nil { quit(err) }
+   for _, aFile := range aDir {
+      if strings.HasSuffix(aFile, ".bak") { continue }
+      _blankRowsFilledForm(iSvc, unescapeFile(aFile), aSet)
+   }
+}
+
+func _blankRowsFilledForm(iSvc string, iFft string, iSet map[string]bool) {
+   aDoor := _getFormDoor(iSvc, iFft)
+   aDoor.Lock(); defer aDoor.Unlock()
+   aFd, err := openFileFlags(fileForm(iSvc, iFft), os.O_RDWR, 0600)
+   if err != nil { quit(err) }
+   defer aFd.Close()
+   var aBuf bytes.Buffer
+   _, err = io.Copy(&aBuf, aFd)
+   if err != nil { quit(err) }
+   var aRows []json.RawMessage
+   err = json.Unmarshal(aBuf.Bytes(), &aRows)
+   if err != nil { quit(err) }
+
+   aDoSync := false
+   var aPos int64
+   for _, aRow := range aRows {
+      aN := bytes.Index(aBuf.Bytes()[aPos:], aRow)
+      if aN < 0 { quit(tError("row not found in "+ iFft)) }
+      aPos += int64(aN)
+      var aMeta struct { Msgid string `json:"$msgid"` }
+      err = json.Unmarshal(aRow, &aMeta)
+      if err != nil { quit(err) }
+      if iSet[aMeta.Msgid] {
+         aBlank := bytes.Repeat([]byte{' '}, len(aRow))
+         copy(aBlank, `{"$deleted":true`)
+         aBlank[len(aBlank)-1] = '}'
+         _, err = aFd.WriteAt(aBlank, aPos)
+         if err != nil { quit(err) }
+         aDoSync = true
+      }
+      aPos += int64(len(aRow))
+   }
+   if aDoSync {
+      err = aFd.Sync()
+      if err != nil { quit(err) }
+   }
+}
+
 func _getFormDoor(iSvc string, iFfn string) *sync.RWMutex {
    return getDoorService(iSvc, iFfn, func()tDoor{ return &sync.RWMutex{} }).(*sync.RWMutex)
 }
@@ -163,8 +163,8 @@ func MakeNode(iR io.Reader) error {
       } else if aHead.Typeflag == tar.TypeReg {
          err = os.Remove(dirSvc(aTemp) + aName) // delete placeholder
          if err != nil && !os.IsNotExist(err) { quit(err) }
-         var aFd *os.File
-         aFd, err = os.OpenFile(dirSvc(aTemp) + aName, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
+         var aFd *tFile
+         aFd, err = openFileFlags(dirSvc(aTemp) + aName, os.O_WRONLY|os.O_CREATE|os.O_EXCL,
                                 os.FileMode(aHead.Mode))
          if err != nil {
             if !os.IsNotExist(err) { quit(err) }
@@ -315,7 +315,7 @@ func _runTar(iSvc string, iW *io.PipeWriter, iNode *tNode, iToNode *tToNode) {
    if err != nil { return }
 
    fPut := func(cPath string) error {
-      cFd, err := os.Open(cPath)
+      cFd, err := openFile(cPath)
       if err != nil { quit(err) }
       defer cFd.Close()
       var cLen int64
@@ -327,6 +327,10 @@ func _runTar(iSvc string, iW *io.PipeWriter, iNode *tNode, iToNode *tToNode) {
          if err != nil { return err }
          cLen, err = cDl.copy(aTf)
       } else {
+         var cFi os.FileInfo
+         cFi, err = cFd.Stat()
+         if err != nil { quit(err) }
+         aHead.Size = cFi.Size() // contents size if encrypted
          err = aTf.WriteHeader(&aHead)
          if err != nil { return err }
          cLen, err = io.Copy(aTf, cFd)
@@ -366,7 +370,7 @@ func _runTar(iSvc string, iW *io.PipeWriter, iNode *tNode, iToNode *tToNode) {
             if strings.HasPrefix(cPath, "form/") {
                cPathHead = unescapeFile(cPath)
             }
-            aHead = tar.Header{Name: cPathHead, Size: cFi.Size(),
+            aHead = tar.Header{Name: cPathHead, Size: sizeFile(dirSvc(iSvc) + cPath, cFi),
                                ModTime: cFi.ModTime(), Typeflag: cHeadType, Mode: int64(cFi.Mode())}
             err = fPut(dirSvc(iSvc) + cPath)
             cHeadType = tar.TypeReg
@@ -380,7 +384,8 @@ func _runTar(iSvc string, iW *io.PipeWriter, iNode *tNode, iToNode *tToNode) {
    if err != nil { quit(err) }
    for _, aFi := range aDir {
       if aFi.Name() == "temp" || aFi.Name() == "sendq" ||
-         aFi.Name() == "ping-draft" || aFi.Name() == "index.bleve" { continue }
+         aFi.Name() == "ping-draft" || aFi.Name() == "index.bleve" ||
+         aFi.Name() == "e2ekey" || aFi.Name() == "signkey" { continue } // node has own keys
       if aFi.IsDir() {
          err = fSub(aFi.Name())
       } else if aFi.Name() == "config" {
@@ -400,7 +405,7 @@ func _runTar(iSvc string, iW *io.PipeWriter, iNode *tNode, iToNode *tToNode) {
             if !os.IsNotExist(err) { quit(err) }
             continue // placeholder symlink
          }
-         aHead = tar.Header{Name: aFi.Name(), Size: aFi.Size(),
+         aHead = tar.Header{Name: aFi.Name(), Size: sizeFile(dirSvc(iSvc) + aFi.Name(), aFi),
                             ModTime: aFi.ModTime(), Typeflag: tar.TypeReg, Mode: int64(aFi.Mode())}
          err = fPut(dirSvc(iSvc) + aFi.Name())
       }
@@ -439,12 +444,19 @@ func _getAttachInodes(iSvc string) []tPathInode {
    for a := range aDir {
       var aSub []os.FileInfo
       aSub, err = readDirFis(dirAttach(iSvc) + aDir[a])
-      if err != nil { quit(err) }
+      if err != nil {
+         if os.IsNotExist(err) { continue } // deleted since readDirNames(), see _statusUpload()
+         quit(err)
+      }
       for _, aFi := range aSub {
          var aId uint64
          aId, err = getInode(dirAttach(iSvc) + aDir[a], aFi)
-         if err != nil { quit(err) }
-         aList = append(aList, tPathInode{aDir[a] +"/"+ aFi.Name(), aId, aFi.Size(), aFi.ModTime()})
+         if err != nil {
+            if os.IsNotExist(err) { continue }
+            quit(err)
+         }
+         aList = append(aList, tPathInode{aDir[a] +"/"+ aFi.Name(), aId,
+                                          sizeFile(dirAttach(iSvc) + aDir[a] +"/"+ aFi.Name(), aFi), aFi.ModTime()})
       }
    }
    sort.Slice(aList, func(cA, cB int)bool { return aList[cA].inode < aList[cB].inode })
@@ -454,12 +466,16 @@ func _getAttachInodes(iSvc string) []tPathInode {
    for _, aFi := range aDirUp {
       var aId uint64
       aId, err = getInode(kUploadDir, aFi)
-      if err != nil { quit(err) }
+      if err != nil {
+         if os.IsNotExist(err) { continue }
+         quit(err)
+      }
       aPos := sort.Search(len(aList), func(c int)bool { return aList[c].inode >= aId })
       if aPos < len(aList) && aList[aPos].inode == aId {
          aList = append(aList, tPathInode{})
          copy(aList[aPos+1:], aList[aPos:])
-         aList[aPos] = tPathInode{kNodeFlagUpload + aFi.Name(), aId, aFi.Size(), aFi.ModTime()}
+         aList[aPos] = tPathInode{kNodeFlagUpload + aFi.Name(), aId, sizeFile(kUploadDir + aFi.Name(), aFi),
+                                  aFi.ModTime()}
       }
    }
    return aList
@@ -498,7 +514,7 @@ func syncUpdtNode(iSvc string, iUpdt *Update, iState *ClientState, iFunc func()e
    aLog := ftmpSyncLog(iSvc)
    aTempOk := ftmpSyncUpdt(iSvc, iState.id)
    aTemp := aTempOk +".tmp"
-   var aTd *os.File
+   var aTd *tFile
    var err error
    var aPos int64
 
@@ -510,11 +526,11 @@ func syncUpdtNode(iSvc string, iUpdt *Update, iState *ClientState, iFunc func()e
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
       } else {
-         aPos = aFi.Size(); if aPos > 0 { aPos-- }
+         aPos = sizeFile(aLog, aFi); if aPos > 0 { aPos-- }
       }
       aTempOk += fmt.Sprint(aPos)
 
-      aTd, err = os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+      aTd, err = openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
       if err != nil { quit(err) }
       defer aTd.Close()
 
@@ -533,15 +549,15 @@ func syncUpdtNode(iSvc string, iUpdt *Update, iState *ClientState, iFunc func()e
    } else {
       aPos = iUpdt.logPos
       aTempOk += fmt.Sprint(aPos)
-      aTd, err = os.Open(aTempOk)
+      aTd, err = openFile(aTempOk)
       if err != nil { quit(err) }
       defer aTd.Close()
    }
 
    if iFunc() == nil {
       sCrashFn(iSvc, "sync-updt-node")
-      var aFd *os.File
-      aFd, err = os.OpenFile(aLog, os.O_WRONLY, 0600)
+      var aFd *tFile
+      aFd, err = openFileFlags(aLog, os.O_WRONLY, 0600)
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
          err = os.Remove(aLog)
@@ -549,7 +565,7 @@ func syncUpdtNode(iSvc string, iUpdt *Update, iState *ClientState, iFunc func()e
          aLogQ := ftmpSyncLogQ(iSvc, makeLocalId("")[1:])
          err = os.Symlink(aLogQ[len(dirTemp(iSvc)):], aLog)
          if err != nil { quit(err) }
-         aFd, err = os.OpenFile(aLogQ, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+         aFd, err = openFileFlags(aLogQ, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
          if err != nil { quit(err) }
          err = syncDir(dirTemp(iSvc))
          if err != nil { quit(err) }
@@ -581,7 +597,7 @@ func initSyncNode(iSvc string) {
    aFi, err := os.Stat(ftmpSyncLog(iSvc))
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
-   } else if aFi.Size() > 0 {
+   } else if sizeFile(ftmpSyncLog(iSvc), aFi) > 0 {
       var aPath string
       aPath, err = os.Readlink(ftmpSyncLog(iSvc))
       if err != nil { quit(err) }
@@ -615,7 +631,7 @@ func sendSyncNode(iW io.Writer, iSvc string, iNodeQ, iId string) error {
    aSvc.nodeUpdt.Unlock()
 //todo fmt.Println("## send ", iNodeQ, iSvc, " log", aPath, err)
 
-   aFd, err := os.Open(dirTemp(iSvc) + iNodeQ)
+   aFd, err := openFile(dirTemp(iSvc) + iNodeQ)
    if err != nil { quit(err) }
    defer aFd.Close()
    aFi, err := aFd.Stat()
@@ -639,8 +655,8 @@ func dropSyncNode(iSvc string, iNodeQ, iQid string, iComplete string) {
    aTemp := aTempOk +".tmp"
    var err error
    if iComplete == "" {
-      var aFd *os.File
-      aFd, err = os.OpenFile(aTemp, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0600)
+      var aFd *tFile
+      aFd, err = openFileFlags(aTemp, os.O_RDONLY|os.O_CREATE|os.O_EXCL, 0600)
       if err != nil { quit(err) }
       err = aFd.Sync() // not strictly required since no data
       if err != nil { quit(err) }
@@ -8,6 +8,7 @@
 package slib
 
 import (
+   "strings"
    "time"
 )
 
@@ -22,6 +23,8 @@ type tNoticeEl struct {
    Alias string
    Gid string `json:",omitempty"`
    Blurb string `json:",omitempty"`
+   Uid string `json:",omitempty"` // for a changed key
+   Key string `json:",omitempty"` // changed key, until accepted
 }
 
 func GetIdxNotice(iSvc string) []tNoticeEl {
@@ -84,3 +87,85 @@ func setLastSeenNotice(iSvc string, iUpdt *Update) error {
    return nil
 }
 
+
+func addThreadNotice(iSvc string, iTid string, iSubject string) {
+   _addNotice(iSvc, tNoticeEl{Type:"s", MsgId:iTid, Date:dateRFC3339(), Alias:"snoozed thread",
+                              Blurb:iSubject})
+}
+
+func addSignNotice(iSvc string, iMsgId string, iAlias string, iSubject string) {
+   aBlurb := "signature mismatch"; if iSubject != "" { aBlurb += ": "+ iSubject }
+   _addNotice(iSvc, tNoticeEl{Type:"v", MsgId:iMsgId, Date:dateRFC3339(), Alias:iAlias, Blurb:aBlurb})
+}
+
+func addQuotaNotice(iSvc string, iMsgId string, iAlias string, iSubject string, iReason string) {
+   aBlurb := "refused, "+ iReason; if iSubject != "" { aBlurb += ": "+ iSubject }
+   _addNotice(iSvc, tNoticeEl{Type:"q", MsgId:iMsgId, Date:dateRFC3339(), Alias:iAlias, Blurb:aBlurb})
+}
+
+func addScanNotice(iSvc string, iMsgId string, iAlias string, iSubject string, iReason string) {
+   aBlurb := "quarantined "+ iReason; if iSubject != "" { aBlurb += ": "+ iSubject }
+   _addNotice(iSvc, tNoticeEl{Type:"x", MsgId:iMsgId, Date:dateRFC3339(), Alias:iAlias, Blurb:aBlurb})
+}
+
+// addKeyNotice reports a changed key of a uid, unless already reported
+func addKeyNotice(iSvc string, iMsgId string, iUid string, iKey string, iBlurb string) {
+   aAlias := lookupUidAdrsbk(iSvc, iUid)
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   for a := range aSvc.notice {
+      if aSvc.notice[a].MsgId == iMsgId {
+         return
+      }
+   }
+   aEl := tNoticeEl{Type:"k", MsgId:iMsgId, Date:dateRFC3339(), Alias:aAlias, Uid:iUid, Key:iKey,
+                    Blurb:iBlurb +"; accept it only if the sender confirms it"}
+   aSvc.notice = append(aSvc.notice, aEl)
+   err := storeFile(fileNotc(iSvc), aSvc.notice)
+   if err != nil { quit(err) }
+}
+
+// acceptKeyNotice pins the key given by a notice from addKeyNotice()
+func acceptKeyNotice(iSvc string, iUpdt *Update) error {
+   if iUpdt.Notice.MsgId == "" {
+      return tError("msgid missing")
+   }
+   var aEl tNoticeEl
+   aSvc := getService(iSvc)
+   aSvc.Lock()
+   for a := range aSvc.notice {
+      if aSvc.notice[a].MsgId == iUpdt.Notice.MsgId && aSvc.notice[a].Key != "" {
+         aEl = aSvc.notice[a]
+         aSvc.notice[a].Key = ""
+         aSvc.notice[a].Blurb = "accepted "+ aSvc.notice[a].Blurb
+         err := storeFile(fileNotc(iSvc), aSvc.notice)
+         if err != nil { quit(err) }
+         break
+      }
+   }
+   aSvc.Unlock()
+   if aEl.Key == "" {
+      return tError("key notice not found")
+   }
+   if strings.HasPrefix(aEl.MsgId, kNoticeKeySign) {
+      pinPeerSign(iSvc, aEl.Uid, aEl.Key)
+   } else {
+      pinPeerE2e(iSvc, aEl.Uid, aEl.Key)
+   }
+   return nil
+}
+
+// _addNotice appends a notice, replacing any with the same MsgId
+func _addNotice(iSvc string, iEl tNoticeEl) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   for a := range aSvc.notice {
+      if aSvc.notice[a].MsgId == iEl.MsgId {
+         aSvc.notice = aSvc.notice[:a + copy(aSvc.notice[a:], aSvc.notice[a+1:])]
+         break
+      }
+   }
+   aSvc.notice = append(aSvc.notice, iEl)
+   err := storeFile(fileNotc(iSvc), aSvc.notice)
+   if err != nil { quit(err) }
+}
@@ -8,12 +8,23 @@
 package slib
 
 import (
+   "fmt"
+   "os"
    "sort"
+   "time"
 )
 
 type tQueueEl struct {
   Srec SendRecord
   Date string
+  Sent bool `json:",omitempty"` // written to a connection, awaiting ack
+}
+
+type tSchedEl struct {
+  Srec SendRecord
+  SendAt string // RFC3339 UTC
+  Node string   // the only node which releases it to sendQ
+  Date string
 }
 
 func GetQueue(iSvc string, iPostFn func(...*SendRecord)) []*SendRecord {
@@ -93,6 +104,53 @@ func addListQueue(iSvc string, iType byte, iIds []string, iNoPost string) []*Sen
    return nil
 }
 
+// startSendQueue marks an item as written; returns false if it left the queue
+func startSendQueue(iSvc string, iId string) bool {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= iId })
+   if aEl == len(aSvc.sendQ) || aSvc.sendQ[aEl].Srec.Id != iId {
+      return false
+   }
+   if !aSvc.sendQ[aEl].Sent {
+      aSvc.sendQ[aEl].Sent = true
+      err := storeFile(fileSendq(iSvc), aSvc.sendQ)
+      if err != nil { quit(err) }
+   }
+   return true
+}
+
+// failSendQueue clears the mark of an item whose write failed, so it may be unsent
+func failSendQueue(iSvc string, iId string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= iId })
+   if aEl == len(aSvc.sendQ) || aSvc.sendQ[aEl].Srec.Id != iId || !aSvc.sendQ[aEl].Sent {
+      return
+   }
+   aSvc.sendQ[aEl].Sent = false
+   err := storeFile(fileSendq(iSvc), aSvc.sendQ)
+   if err != nil { quit(err) }
+}
+
+// unsendQueue drops an item which hasn't been written to a connection
+func unsendQueue(iSvc string, iType byte, iId string) error {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aId := string(iType) + iId
+   aEl := sort.Search(len(aSvc.sendQ), func(c int) bool { return aSvc.sendQ[c].Srec.Id >= aId })
+   if aEl == len(aSvc.sendQ) || aSvc.sendQ[aEl].Srec.Id != aId {
+      return tError("not queued")
+   }
+   if aSvc.sendQ[aEl].Sent {
+      return tError("too late, already in flight")
+   }
+   aSvc.sendQ = aSvc.sendQ[:aEl + copy(aSvc.sendQ[aEl:], aSvc.sendQ[aEl+1:])]
+   err := storeFile(fileSendq(iSvc), aSvc.sendQ)
+   if err != nil { quit(err) }
+   return nil
+}
+
 func dropQueue(iSvc string, iId string) {
    aSvc := getService(iSvc)
    aSvc.Lock(); defer aSvc.Unlock()
@@ -105,3 +163,127 @@ func dropQueue(iSvc string, iId string) {
    if err != nil { quit(err) }
 }
 
+
+func GetSchedQueue(iSvc string) interface{} {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   aList := make([]tSchedEl, len(aSvc.schedQ))
+   for a := range aSvc.schedQ {
+      aList[a] = *aSvc.schedQ[a]
+   }
+   sort.SliceStable(aList, func(cA, cB int) bool { return aList[cA].SendAt < aList[cB].SendAt })
+   return aList
+}
+
+func hasSchedQueue(iSvc string, iId string) bool {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   aEl := sort.Search(len(aSvc.schedQ), func(c int) bool { return aSvc.schedQ[c].Srec.Id >= iId })
+   return aEl < len(aSvc.schedQ) && aSvc.schedQ[aEl].Srec.Id == iId
+}
+
+// setSchedQueue adds or reschedules an item, or drops it if iSched.SendAt is empty
+func setSchedQueue(iSvc string, iSched *UpdateSched) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aEl := sort.Search(len(aSvc.schedQ), func(c int) bool { return aSvc.schedQ[c].Srec.Id >= iSched.Id })
+   aHas := aEl < len(aSvc.schedQ) && aSvc.schedQ[aEl].Srec.Id == iSched.Id
+   if iSched.SendAt == "" {
+      if !aHas {
+         return
+      }
+      aSvc.schedQ = aSvc.schedQ[:aEl + copy(aSvc.schedQ[aEl:], aSvc.schedQ[aEl+1:])]
+   } else if aHas {
+      aCopy := *aSvc.schedQ[aEl]
+      aCopy.SendAt = iSched.SendAt
+      aSvc.schedQ[aEl] = &aCopy
+   } else {
+      if iSched.Node == "" { // edit from another node crossed a release
+         return
+      }
+      aSvc.schedQ = append(aSvc.schedQ, nil)
+      copy(aSvc.schedQ[aEl+1:], aSvc.schedQ[aEl:])
+      aSvc.schedQ[aEl] = &tSchedEl{Srec:SendRecord{iSched.Id}, SendAt:iSched.SendAt,
+                                   Node:iSched.Node, Date:dateRFC3339()}
+   }
+   err := storeFile(fileSchedq(iSvc), aSvc.schedQ)
+   if err != nil { quit(err) }
+   _armSchedQueue(iSvc, aSvc)
+}
+
+// syncSchedQueue applies iSched and replicates it to other nodes; caller holds service.updt
+func syncSchedQueue(iSvc string, iSched *UpdateSched) {
+   aUpdt := Update{Op: "sched_sync", Sched: iSched}
+   aState := ClientState{id: "syncSchedQueue", History: []string{""}}
+   syncUpdtNode(iSvc, &aUpdt, &aState, func() error {
+      applySchedQueue(iSvc, &aUpdt)
+      return nil
+   })
+}
+
+func applySchedQueue(iSvc string, iUpdt *Update) {
+   if iUpdt.Sched.Release {
+      if iUpdt.log != eLogNone { // only the originating node sends it
+         addQueue(iSvc, iUpdt.Sched.Id[0], iUpdt.Sched.Id[1:])
+      }
+      iUpdt.Sched.SendAt = ""
+   }
+   setSchedQueue(iSvc, iUpdt.Sched)
+}
+
+func initSchedQueue(iSvc string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   _armSchedQueue(iSvc, aSvc)
+}
+
+// _armSchedQueue sets a timer for the earliest item this node releases; caller holds aSvc.Lock
+func _armSchedQueue(iSvc string, iService *tService) {
+   if iService.schedTimer != nil {
+      iService.schedTimer.Stop()
+      iService.schedTimer = nil
+   }
+   aNext := ""
+   for _, aEl := range iService.schedQ {
+      if aEl.Node == iService.config.Node && (aNext == "" || aEl.SendAt < aNext) {
+         aNext = aEl.SendAt
+      }
+   }
+   if aNext == "" {
+      return
+   }
+   aAt, err := time.Parse(time.RFC3339, aNext)
+   if err != nil { quit(err) }
+   iService.schedTimer = time.AfterFunc(time.Until(aAt), func() {
+      sMsgToSelfFn(iSvc, &Header{Op:"_sched"})
+   })
+}
+
+// runSchedQueue releases this node's due items and replicates that to other nodes;
+// a thread draft that no longer validates is unscheduled; returns true if any item left
+func runSchedQueue(iSvc string) bool {
+   aSvc := getService(iSvc)
+   aSvc.updt.RLock(); defer aSvc.updt.RUnlock()
+   aNow := dateRFC3339()
+   var aDue []string
+   aSvc.RLock()
+   for _, aEl := range aSvc.schedQ {
+      if aEl.Node == aSvc.config.Node && aEl.SendAt <= aNow {
+         aDue = append(aDue, aEl.Srec.Id)
+      }
+   }
+   aSvc.RUnlock()
+   for _, aId := range aDue {
+      if aId[0] == eSrecThread {
+         err := validateDraftThread(iSvc, aId[1:])
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "runSchedQueue %s: unscheduled %s: %s\n", iSvc, aId, err.Error())
+            syncSchedQueue(iSvc, &UpdateSched{Id:aId})
+            continue
+         }
+      }
+      syncSchedQueue(iSvc, &UpdateSched{Id:aId, Release:true})
+   }
+   initSchedQueue(iSvc)
+   return len(aDue) > 0
+}
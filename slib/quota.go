@@ -0,0 +1,195 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "fmt"
+   "os"
+   "sort"
+   "strings"
+   "sync"
+)
+
+// sQuotaUsed keeps a running total of the space used by each service, counted once by
+// _sizeQuota and then raised by each message admitted. Deletions aren't tracked, so the
+// total is recounted before refusing a message.
+var sQuotaDoor sync.Mutex
+var sQuotaUsed = map[string]int64{}
+
+type tQuota struct { // bytes; 0 for no limit
+   AttachMax int64 `json:",omitempty"` // one attachment
+   MsgMax int64 `json:",omitempty"`    // message with attachments
+   StoreMax int64 `json:",omitempty"`  // all service files
+}
+
+type tUsage struct {
+   Total int64 // linked files counted once
+   Quota tQuota
+   Threads []tUsageThread // largest first
+}
+
+type tUsageThread struct {
+   Id string
+   Subject string
+   Size int64 // thread file, with drafts
+   AttachSize int64
+   Attach []tUsageAttach `json:",omitempty"`
+}
+
+type tUsageAttach struct {
+   MsgId string
+   Name string
+   Size int64
+   Shared bool `json:",omitempty"` // stored once for several messages
+}
+
+func validateQuota(iQ *tQuota) error {
+   if iQ.AttachMax < 0 || iQ.MsgMax < 0 || iQ.StoreMax < 0 {
+      return tError("quota limits must be >= 0")
+   }
+   return nil
+}
+
+func _getQuota(iSvc string) tQuota {
+   aQ := GetConfigService(iSvc).Quota
+   if aQ == nil {
+      return tQuota{}
+   }
+   return *aQ
+}
+
+// tQuotaError is a message refused for exceeding a limit
+type tQuotaError struct { error }
+
+func isQuotaError(iErr error) bool { _, ok := iErr.(tQuotaError); return ok }
+
+// checkQuota tests a message against the limits
+func checkQuota(iSvc string, iAttach []tHeader2Attach, iBodyLen int64) error {
+   aQ := _getQuota(iSvc)
+   if aQ == (tQuota{}) {
+      return nil
+   }
+   aTotal := iBodyLen
+   for _, aFile := range iAttach {
+      if aQ.AttachMax > 0 && aFile.Size > aQ.AttachMax {
+         return tQuotaError{tError(fmt.Sprintf("attachment %s exceeds limit of %d bytes", aFile.Name, aQ.AttachMax))}
+      }
+      aTotal += aFile.Size
+   }
+   if aQ.MsgMax > 0 && aTotal > aQ.MsgMax {
+      return tQuotaError{tError(fmt.Sprintf("message exceeds limit of %d bytes", aQ.MsgMax))}
+   }
+   if aQ.StoreMax > 0 {
+      sQuotaDoor.Lock(); defer sQuotaDoor.Unlock()
+      aUsed, aHas := sQuotaUsed[iSvc]
+      if !aHas || aUsed + aTotal > aQ.StoreMax {
+         aUsed = _sizeQuota(iSvc)
+      }
+      if aUsed + aTotal > aQ.StoreMax {
+         sQuotaUsed[iSvc] = aUsed
+         return tQuotaError{tError(fmt.Sprintf("storage exceeds limit of %d bytes", aQ.StoreMax))}
+      }
+      sQuotaUsed[iSvc] = aUsed + aTotal
+   }
+   return nil
+}
+
+// _sizeQuota returns the space used by the service
+func _sizeQuota(iSvc string) int64 {
+   aSeen := map[uint64]bool{}
+   var fWalk func(string) int64
+   fWalk = func(cPath string) int64 {
+      cDir, err := readDirFis(cPath)
+      if err != nil {
+         if os.IsNotExist(err) { return 0 }
+         quit(err)
+      }
+      var cSum int64
+      for _, cFi := range cDir {
+         if cFi.IsDir() {
+            cSum += fWalk(cPath + cFi.Name() +"/")
+            continue
+         }
+         var cIno uint64
+         cIno, err = getInode(cPath, cFi)
+         if err != nil { quit(err) }
+         if aSeen[cIno] { continue }
+         aSeen[cIno] = true
+         cSum += sizeFile(cPath + cFi.Name(), cFi)
+      }
+      return cSum
+   }
+   return fWalk(dirSvc(iSvc))
+}
+
+func GetUsageQuota(iSvc string) interface{} {
+   aUsage := tUsage{Total: _sizeQuota(iSvc), Quota: _getQuota(iSvc), Threads: []tUsageThread{}}
+   sQuotaDoor.Lock()
+   sQuotaUsed[iSvc] = aUsage.Total
+   sQuotaDoor.Unlock()
+   aThreads := map[string]*tUsageThread{}
+   fThread := func(cTid string) *tUsageThread {
+      if aThreads[cTid] == nil {
+         aThreads[cTid] = &tUsageThread{Id: cTid}
+      }
+      return aThreads[cTid]
+   }
+   aDir, err := readDirFis(dirThread(iSvc))
+   if err != nil { quit(err) }
+   for _, aFi := range aDir {
+      aTid := aFi.Name()
+      if aDelim := strings.IndexByte(aTid, '_'); aDelim > 0 { aTid = aTid[:aDelim] } // draft
+      fThread(aTid).Size += sizeFile(dirThread(iSvc) + aFi.Name(), aFi)
+   }
+   aCount := map[string]int{}
+   aSvc := getService(iSvc)
+   aSvc.RLock()
+   for _, aSum := range aSvc.blobRef {
+      aCount[aSum]++
+   }
+   aShared := map[string]bool{}
+   for aRef, aSum := range aSvc.blobRef {
+      aShared[aRef] = aCount[aSum] > 1
+   }
+   aSvc.RUnlock()
+   aDir, err = readDirFis(dirAttach(iSvc))
+   if err != nil { quit(err) }
+   for _, aFi := range aDir {
+      if !aFi.IsDir() || aFi.Name() == "blob" { continue }
+      aTid := aFi.Name()
+      var aSub []os.FileInfo
+      aSub, err = readDirFis(dirAttach(iSvc) + aFi.Name())
+      if err != nil { quit(err) }
+      for _, aAf := range aSub {
+         aFn := aAf.Name()
+         aDelim := strings.IndexByte(aFn, '_')
+         if aDelim < 0 { continue } // ffnindex
+         aThread := fThread(aTid)
+         aSize := sizeFile(dirAttach(iSvc) + aTid +"/"+ aFn, aAf)
+         aThread.AttachSize += aSize
+         aThread.Attach = append(aThread.Attach, tUsageAttach{MsgId: aFn[:aDelim],
+                                 Name: unescapeFile(aFn[aDelim+1:]), Size: aSize,
+                                 Shared: aShared[aTid +"/"+ aFn]})
+      }
+   }
+   for _, aT := range aThreads {
+      if aIdx := getIndexThread(iSvc, aT.Id); len(aIdx) > 0 {
+         aT.Subject = aIdx[0].Subject
+      }
+      sort.Slice(aT.Attach, func(cA, cB int)bool { return aT.Attach[cA].Size > aT.Attach[cB].Size })
+      aUsage.Threads = append(aUsage.Threads, *aT)
+   }
+   sort.Slice(aUsage.Threads, func(cA, cB int)bool {
+      aA, aB := &aUsage.Threads[cA], &aUsage.Threads[cB]
+      if aA.Size + aA.AttachSize != aB.Size + aB.AttachSize {
+         return aA.Size + aA.AttachSize > aB.Size + aB.AttachSize
+      }
+      return aA.Id < aB.Id
+   })
+   return aUsage
+}
@@ -0,0 +1,136 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "fmt"
+   "time"
+)
+
+const kRetainDelay = 5 * time.Minute // after startup
+const kRetainPeriod = 24 * time.Hour
+
+const (
+   eRetainDelete = "delete"
+   eRetainArchive = "archive"
+)
+
+type tRetainEl struct {
+   Tag string `json:",omitempty"` // tag id, or all threads if empty
+   Days int // since thread LastDate
+   Action string // eRetain*
+   ArchiveTag string `json:",omitempty"` // tag id for eRetainArchive
+}
+
+type tRetainItem struct {
+   Id string
+   Subject string
+   LastDate string
+   Action string
+   Rule int // index in tSvcConfig.Retain
+}
+
+// parseRetain validates rules given with tag ids
+func parseRetain(iList []tRetainEl) ([]tRetainEl, error) {
+   aList := make([]tRetainEl, len(iList))
+   for a, aEl := range iList {
+      if aEl.Days < 1 {
+         return nil, tError(fmt.Sprintf("rule %d: days must be > 0", a))
+      }
+      if aEl.Tag != "" && !hasIdTag(aEl.Tag) {
+         return nil, tError(fmt.Sprintf("rule %d: tag not found: %s", a, aEl.Tag))
+      }
+      switch aEl.Action {
+      case eRetainDelete:
+         aEl.ArchiveTag = ""
+      case eRetainArchive:
+         if !hasIdTag(aEl.ArchiveTag) {
+            return nil, tError(fmt.Sprintf("rule %d: archive tag not found: %s", a, aEl.ArchiveTag))
+         }
+         if aEl.ArchiveTag == aEl.Tag {
+            return nil, tError(fmt.Sprintf("rule %d: archive tag same as rule tag", a))
+         }
+      default:
+         return nil, tError(fmt.Sprintf("rule %d: unknown action: %s", a, aEl.Action))
+      }
+      aList[a] = aEl
+   }
+   return aList, nil
+}
+
+func GetRetainPreview(iSvc string) interface{} {
+   return _listRetain(iSvc)
+}
+
+// _listRetain returns the threads affected by the retention rules, once each
+func _listRetain(iSvc string) []tRetainItem {
+   aSvc := getService(iSvc)
+   aSvc.RLock()
+   aRules := aSvc.config.Retain
+   aSvc.RUnlock()
+   aList := []tRetainItem{}
+   aHave := map[string]bool{}
+   aNow := time.Now().UTC()
+   for aN, aRule := range aRules {
+      aBefore := aNow.AddDate(0, 0, -aRule.Days).Format(time.RFC3339)
+      for _, aEl := range listBeforeSearch(iSvc, aRule.Tag, aRule.ArchiveTag, aBefore) {
+         if aHave[aEl.Id] { continue }
+         aHave[aEl.Id] = true
+         aList = append(aList, tRetainItem{Id: aEl.Id, Subject: aEl.Subject, LastDate: aEl.LastDate,
+                                           Action: aRule.Action, Rule: aN})
+      }
+   }
+   return aList
+}
+
+// runRetain applies the retention rules via the thread ops; returns ids of deleted threads
+func runRetain(iSvc string) (aDeleted []string, aChg bool) {
+   aList := _listRetain(iSvc)
+   if len(aList) == 0 {
+      return nil, false
+   }
+   aSvc := getService(iSvc)
+   aSvc.RLock()
+   aRules := aSvc.config.Retain
+   aSvc.RUnlock()
+   for _, aEl := range aList {
+      aUpdt := Update{Op: "thread_delete", Touch: &UpdateTouch{ThreadId: aEl.Id}}
+      if aEl.Action == eRetainArchive {
+         aUpdt = Update{Op: "thread_tag",
+                        Touch: &UpdateTouch{MsgId: aEl.Id, TagId: aRules[aEl.Rule].ArchiveTag, Act: 't'}}
+      }
+      aState := ClientState{id: "runRetain", History: []string{aEl.Id}}
+      aFn, _ := HandleUpdtService(iSvc, &aState, &aUpdt)
+      if aFn != nil {
+         if aErr := aFn(&aState); len(aErr) == 2 && aErr[0] == "_e" {
+            fmt.Printf("runRetain %s: %s %s failed: %s\n", iSvc, aEl.Action, aEl.Id, aErr[1])
+            continue
+         }
+      }
+      fmt.Printf("runRetain %s: %s %s (last %s, rule %d)\n", iSvc, aEl.Action, aEl.Id, aEl.LastDate, aEl.Rule)
+      if aEl.Action == eRetainDelete {
+         aDeleted = append(aDeleted, aEl.Id)
+      }
+   }
+   return aDeleted, true
+}
+
+func initRetain(iSvc string) {
+   time.AfterFunc(kRetainDelay, func() { _runRetain(iSvc) })
+}
+
+func _runRetain(iSvc string) {
+   defer time.AfterFunc(kRetainPeriod, func() { _runRetain(iSvc) })
+   aSvc := getService(iSvc)
+   aSvc.RLock()
+   aHave := len(aSvc.config.Retain) > 0
+   aSvc.RUnlock()
+   if aHave && isLeadNode(iSvc) { // other nodes get the results via sync
+      sMsgToSelfFn(iSvc, &Header{Op:"_retain"})
+   }
+}
@@ -0,0 +1,295 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "bufio"
+   "context"
+   "encoding/binary"
+   "io"
+   "net"
+   "os"
+   "os/exec"
+   "strings"
+   "sync"
+   "time"
+)
+
+// Received attachments & uploads are passed to a Scanner if one is set. Received attachments
+// are scanned in the background, and aren't served until scanned. One which isn't clean is
+// quarantined: it's kept, but not served, and a notice gives the verdict. An upload which
+// isn't clean is dropped.
+
+const (
+   ScanClean = "clean"
+   ScanInfected = "infected"
+   ScanError = "error"
+)
+
+const eScanPending = "pending" // tQuarantineEl.Verdict until scanned
+
+const kScanTimeout = 2 * time.Minute
+const kScanChunk = 64 * 1024
+
+type Scanner interface {
+   Scan(iR io.Reader, iName string) (string, string) // verdict Scan*, detail
+}
+
+var sScanner Scanner // nil for no scanning
+var sScanDoor sync.Mutex // one scan at a time
+
+func SetScanner(i Scanner) { sScanner = i }
+
+type tQuarantine map[string]tQuarantineEl // "tid/file" -> verdict, or eScanPending
+
+type tQuarantineEl struct {
+   Verdict string
+   Detail string `json:",omitempty"`
+   Date string
+}
+
+// NewScanner returns a Scanner given "exec:command args" or "unix:/path/to/socket".
+// A command reads the file on stdin, and exits 0 if clean, or 1 if infected with the reason
+// on stdout. A socket server speaks the clamd INSTREAM protocol.
+func NewScanner(iSpec string) (Scanner, error) {
+   aPair := strings.SplitN(iSpec, ":", 2)
+   if len(aPair) != 2 || aPair[1] == "" {
+      return nil, tError("scanner must be exec:command or unix:path")
+   }
+   switch aPair[0] {
+   case "exec":
+      aArgs := strings.Fields(aPair[1])
+      if len(aArgs) == 0 {
+         return nil, tError("scanner command missing")
+      }
+      return tScanExec(aArgs), nil
+   case "unix":
+      return tScanSocket(aPair[1]), nil
+   }
+   return nil, tError("unknown scanner type "+ aPair[0])
+}
+
+type tScanExec []string
+
+func (o tScanExec) Scan(iR io.Reader, iName string) (string, string) {
+   aCtx, aCancel := context.WithTimeout(context.Background(), kScanTimeout)
+   defer aCancel()
+   aCmd := exec.CommandContext(aCtx, o[0], o[1:]...)
+   aCmd.Stdin = iR
+   aCmd.Env = append(os.Environ(), "MNM_SCAN_NAME="+ iName)
+   aOut, err := aCmd.Output()
+   aLine := strings.TrimSpace(strings.SplitN(string(aOut), "\n", 2)[0])
+   if err == nil {
+      return ScanClean, ""
+   }
+   if aEr, ok := err.(*exec.ExitError); ok && aEr.ExitCode() == 1 {
+      return ScanInfected, aLine
+   }
+   return ScanError, err.Error()
+}
+
+type tScanSocket string
+
+func (o tScanSocket) Scan(iR io.Reader, iName string) (string, string) {
+   aConn, err := net.DialTimeout("unix", string(o), 10 * time.Second)
+   if err != nil {
+      return ScanError, err.Error()
+   }
+   defer aConn.Close()
+   err = aConn.SetDeadline(time.Now().Add(kScanTimeout))
+   if err != nil { quit(err) }
+   aBw := bufio.NewWriterSize(aConn, kScanChunk + 4)
+   _, err = aBw.WriteString("zINSTREAM\x00")
+   aBuf := make([]byte, kScanChunk)
+   aLen := make([]byte, 4)
+   for err == nil {
+      var aN int
+      aN, err = io.ReadFull(iR, aBuf)
+      if aN > 0 {
+         binary.BigEndian.PutUint32(aLen, uint32(aN))
+         aBw.Write(aLen)
+         _, err = aBw.Write(aBuf[:aN])
+      }
+      if err == io.EOF || err == io.ErrUnexpectedEOF {
+         binary.BigEndian.PutUint32(aLen, 0)
+         _, err = aBw.Write(aLen)
+         if err == nil {
+            err = aBw.Flush()
+         }
+         break
+      }
+   }
+   if err != nil {
+      return ScanError, err.Error()
+   }
+   aReply, err := bufio.NewReader(aConn).ReadString(0)
+   if err != nil && err != io.EOF {
+      return ScanError, err.Error()
+   }
+   aReply = strings.TrimPrefix(strings.TrimRight(aReply, "\x00\n"), "stream: ")
+   if aReply == "OK" {
+      return ScanClean, ""
+   }
+   if strings.HasSuffix(aReply, " FOUND") {
+      return ScanInfected, strings.TrimSuffix(aReply, " FOUND")
+   }
+   return ScanError, aReply
+}
+
+// _scanFile runs the scanner on a stored file; returns false if it's gone
+func _scanFile(iPath string, iName string) (string, string, bool) {
+   aFd, err := openFile(iPath)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return "", "", false
+   }
+   defer aFd.Close()
+   sScanDoor.Lock(); defer sScanDoor.Unlock()
+   aVerdict, aDetail := sScanner.Scan(aFd, iName)
+   return aVerdict, aDetail, true
+}
+
+// scanUpload checks a new upload; returns an error if it isn't clean
+func scanUpload(iPath string, iName string) error {
+   if sScanner == nil {
+      return nil
+   }
+   aVerdict, aDetail, _ := _scanFile(iPath, iName)
+   if aVerdict == ScanClean {
+      return nil
+   }
+   aMsg := "rejected by scanner, "+ aVerdict; if aDetail != "" { aMsg += ": "+ aDetail }
+   return tError(aMsg)
+}
+
+// scanAttach marks the stored attachments of a received message as pending, and starts
+// scanning them
+func scanAttach(iSvc string, iSubHead *tHeader2, iRec tComplete) {
+   if sScanner == nil {
+      return
+   }
+   var aRefs []string
+   for _, aFile := range iSubHead.Attach {
+      if _isFormFill(aFile.Name) { continue }
+      aPath := fileAtc(iSvc, iRec.tid(), iRec.mid(), aFile.Name)
+      if _, err := os.Lstat(aPath); err != nil {
+         if !os.IsNotExist(err) { quit(err) }
+         continue
+      }
+      aRefs = append(aRefs, iRec.tid() +"/"+ iRec.mid() +"_"+ escapeFile(aFile.Name))
+   }
+   if len(aRefs) == 0 {
+      return
+   }
+   aSvc := getService(iSvc)
+   aSvc.Lock()
+   for _, aRef := range aRefs {
+      aSvc.quarantine[aRef] = tQuarantineEl{Verdict: eScanPending, Date: dateRFC3339()}
+   }
+   err := storeFile(fileQuarantine(iSvc), aSvc.quarantine)
+   if err != nil { quit(err) }
+   aSvc.Unlock()
+   go _runScanAttach(iSvc, aRefs, iSubHead.Alias, iSubHead.Subject)
+}
+
+// initScan restarts the scans left pending at shutdown
+func initScan(iSvc string) {
+   if sScanner == nil {
+      return
+   }
+   aMsgs := map[string][]string{} // "tid/mid" -> refs
+   aSvc := getService(iSvc)
+   aSvc.RLock()
+   for aRef, aEl := range aSvc.quarantine {
+      if aEl.Verdict != eScanPending { continue }
+      aN := strings.IndexByte(aRef, '/'); aN += strings.IndexByte(aRef[aN:], '_')
+      aMsgs[aRef[:aN]] = append(aMsgs[aRef[:aN]], aRef)
+   }
+   aSvc.RUnlock()
+   for _, aRefs := range aMsgs {
+      go _runScanAttach(iSvc, aRefs, "", "")
+   }
+}
+
+// _runScanAttach scans the attachments of a message, and quarantines any not clean;
+// an attachment deleted meanwhile is skipped
+func _runScanAttach(iSvc string, iRefs []string, iAlias, iSubject string) {
+   aFlag := tQuarantine{}
+   var aReason []string
+   for _, aRef := range iRefs {
+      aName := aRef[strings.IndexByte(aRef, '/')+1:]
+      aName = unescapeFile(aName[strings.IndexByte(aName, '_')+1:])
+      aVerdict, aDetail, aOk := _scanFile(dirAttach(iSvc) + aRef, aName)
+      if !aOk { continue }
+      aFlag[aRef] = tQuarantineEl{Verdict: aVerdict, Detail: aDetail, Date: dateRFC3339()}
+      if aVerdict != ScanClean {
+         aBlurb := aName +" "+ aVerdict; if aDetail != "" { aBlurb += " ("+ aDetail +")" }
+         aReason = append(aReason, aBlurb)
+      }
+   }
+   aTid := iRefs[0][:strings.IndexByte(iRefs[0], '/')]
+   if len(aReason) > 0 {
+      aMid := iRefs[0][len(aTid)+1:]; aMid = aMid[:strings.IndexByte(aMid, '_')]
+      addScanNotice(iSvc, aMid, iAlias, iSubject, strings.Join(aReason, ", "))
+   }
+   aSvc := getService(iSvc)
+   aSvc.Lock()
+   for aRef, aEl := range aFlag {
+      if aSvc.quarantine[aRef].Verdict != eScanPending {
+         continue // dropped
+      }
+      if aEl.Verdict == ScanClean {
+         delete(aSvc.quarantine, aRef)
+      } else {
+         aSvc.quarantine[aRef] = aEl
+      }
+   }
+   err := storeFile(fileQuarantine(iSvc), aSvc.quarantine)
+   if err != nil { quit(err) }
+   aSvc.Unlock()
+   sMsgToSelfFn(iSvc, &Header{Op:"_scan", Id:aTid})
+}
+
+// isQuarantined checks whether an attachment path is quarantined or awaiting a scan
+func isQuarantined(iSvc string, iPath string) bool {
+   aRef := strings.TrimPrefix(iPath, dirAttach(iSvc))
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   _, aHas := aSvc.quarantine[aRef]
+   return aHas
+}
+
+// getQuarantine returns the quarantined attachments of a thread, by file name
+func getQuarantine(iSvc string, iTid string) map[string]tQuarantineEl {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   aList := map[string]tQuarantineEl{}
+   for aRef, aEl := range aSvc.quarantine {
+      if strings.HasPrefix(aRef, iTid +"/") {
+         aList[aRef[len(iTid)+1:]] = aEl
+      }
+   }
+   return aList
+}
+
+// dropQuarantine removes the entries starting with iPrefix
+func dropQuarantine(iSvc string, iPrefix string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   aN := len(aSvc.quarantine)
+   for aRef := range aSvc.quarantine {
+      if strings.HasPrefix(aRef, iPrefix) {
+         delete(aSvc.quarantine, aRef)
+      }
+   }
+   if len(aSvc.quarantine) == aN {
+      return
+   }
+   err := storeFile(fileQuarantine(iSvc), aSvc.quarantine)
+   if err != nil { quit(err) }
+}
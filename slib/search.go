@@ -9,6 +9,7 @@ package slib
 
 import (
    "bytes"
+   "encoding/base64"
    "fmt"
    "io"
    "io/ioutil"
@@ -16,15 +17,44 @@ import (
    "os"
    "sort"
    "strings"
+   "time"
 
    pBkeyword  "github.com/blevesearch/bleve/analysis/analyzer/keyword"
+   pBcustom   "github.com/blevesearch/bleve/analysis/analyzer/custom"
+   pBlower    "github.com/blevesearch/bleve/analysis/token/lowercase"
+   pBunicode  "github.com/blevesearch/bleve/analysis/tokenizer/unicode"
    pBleve     "github.com/blevesearch/bleve"
+   pBmapping  "github.com/blevesearch/bleve/mapping"
    pBquery    "github.com/blevesearch/bleve/search/query"
    pBscorch   "github.com/blevesearch/bleve/index/scorch"
    pBsearch   "github.com/blevesearch/bleve/search"
 )
 
-var kSearchIndexRev = []byte("0.8")
+var kSearchIndexRev = []byte("0.8.3")
+
+const kSearchPage = 200
+
+// sort options for the thread list; a tie is broken by thread id
+var kSearchSort = map[string][]string{
+   "LastDate":  {"-LastDate", "_id"},
+   "OrigDate":  {"-OrigDate", "_id"},
+   "Relevance": {"-_score", "-LastDate", "_id"},
+   "Subject":   {"SubjectKey", "-LastDate", "_id"},
+}
+
+type tSearchPage struct {
+   Total uint64
+   Sort string
+   Next string // cursor for next page, if any
+   Error string `json:",omitempty"` // query no longer valid, e.g. its tag was deleted
+   List []tSearchEl
+}
+
+type tSearchCursor struct {
+   Sort string
+   After []string `json:",omitempty"` // sort keys of last hit
+   From int `json:",omitempty"` // for Relevance, as bleve can't resume after a score
+}
 
 type tSearchEl struct {
    Id string
@@ -35,6 +65,9 @@ type tSearchEl struct {
    OrigDate, LastDate string
    OrigAuthor, LastAuthor string
    Unread bool `json:",omitempty"`
+   Snooze string `json:",omitempty"`
+   Snippet []tSnippet `json:",omitempty"`
+   AttachHit []string `json:",omitempty"` // msgid_name of attachments with matching text
 }
 
 type tSearchDoc struct {
@@ -47,9 +80,14 @@ type tSearchDoc struct {
    OrigAuthor, LastAuthor string
    OrigDate, LastDate string
    LastSubjectN int // ref to Subject item
+   SubjectKey string // for sorting
    Unread bool
+   Attach bool
+   AttachRef tStrings // msgid_name for each AttachText item
+   AttachText []string
    Body string
    bodyStream io.Reader
+   uid string // of service, to find filled forms
 }
 
 func (*tSearchDoc) Type() string { return "thread" }
@@ -71,7 +109,8 @@ type tIndexer interface {
 
 var kResultFields = []string{"*"} //todo list fields?
 
-func WriteResultSearch(iW io.Writer, iSvc string, iState *ClientState) error {
+// WriteResultSearch writes a page of the thread list for the current tab, following iCursor if given
+func WriteResultSearch(iW io.Writer, iSvc string, iState *ClientState, iCursor string) error {
    var err error
    aTabType, aTabVal := iState.getSvcTab()
    if aTabType == ePosForTerms && strings.HasPrefix(aTabVal, "ffn:") {
@@ -88,8 +127,9 @@ func WriteResultSearch(iW io.Writer, iSvc string, iState *ClientState) error {
       return err
    }
    var aQ pBquery.Query
+   var aQerr error
    if aTabType != ePosForDefault || aTabVal[0] == '#' {
-      aQ = _makeWordsQuery(aTabVal)
+      aQ, aQerr = makeQuerySearch(aTabVal) // tab_add checks it, but a tag may be deleted since
    } else if aTabVal == "All" {
       aQ = pBleve.NewMatchAllQuery()
    } else if aTabVal == "Unread" {
@@ -97,16 +137,55 @@ func WriteResultSearch(iW io.Writer, iSvc string, iState *ClientState) error {
       aQb.SetField("Unread")
       aQ = aQb
    }
+   if aTabType == ePosForDefault && (aTabVal == "All" || aTabVal == "Unread") {
+      if aSnoozed := getListSnooze(iSvc); len(aSnoozed) > 0 {
+         aQb := pBleve.NewBooleanQuery()
+         aQb.AddMust(aQ)
+         aQb.AddMustNot(pBleve.NewDocIDQuery(aSnoozed))
+         aQ = aQb
+      }
+   }
+   aPage := tSearchPage{Sort: iState.getListSort(), List: []tSearchEl{}}
+   var aCur tSearchCursor
+   if iCursor != "" {
+      aBuf, err := base64.RawURLEncoding.DecodeString(iCursor)
+      if err == nil {
+         err = json.Unmarshal(aBuf, &aCur)
+      }
+      if err != nil || aCur.Sort != aPage.Sort {
+         return tError("invalid or stale cursor")
+      }
+   }
    if aQ == nil {
-      _, err = iW.Write([]byte{'[',']'})
-      return err
+      if aQerr != nil {
+         aPage.Error = aQerr.Error()
+      }
+      return json.NewEncoder(iW).Encode(aPage)
    }
    aBi := getService(iSvc).index
-   aSr := pBleve.NewSearchRequestOptions(aQ, 1024, 0, false)
+   aSr := pBleve.NewSearchRequestOptions(aQ, kSearchPage + 1, aCur.From, false) // +1 to detect next page
    aSr.Fields = kResultFields
+   aSr.SortBy(kSearchSort[aPage.Sort])
+   aSr.IncludeLocations = aTabType != ePosForDefault
+   if aCur.After != nil {
+      aSr.SearchAfter = aCur.After
+   }
    aSet, err := aBi.Search(aSr)
    if err != nil { quit(err) }
-   aList := make([]tSearchEl, 0, len(aSet.Hits))
+   aPage.Total = aSet.Total
+   if len(aSet.Hits) > kSearchPage {
+      aSet.Hits = aSet.Hits[:kSearchPage]
+      aNext := tSearchCursor{Sort: aPage.Sort}
+      if aPage.Sort == "Relevance" {
+         aNext.From = aCur.From + kSearchPage
+      } else {
+         aNext.After = aSet.Hits[len(aSet.Hits)-1].Sort
+      }
+      aBuf, err := json.Marshal(aNext)
+      if err != nil { quit(err) }
+      aPage.Next = base64.RawURLEncoding.EncodeToString(aBuf)
+   }
+   aList := aPage.List
    for _, aHit := range aSet.Hits {
       aSubject := _i2slice(aHit.Fields["Subject"])
       //aAuthor  := _i2slice(aHit.Fields["Author"])
@@ -123,13 +202,18 @@ func WriteResultSearch(iW io.Writer, iSvc string, iState *ClientState) error {
                                       LastDate:   aHit.Fields["LastDate"].(string),
                                       OrigAuthor: aHit.Fields["OrigAuthor"].(string),
                                       LastAuthor: aHit.Fields["LastAuthor"].(string),
-                                      Unread:     aHit.Fields["Unread"].(bool)})
+                                      Unread:     aHit.Fields["Unread"].(bool),
+                                      Snooze:     getSnooze(iSvc, aHit.ID)})
       if aLastSubjectN != 0 {
          aList[len(aList)-1].SubjectWas = aSubject[0].(string)
       }
+      if aSites := _sitesSearch(aHit.Locations["Body"]); len(aSites) > 0 {
+         aList[len(aList)-1].Snippet = snippetThread(iSvc, aHit.ID, aSites)
+      }
+      aList[len(aList)-1].AttachHit = _attachHitSearch(aHit)
    }
-   sort.Slice(aList, func(cA, cB int) bool { return aList[cA].LastDate > aList[cB].LastDate })
-   err = json.NewEncoder(iW).Encode(aList)
+   aPage.List = aList
+   err = json.NewEncoder(iW).Encode(aPage)
    return err
 }
 
@@ -187,6 +271,273 @@ func _makeWordsQuery(iWords string) pBquery.Query {
    return pBquery.NewBooleanQuery(aMust, aShld, aNot)
 }
 
+// Query syntax, used when a search has field prefixes, quotes, parentheses, or OR/AND/NOT;
+// otherwise _makeWordsQuery applies. Terms are ANDed unless joined by OR; -term or NOT term
+// excludes. Fields: from: to: subject: attach: tag: before: after: (YYYY[-MM[-DD]], compared with
+// the last message) is:unread|read has:attachment. A "quoted phrase" matches words in sequence.
+
+var kQueryField = map[string]bool{"from":true, "to":true, "subject":true, "attach":true, "tag":true,
+                                  "before":true, "after":true, "is":true, "has":true}
+
+type tQueryParse struct {
+   tok []string
+   a int
+}
+
+// makeQuerySearch returns the query for a search term, or an error if it's malformed
+func makeQuerySearch(iText string) (pBquery.Query, error) {
+   if !_isQuerySearch(iText) {
+      return _makeWordsQuery(iText), nil
+   }
+   aP := &tQueryParse{tok: _tokenQuerySearch(iText)}
+   if len(aP.tok) == 0 {
+      return nil, tError("query: empty")
+   }
+   aQ, err := aP.and()
+   if err != nil {
+      return nil, err
+   }
+   if aP.a < len(aP.tok) {
+      return nil, tError("query: unexpected "+ aP.tok[aP.a])
+   }
+   return aQ, nil
+}
+
+func _isQuerySearch(iText string) bool {
+   if strings.ContainsAny(iText, `()"`) {
+      return true
+   }
+   for _, aW := range strings.Fields(iText) {
+      if aW == "OR" || aW == "AND" || aW == "NOT" {
+         return true
+      }
+      if aC := strings.IndexByte(aW, ':'); aC > 0 && kQueryField[strings.TrimLeft(aW[:aC], "+-")] {
+         return true
+      }
+   }
+   return false
+}
+
+// _tokenQuerySearch splits a query into (, ), -, quoted phrases, field:value, and words
+func _tokenQuerySearch(iText string) []string {
+   var aList []string
+   for a := 0; a < len(iText); {
+      switch iText[a] {
+      case ' ', '\t', '\n', '\r':
+         a++
+      case '(', ')', '-', '+':
+         aList = append(aList, iText[a:a+1])
+         a++
+      default:
+         aEnd := a
+         for aEnd < len(iText) && !strings.ContainsRune(" \t\n\r()", rune(iText[aEnd])) {
+            if iText[aEnd] == '"' { // through closing quote
+               aQ := strings.IndexByte(iText[aEnd+1:], '"')
+               if aQ < 0 { aEnd = len(iText); break }
+               aEnd += aQ + 1
+            }
+            aEnd++
+         }
+         aList = append(aList, iText[a:aEnd])
+         a = aEnd
+      }
+   }
+   return aList
+}
+
+func (o *tQueryParse) peek() string {
+   if o.a < len(o.tok) { return o.tok[o.a] }
+   return ""
+}
+
+// and parses a sequence of terms up to ) or end
+func (o *tQueryParse) and() (pBquery.Query, error) {
+   var aMust, aNot []pBquery.Query
+   for o.a < len(o.tok) && o.peek() != ")" {
+      if o.peek() == "AND" {
+         o.a++
+         continue
+      }
+      aQ, aNeg, err := o.or()
+      if err != nil {
+         return nil, err
+      }
+      if aNeg {
+         aNot = append(aNot, aQ)
+      } else {
+         aMust = append(aMust, aQ)
+      }
+   }
+   if len(aMust) == 0 && len(aNot) == 0 {
+      return nil, tError("query: missing term")
+   }
+   if len(aNot) == 0 && len(aMust) == 1 {
+      return aMust[0], nil
+   }
+   if len(aMust) == 0 {
+      aMust = []pBquery.Query{pBleve.NewMatchAllQuery()}
+   }
+   return pBquery.NewBooleanQuery(aMust, nil, aNot), nil
+}
+
+// or parses terms joined by OR; returns true if a single term is negated
+func (o *tQueryParse) or() (pBquery.Query, bool, error) {
+   aQ, aNeg, err := o.unary()
+   if err != nil || o.peek() != "OR" {
+      return aQ, aNeg, err
+   }
+   aList := []pBquery.Query{_notQuerySearch(aQ, aNeg)}
+   for o.peek() == "OR" {
+      o.a++
+      aQ, aNeg, err = o.unary()
+      if err != nil {
+         return nil, false, err
+      }
+      aList = append(aList, _notQuerySearch(aQ, aNeg))
+   }
+   return pBquery.NewDisjunctionQuery(aList), false, nil
+}
+
+func _notQuerySearch(iQ pBquery.Query, iNeg bool) pBquery.Query {
+   if !iNeg {
+      return iQ
+   }
+   return pBquery.NewBooleanQuery([]pBquery.Query{pBleve.NewMatchAllQuery()}, nil, []pBquery.Query{iQ})
+}
+
+func (o *tQueryParse) unary() (pBquery.Query, bool, error) {
+   aNeg := false
+   for o.peek() == "-" || o.peek() == "+" || o.peek() == "NOT" {
+      aNeg = aNeg != (o.peek() != "+")
+      o.a++
+   }
+   aTok := o.peek()
+   switch aTok {
+   case "":
+      return nil, false, tError("query: missing term at end")
+   case ")", "OR", "AND":
+      return nil, false, tError("query: unexpected "+ aTok)
+   case "(":
+      o.a++
+      aQ, err := o.and()
+      if err != nil {
+         return nil, false, err
+      }
+      if o.peek() != ")" {
+         return nil, false, tError("query: missing )")
+      }
+      o.a++
+      return aQ, aNeg, nil
+   }
+   o.a++
+   aQ, err := _termQuerySearch(aTok)
+   return aQ, aNeg, err
+}
+
+func _termQuerySearch(iTok string) (pBquery.Query, error) {
+   aField, aVal := "", iTok
+   if aC := strings.IndexByte(iTok, ':'); aC > 0 && kQueryField[iTok[:aC]] {
+      aField, aVal = iTok[:aC], iTok[aC+1:]
+   }
+   aPhrase := len(aVal) >= 2 && aVal[0] == '"' && aVal[len(aVal)-1] == '"'
+   if aPhrase {
+      aVal = aVal[1:len(aVal)-1]
+   } else if strings.IndexByte(aVal, '"') >= 0 {
+      return nil, tError("query: unmatched quote in "+ iTok)
+   }
+   if strings.TrimSpace(aVal) == "" {
+      return nil, tError("query: missing value for "+ iTok)
+   }
+   aMatch := func(cField string) pBquery.Query {
+      if aPhrase {
+         cQ := pBleve.NewMatchPhraseQuery(aVal); cQ.SetField(cField)
+         return cQ
+      }
+      cQ := pBleve.NewMatchQuery(aVal); cQ.SetField(cField)
+      return cQ
+   }
+   switch aField {
+   case "":
+      if aVal[0] == '#' && len(aVal) > 1 && !aPhrase {
+         return _termQuerySearch("tag:"+ aVal[1:])
+      }
+      return aMatch(""), nil
+   case "from":
+      return pBleve.NewDisjunctionQuery(aMatch("Author"), aMatch("OrigAuthor"), aMatch("LastAuthor")), nil
+   case "to":
+      return aMatch("OrigCc"), nil
+   case "subject":
+      return aMatch("Subject"), nil
+   case "attach":
+      return aMatch("AttachText"), nil
+   case "tag":
+      aTag := GetIdTag(aVal)
+      if aTag == "" {
+         return nil, tError("query: tag not found: "+ aVal)
+      }
+      return pBquery.NewPhraseQuery([]string{aTag}, "Tag"), nil
+   case "before", "after":
+      aOk := false
+      for _, aForm := range [...]string{"2006-01-02", "2006-01", "2006"} {
+         if _, err := time.Parse(aForm, aVal); err == nil { aOk = true; break }
+      }
+      if !aOk {
+         return nil, tError("query: date must be YYYY[-MM[-DD]] in "+ iTok)
+      }
+      // dates are RFC3339, so a date prefix sorts before every time on that date;
+      // both fields compare the thread's latest message
+      aMin, aMax := aVal, ""
+      if aField == "before" {
+         aMin, aMax = "", aVal
+      }
+      aQ := pBleve.NewTermRangeQuery(aMin, aMax); aQ.SetField("LastDate")
+      return aQ, nil
+   case "is":
+      if aVal != "unread" && aVal != "read" {
+         return nil, tError("query: is: takes unread or read")
+      }
+      aQ := pBleve.NewBoolFieldQuery(aVal == "unread"); aQ.SetField("Unread")
+      return aQ, nil
+   case "has":
+      if aVal != "attachment" && aVal != "attach" {
+         return nil, tError("query: has: takes attachment")
+      }
+      aQ := pBleve.NewBoolFieldQuery(true); aQ.SetField("Attach")
+      return aQ, nil
+   }
+   quit(tError("_termQuerySearch: unknown field "+ aField))
+   return nil, nil
+}
+
+// _attachHitSearch returns the attachments whose text matched
+func _attachHitSearch(iHit *pBsearch.DocumentMatch) []string {
+   aRef := _i2slice(iHit.Fields["AttachRef"])
+   var aList []string
+   aHas := map[uint64]bool{}
+   for _, aLocs := range iHit.Locations["AttachText"] {
+      for _, aLoc := range aLocs {
+         aN := uint64(0); if len(aLoc.ArrayPositions) > 0 { aN = aLoc.ArrayPositions[0] }
+         if aHas[aN] || aN >= uint64(len(aRef)) { continue }
+         aHas[aN] = true
+         aList = append(aList, aRef[aN].(string))
+      }
+   }
+   sort.Strings(aList)
+   return aList
+}
+
+// _sitesSearch returns the sorted [start, end) offsets of term matches
+func _sitesSearch(iMap pBsearch.TermLocationMap) [][2]int64 {
+   var aSites [][2]int64
+   for _, aLocs := range iMap {
+      for _, aLoc := range aLocs {
+         aSites = append(aSites, [2]int64{int64(aLoc.Start), int64(aLoc.End)})
+      }
+   }
+   sort.Slice(aSites, func(cA, cB int) bool { return aSites[cA][0] < aSites[cB][0] })
+   return aSites
+}
+
 func _i2slice(i interface{}) []interface{} { // bleve stores string for input []string{s}
    switch aV := i.(type) {
    case []interface{}: return aV
@@ -205,6 +556,43 @@ func countUnreadSearch(iSvc string) int {
    return int(aSet.Total)
 }
 
+// listBeforeSearch returns threads with LastDate before iBefore,
+// optionally limited to tag iTagId and excluding tag iNotTagId
+func listBeforeSearch(iSvc string, iTagId, iNotTagId string, iBefore string) []tSearchEl {
+   aQd := pBleve.NewTermRangeQuery("", iBefore); aQd.SetField("LastDate")
+   aQb := pBleve.NewBooleanQuery()
+   aQb.AddMust(aQd)
+   if iTagId != "" {
+      aQb.AddMust(pBquery.NewPhraseQuery([]string{iTagId}, "Tag"))
+   }
+   if iNotTagId != "" {
+      aQb.AddMustNot(pBquery.NewPhraseQuery([]string{iNotTagId}, "Tag"))
+   }
+   aBi := getService(iSvc).index
+   aList := []tSearchEl{}
+   for aFrom := 0; true; aFrom += 1024 {
+      aSr := pBleve.NewSearchRequestOptions(aQb, 1024, aFrom, false)
+      aSr.Fields = []string{"Subject", "LastSubjectN", "LastDate"}
+      aSet, err := aBi.Search(aSr)
+      if err != nil { quit(err) }
+      for _, aHit := range aSet.Hits {
+         aLastDate, _ := aHit.Fields["LastDate"].(string)
+         if aHit.ID[0] == '_' || aLastDate == "" {
+            continue
+         }
+         aSubject := _i2slice(aHit.Fields["Subject"])
+         aLastSubjectN := int(aHit.Fields["LastSubjectN"].(float64))
+         aList = append(aList, tSearchEl{Id: aHit.ID, LastDate: aLastDate,
+                                         Subject: aSubject[aLastSubjectN].(string)})
+      }
+      if len(aSet.Hits) < 1024 {
+         break
+      }
+   }
+   sort.Slice(aList, func(cA, cB int) bool { return aList[cA].LastDate < aList[cB].LastDate })
+   return aList
+}
+
 type tTermSites pBsearch.TermLocationMap
 
 var kTermSitesEmpty = tTermSites{}
@@ -212,8 +600,15 @@ var kResultFieldsMsg = []string{"Body"}
 
 func messageSearch(iSvc string, iTid string, iTerm string) tTermSites {
    aBi := getService(iSvc).index
-   aQ := pBleve.NewConjunctionQuery(pBleve.NewDocIDQuery([]string{iTid}),
-                                    pBleve.NewMatchPhraseQuery(iTerm))
+   var aQt pBquery.Query = pBleve.NewMatchPhraseQuery(iTerm)
+   if _isQuerySearch(iTerm) {
+      var err error
+      aQt, err = makeQuerySearch(iTerm)
+      if err != nil {
+         return kTermSitesEmpty
+      }
+   }
+   aQ := pBleve.NewConjunctionQuery(pBleve.NewDocIDQuery([]string{iTid}), aQt)
    aSr := pBleve.NewSearchRequest(aQ)
    aSr.Fields = kResultFieldsMsg
    aSet, err := aBi.Search(aSr)
@@ -240,17 +635,57 @@ func (o tTermSites) hasTermBefore(iPos int64) bool {
 }
 
 func indexThreadSearch(iSvc string, iDoc *tSearchDoc, iI tIndexer) {
-   if iI == nil {
+   aLive := iI == nil
+   if aLive {
       iI = getService(iSvc).index.(tIndexer)
    }
    var err error
    aData, err := ioutil.ReadAll(iDoc.bodyStream)
    if err != nil { quit(err) }
    iDoc.Body = string(aData)
+   if aTs, _ := iDoc.bodyStream.(*tThreadStream); aTs != nil {
+      iDoc.Attach = aTs.attach
+      _addAttachSearch(iSvc, iDoc, aTs.atc, aLive)
+   }
    err = iI.Index(iDoc.id, iDoc)
    if err != nil { quit(err) }
 }
 
+// _addAttachSearch adds the text of attachments to a document.
+// iLive is false on reindex, when the service may not be open.
+func _addAttachSearch(iSvc string, iDoc *tSearchDoc, iAtc []tStreamAtc, iLive bool) {
+   if len(iAtc) == 0 {
+      return
+   }
+   var aQuar tQuarantine
+   if !iLive {
+      err := readJsonFile(&aQuar, fileQuarantine(iSvc))
+      if err != nil && !os.IsNotExist(err) { quit(err) }
+   }
+   for _, aAtc := range iAtc {
+      aName := aAtc.file.Name
+      aCache := fileExtract(iSvc, iDoc.id, aAtc.msgId, aName)
+      var aText string
+      if _isFormFill(aName) {
+         aSuffix := kSuffixRecv; if aAtc.from == iDoc.uid { aSuffix = kSuffixSent }
+         aText = getFormExtract(iSvc, aAtc.file.Ffn + aSuffix, aAtc.msgId, aName, aCache, iLive)
+      } else {
+         aPath := fileAtc(iSvc, iDoc.id, aAtc.msgId, aName)
+         if iLive && isQuarantined(iSvc, aPath) {
+            continue
+         } else if _, aHas := aQuar[iDoc.id +"/"+ aAtc.msgId +"_"+ escapeFile(aName)]; aHas {
+            continue
+         }
+         aText = getTextExtract(aPath, aCache, aName)
+      }
+      if aText == "" {
+         continue
+      }
+      iDoc.AttachRef = append(iDoc.AttachRef, aAtc.msgId +"_"+ aName)
+      iDoc.AttachText = append(iDoc.AttachText, aText)
+   }
+}
+
 func updateUnreadSearch(iSvc string, iTid string, iUnread bool) {
    //todo store status with SetInternal()?
 }
@@ -266,6 +701,14 @@ func openIndexSearch(iCfg *tSvcConfig) pBleve.Index {
    aTemp := aPath + ".tmp"
    err := os.RemoveAll(aTemp)
    if err != nil && !os.IsNotExist(err) { quit(err) }
+   if len(sCryptKeys) > 0 { // bleve files can't be encrypted, so rebuild index in memory
+      err = os.RemoveAll(aPath)
+      if err != nil { quit(err) }
+      aBi, err := pBleve.NewMemOnly(_mappingSearch())
+      if err != nil { quit(err) }
+      _reindex(iCfg, aBi)
+      return aBi
+   }
    aBi, err := pBleve.Open(aPath)
    if err == nil {
       var aRev []byte
@@ -282,18 +725,41 @@ func openIndexSearch(iCfg *tSvcConfig) pBleve.Index {
    }
    if err != pBleve.ErrorIndexPathDoesNotExist { quit(err) }
    pBleve.Config.DefaultIndexType = pBscorch.Name
+   aBi, err = pBleve.New(aTemp, _mappingSearch())
+   if err != nil { quit(err) }
+   _reindex(iCfg, aBi)
+   err = aBi.Close()
+   if err != nil { quit(err) }
+   err = syncDir(aTemp) // in case bleve doesn't do so
+   if err != nil { quit(err) }
+   err = os.Rename(aTemp, aPath)
+   if err != nil { quit(err) }
+   aBi, err = pBleve.Open(aPath)
+   if err != nil { quit(err) }
+   return aBi
+}
+
+func _mappingSearch() *pBmapping.IndexMappingImpl {
    aIm := pBleve.NewIndexMapping()
    aIm.TypeField = "type"
    aIm.DefaultAnalyzer = "en"
+   err := aIm.AddCustomAnalyzer("alias", map[string]interface{}{
+      "type": pBcustom.Name, "tokenizer": pBunicode.Name, "token_filters": []string{pBlower.Name},
+   })
+   if err != nil { quit(err) }
 
    aFtext := pBleve.NewTextFieldMapping()
+   aAtext := pBleve.NewTextFieldMapping() // aliases, without stemming or stop words
+   aAtext.Analyzer = "alias"
    aBtext := pBleve.NewTextFieldMapping()
    aBtext.Store = false
-   aNtext := pBleve.NewTextFieldMapping()
-   aNtext.Index = false
    aKtext := pBleve.NewTextFieldMapping()
    aKtext.Analyzer = pBkeyword.Name
    aKtext.Store = false
+   aNtext := pBleve.NewTextFieldMapping()
+   aNtext.Index = false
+   aKstore := pBleve.NewTextFieldMapping()
+   aKstore.Analyzer = pBkeyword.Name
    aNnumr := pBleve.NewNumericFieldMapping()
    aNnumr.Index = false
    aFbool := pBleve.NewBooleanFieldMapping()
@@ -301,30 +767,22 @@ func openIndexSearch(iCfg *tSvcConfig) pBleve.Index {
    aThread := pBleve.NewDocumentMapping()
    aThread.AddFieldMappingsAt("Count", aNnumr)
    aThread.AddFieldMappingsAt("Subject", aFtext)
-   aThread.AddFieldMappingsAt("Author", aFtext)
+   aThread.AddFieldMappingsAt("Author", aAtext)
    aThread.AddFieldMappingsAt("Tag", aKtext)
-   aThread.AddFieldMappingsAt("OrigCc", aNtext)
-   aThread.AddFieldMappingsAt("OrigDate", aNtext)
-   aThread.AddFieldMappingsAt("LastDate", aNtext)
-   aThread.AddFieldMappingsAt("OrigAuthor", aNtext)
-   aThread.AddFieldMappingsAt("LastAuthor", aNtext)
+   aThread.AddFieldMappingsAt("OrigCc", aAtext)
+   aThread.AddFieldMappingsAt("OrigDate", aKstore)
+   aThread.AddFieldMappingsAt("LastDate", aKstore)
+   aThread.AddFieldMappingsAt("OrigAuthor", aAtext)
+   aThread.AddFieldMappingsAt("LastAuthor", aAtext)
    aThread.AddFieldMappingsAt("LastSubjectN", aNnumr)
+   aThread.AddFieldMappingsAt("SubjectKey", aKtext)
    aThread.AddFieldMappingsAt("Unread", aFbool)
+   aThread.AddFieldMappingsAt("Attach", aFbool)
+   aThread.AddFieldMappingsAt("AttachRef", aNtext)
+   aThread.AddFieldMappingsAt("AttachText", aBtext)
    aThread.AddFieldMappingsAt("Body", aBtext)
    aIm.AddDocumentMapping("thread", aThread)
-
-   aBi, err = pBleve.New(aTemp, aIm)
-   if err != nil { quit(err) }
-   _reindex(iCfg, aBi)
-   err = aBi.Close()
-   if err != nil { quit(err) }
-   err = syncDir(aTemp) // in case bleve doesn't do so
-   if err != nil { quit(err) }
-   err = os.Rename(aTemp, aPath)
-   if err != nil { quit(err) }
-   aBi, err = pBleve.Open(aPath)
-   if err != nil { quit(err) }
-   return aBi
+   return aIm
 }
 
 func _reindex(iCfg *tSvcConfig, iBi pBleve.Index) {
@@ -336,8 +794,8 @@ func _reindex(iCfg *tSvcConfig, iBi pBleve.Index) {
    }
    for _, aFn := range aDir {
       if strings.ContainsRune(aFn[1:], '_') || strings.HasSuffix(aFn, ".bak") { continue }
-      var aFd *os.File
-      aFd, err = os.Open(dirThread(iCfg.Name) + aFn)
+      var aFd *tFile
+      aFd, err = openFile(dirThread(iCfg.Name) + aFn)
       if err != nil { quit(err) }
       _updateSearchDoc(iCfg.Name, iCfg, aFn, aFd, aTx)
       aFd.Close()
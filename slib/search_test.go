@@ -0,0 +1,103 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "reflect"
+   "strings"
+   "testing"
+
+   pBquery "github.com/blevesearch/bleve/search/query"
+)
+
+func TestIsQuerySearch(i *testing.T) {
+   for _, aEl := range []struct { text string; want bool }{
+      {"budget plan", false},
+      {"+budget -plan", false},
+      {"#Todo", false},
+      {"note: later", false},
+      {"from:bob", true},
+      {"-tag:Todo", true},
+      {`"budget plan"`, true},
+      {"(a b)", true},
+      {"a OR b", true},
+      {"a or b", false},
+      {"NOT a", true},
+   } {
+      if aHas := _isQuerySearch(aEl.text); aHas != aEl.want {
+         i.Errorf("_isQuerySearch(%q) = %v", aEl.text, aHas)
+      }
+   }
+}
+
+func TestTokenQuerySearch(i *testing.T) {
+   for _, aEl := range []struct { text string; want []string }{
+      {"from:bob  after:2019", []string{"from:bob", "after:2019"}},
+      {`(subject:"budget plan" OR tag:Todo)`,
+       []string{"(", `subject:"budget plan"`, "OR", "tag:Todo", ")"}},
+      {"-is:read +word", []string{"-", "is:read", "+", "word"}},
+      {`"open quote`, []string{`"open quote`}},
+      {"a\tb\n", []string{"a", "b"}},
+   } {
+      if aList := _tokenQuerySearch(aEl.text); !reflect.DeepEqual(aList, aEl.want) {
+         i.Errorf("_tokenQuerySearch(%q) = %q", aEl.text, aList)
+      }
+   }
+}
+
+func TestMakeQuerySearch(i *testing.T) {
+   for _, aText := range []string{
+      "budget plan",
+      "from:bob",
+      `from:bob (subject:"budget plan" OR tag:Todo) -is:read after:2019`,
+      "#Todo before:2019-05-01",
+      "a AND NOT b",
+      "has:attachment OR attach:invoice",
+      "-(is:unread after:2019-05)",
+   } {
+      aQ, err := makeQuerySearch(aText)
+      if err != nil || aQ == nil {
+         i.Errorf("makeQuerySearch(%q) failed: %v", aText, err)
+      }
+   }
+   for _, aEl := range []struct { text, want string }{
+      {"()", "missing term"},
+      {"(from:bob", "missing )"},
+      {"from:bob)", "unexpected )"},
+      {"a OR", "missing term at end"},
+      {"OR a", "unexpected OR"},
+      {`subject:"budget`, "unmatched quote"},
+      {"from:", "missing value"},
+      {"tag:NoSuchTag", "tag not found"},
+      {"before:May", "date must be"},
+      {"after:2019-13", "date must be"},
+      {"is:new", "is: takes"},
+      {"has:link", "has: takes"},
+   } {
+      _, err := makeQuerySearch(aEl.text)
+      if err == nil || !strings.Contains(err.Error(), aEl.want) {
+         i.Errorf("makeQuerySearch(%q) error = %v, want %q", aEl.text, err, aEl.want)
+      }
+   }
+}
+
+func TestDateQuerySearch(i *testing.T) {
+   for _, aEl := range []struct { text, min, max string }{
+      {"before:2019-05", "", "2019-05"},
+      {"after:2019-05-01", "2019-05-01", ""},
+   } {
+      aQ, err := makeQuerySearch(aEl.text)
+      if err != nil {
+         i.Fatalf("makeQuerySearch(%q) failed: %v", aEl.text, err)
+      }
+      aQr, _ := aQ.(*pBquery.TermRangeQuery)
+      if aQr == nil || aQr.FieldVal != "LastDate" || aQr.Min != aEl.min || aQr.Max != aEl.max {
+         i.Errorf("makeQuerySearch(%q) = %+v", aEl.text, aQ)
+      }
+   }
+}
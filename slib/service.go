@@ -40,6 +40,11 @@ type tSvcConfig struct {
    Uid string
    Node string `json:",omitempty"`
    NodeSet []tNode
+   Receipts string `json:",omitempty"` // eReceipt*
+   Retain []tRetainEl `json:",omitempty"`
+   E2e bool `json:",omitempty"` // encrypt messages end-to-end
+   Sign bool `json:",omitempty"` // sign sent messages
+   Quota *tQuota `json:",omitempty"` // size limits
    Error string `json:",omitempty"` // from "registered" message
 }
 
@@ -71,7 +76,25 @@ func initServices(iSs func(string), iMts func(string, *Header)) {
       //makeTreeService(aSvc) // for development, update tree
       err = os.Symlink("empty", fileTag(aSvc)) //todo drop in 0.8
       if err != nil && !os.IsExist(err) { quit(err) }
+      err = os.Symlink("empty", fileSchedq(aSvc)) //todo drop in 0.9
+      if err != nil && !os.IsExist(err) { quit(err) }
+      err = os.Symlink("empty", fileTomb(aSvc)) //todo drop in 0.9
+      if err != nil && !os.IsExist(err) { quit(err) }
+      err = os.Symlink("empty", fileDlv(aSvc)) //todo drop in 0.9
+      if err != nil && !os.IsExist(err) { quit(err) }
+      err = os.Symlink("empty", fileSnooze(aSvc)) //todo drop in 0.9
+      if err != nil && !os.IsExist(err) { quit(err) }
+      err = os.Symlink("empty", fileE2ePeer(aSvc)) //todo drop in 0.9
+      if err != nil && !os.IsExist(err) { quit(err) }
+      err = os.Symlink("empty", fileSignPeer(aSvc)) //todo drop in 0.9
+      if err != nil && !os.IsExist(err) { quit(err) }
+      err = os.Symlink("empty", fileAccept(aSvc)) //todo drop in 0.9
+      if err != nil && !os.IsExist(err) { quit(err) }
+      err = os.Symlink("empty", fileQuarantine(aSvc)) //todo drop in 0.9
+      if err != nil && !os.IsExist(err) { quit(err) }
+      initBlobAttach(aSvc)
       sServices[aSvc] = _openService(aSvc)
+      sweepBlobAttach(aSvc)
       initSyncNode(aSvc)
       var aTmps []string
       aTmps, err = readDirNames(dirTemp(aSvc))
@@ -106,19 +129,32 @@ func initServices(iSs func(string), iMts func(string, *Header)) {
             completeThread(aSvc, aTmp)
          }
       }
+      initSchedQueue(aSvc)
+      initScan(aSvc)
+      initRetain(aSvc)
+      initSnooze(aSvc)
    }
 }
 
 func _openService(iSvc string) *tService {
    aService := _newService(nil)
    aSvcFiles := [...]struct { name string; cache interface{}; reqd bool }{
-      {fileCfg  (iSvc), &aService.config, true },
-      {fileSendq(iSvc), &aService.sendQ,  false},
-      {fileTab  (iSvc), &aService.tabs,   false},
-      {fileNotc (iSvc), &aService.notice, false},
-      {filePing (iSvc), nil,              false},
-      {fileOhi  (iSvc), nil,              false},
-      {fileTag  (iSvc), &tTagset{},       false}, // last for initTag()
+      {fileCfg   (iSvc), &aService.config,    true },
+      {fileSendq (iSvc), &aService.sendQ,     false},
+      {fileSchedq(iSvc), &aService.schedQ,    false},
+      {fileTomb  (iSvc), &aService.tombstone, false},
+      {fileDlv   (iSvc), &aService.delivery,  false},
+      {fileSnooze(iSvc), &aService.snooze,    false},
+      {fileE2ePeer(iSvc), &aService.e2ePeer,  false},
+      {fileSignPeer(iSvc), &aService.signPeer, false},
+      {fileAccept(iSvc), &aService.accept,    false},
+      {fileBlobRef(iSvc), &aService.blobRef,  false},
+      {fileQuarantine(iSvc), &aService.quarantine, false},
+      {fileTab   (iSvc), &aService.tabs,      false},
+      {fileNotc  (iSvc), &aService.notice,    false},
+      {filePing  (iSvc), nil,                 false},
+      {fileOhi   (iSvc), nil,                 false},
+      {fileTag   (iSvc), &tTagset{},          false}, // last for initTag()
    }
    for a := range aSvcFiles {
       err := resolveTmpFile(aSvcFiles[a].name + ".tmp")
@@ -267,6 +303,19 @@ func _findNode(iSvc string, iName string) *tNode {
    return nil
 }
 
+// isLeadNode reports whether this is the first active node, which does tasks
+// that the other nodes would duplicate
+func isLeadNode(iSvc string) bool {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   for a := range aSvc.config.NodeSet {
+      if aSvc.config.NodeSet[a].Status == eNodeActive {
+         return aSvc.config.NodeSet[a].Local
+      }
+   }
+   return true
+}
+
 func _addNode(iSvc string, iNode *tNode) {
    _editConfig(iSvc, func(cCfg *tSvcConfig) error {
       for a := range cCfg.NodeSet {
@@ -376,6 +425,23 @@ func decrUnreadService(iSvc string) {
    }
 }
 
+func hasTombService(iSvc string, iId string) bool {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   return aSvc.tombstone[iId] != ""
+}
+
+func addTombService(iSvc string, iId string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   if aSvc.tombstone[iId] != "" {
+      return
+   }
+   aSvc.tombstone[iId] = dateRFC3339()
+   err := storeFile(fileTomb(iSvc), aSvc.tombstone)
+   if err != nil { quit(err) }
+}
+
 func getDoorService(iSvc string, iId string, iMake func()tDoor) tDoor {
    aSvc := getService(iSvc)
    aSvc.Lock(); defer aSvc.Unlock()
@@ -394,7 +460,11 @@ func checkNameService(iName string) bool {
 }
 
 func _newService(iCfg *tSvcConfig) *tService {
-   aSvc := &tService{tabs: []tTermEl{}, unreadCount: -1, doors: make(map[string]tDoor)}
+   aSvc := &tService{tabs: []tTermEl{}, unreadCount: -1, doors: make(map[string]tDoor),
+                     tombstone: map[string]string{}, delivery: map[string]tDlvSet{},
+                     snooze: map[string]string{}, e2ePeer: map[string][]string{},
+                     signPeer: map[string][]string{}, accept: map[string][]string{},
+                     blobRef: tBlobRef{}, quarantine: tQuarantine{}}
    if iCfg != nil {
       aSvc.config = *iCfg
       aSvc.index = openIndexSearch(iCfg)
@@ -404,12 +474,16 @@ func _newService(iCfg *tSvcConfig) *tService {
 
 func makeTreeService(iSvc string) {
    var err error
-   for _, aDir := range [...]string{dirTemp(iSvc), dirThread(iSvc), dirAttach(iSvc), dirForm(iSvc)} {
+   for _, aDir := range [...]string{dirTemp(iSvc), dirThread(iSvc), dirAttach(iSvc), dirForm(iSvc),
+                                    dirThumb(iSvc), dirExtract(iSvc)} {
       err = os.MkdirAll(aDir, 0700)
       if err != nil { quit(err) }
    }
    for _, aFile := range [...]string{filePing(iSvc), fileOhi(iSvc), fileTab(iSvc), fileSendq(iSvc),
-                                     fileNotc(iSvc), fileTag(iSvc)} {
+                                     fileSchedq(iSvc), fileTomb(iSvc), fileDlv(iSvc), fileSnooze(iSvc),
+                                     fileE2ePeer(iSvc), fileSignPeer(iSvc), fileAccept(iSvc),
+                                     fileBlobRef(iSvc), fileQuarantine(iSvc), fileNotc(iSvc),
+                                     fileTag(iSvc)} {
       err = os.Symlink("empty", aFile)
       if err != nil && !os.IsExist(err) { quit(err) }
    }
@@ -456,6 +530,35 @@ func syncTagService(iSvc string, iTid, iMid string, iTagId []string) { //todo dr
    }
 }
 
+// _sendLaterService queues a send record, or schedules it if iSendAt is given;
+// returns true if the schedule changed
+func _sendLaterService(iSvc string, iType byte, iId string, iSendAt string) (bool, error) {
+   aId := string(iType) + iId
+   if iSendAt == "" {
+      if hasSchedQueue(iSvc, aId) {
+         syncSchedQueue(iSvc, &UpdateSched{Id:aId, Release:true})
+         return true, nil
+      }
+      addQueue(iSvc, iType, iId)
+      return false, nil
+   }
+   if hasQueue(iSvc, iType, iId) {
+      return false, tError("already queued")
+   }
+   aSendAt, err := _parseSendAt(iSendAt)
+   if err != nil { return false, err }
+   syncSchedQueue(iSvc, &UpdateSched{Id:aId, SendAt:aSendAt, Node:GetConfigService(iSvc).Node})
+   return true, nil
+}
+
+func _parseSendAt(iSendAt string) (string, error) {
+   aAt, err := time.Parse(time.RFC3339, iSendAt)
+   if err != nil {
+      return "", tError("sendAt not RFC3339")
+   }
+   return aAt.UTC().Format(time.RFC3339), nil
+}
+
 func sendAliasService(iW io.Writer, iSvc string, iQid, iId string) error {
    aHead, err := json.Marshal(Msg{"Op":3, "Id":iId, "Newalias":iQid})
    if err != nil { quit(err) }
@@ -463,6 +566,11 @@ func sendAliasService(iW io.Writer, iSvc string, iQid, iId string) error {
    return err
 }
 
+// tSendError is a failure that a retry won't fix; the item is dropped from the queue
+type tSendError struct { error }
+
+func IsDroppedSend(iErr error) bool { _, ok := iErr.(tSendError); return ok }
+
 func SendService(iW io.Writer, iSvc string, iSrec *SendRecord) error {
    var aFn func(io.Writer, string, string, string) error
    switch iSrec.Id[0] {
@@ -475,12 +583,22 @@ func SendService(iW io.Writer, iSvc string, iSrec *SendRecord) error {
    case eSrecAlias:  aFn = sendAliasService
    case eSrecNode:   aFn = sendUserEditNode
    case eSrecSync:   aFn = sendSyncNode
+   case eSrecRcpt:   aFn = sendReceiptDlv
+   case eSrecResend: aFn = sendResendDelta
+   case eSrecRefill: aFn = sendRefillDelta
    default:
       quit(tError("unknown op " + iSrec.Id[:1]))
    }
+   if !startSendQueue(iSvc, iSrec.Id) {
+      return tError("not queued") // unsent, or acked
+   }
    err := aFn(iW, iSvc, iSrec.Id[1:], iSrec.Id)
-   if err != nil && err.Error() == "already sent" {
-      dropQueue(iSvc, iSrec.Id)
+   if err != nil {
+      if err.Error() == "already sent" || IsDroppedSend(err) {
+         dropQueue(iSvc, iSrec.Id)
+      } else {
+         failSendQueue(iSvc, iSrec.Id)
+      }
    }
    return err
 }
@@ -575,6 +693,40 @@ func HandleTmtpService(iSvc string, iHead *Header, iR io.Reader) (
       aNd.Status, aNd.NodeId = eNodeActive, ""
       _updateNode(iSvc, aNd)
       aFn, aResult = fAll, []string{"cf", "cn"}
+   case "_snooze": // via sMsgToSelfFn
+      aTids := wakeSnooze(iSvc)
+      if len(aTids) == 0 { break }
+      aFn = func(c *ClientState) []string {
+         for _, cId := range aTids {
+            if c.getThread() == cId { return aResult }
+         }
+         return aResult[:1]
+      }
+      aResult = []string{"tl", "ml"}
+      aToAll = []string{"/v"}
+   case "_sched": // via sMsgToSelfFn
+      if !runSchedQueue(iSvc) { break }
+      aFn, aResult = fAll, []string{"sl", "ml"}
+   case "_scan": // via sMsgToSelfFn
+      indexThread(iSvc, iHead.Id) // add text of attachments found clean
+      aFn = func(c *ClientState) []string {
+         if c.getThread() == iHead.Id { return aResult }
+         return nil
+      }
+      aResult = []string{"al"}
+      aToAll = []string{"/v"}
+   case "_retain": // via sMsgToSelfFn
+      aDeleted, aChg := runRetain(iSvc)
+      if !aChg { break }
+      aFn = func(c *ClientState) []string {
+         aTid := c.getThread()
+         for _, cId := range aDeleted {
+            c.discardThread(cId)
+         }
+         if c.getThread() != aTid { return aResult }
+         return aResult[:1]
+      }
+      aResult = []string{"tl", "cs", "cl", "al", "_t", "ml", "mo"}
    case "ohi":
       updateFromOhi(iSvc, iHead)
       aFn, aResult = fAll, []string{"of"}
@@ -606,16 +758,62 @@ func HandleTmtpService(iSvc string, iHead *Header, iR io.Reader) (
          }
       }
    case "delivery":
+      if iHead.SubHead.Resend != nil {
+         err = storeResendDelta(iSvc, iHead, iR)
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "HandleTmtpService %s: resend error %s\n", iSvc, err.Error())
+            return fErr, nil
+         }
+         break
+      }
+      if iHead.SubHead.Refill != nil {
+         var aChg bool
+         aChg, err = storeRefillDelta(iSvc, iHead, iR)
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "HandleTmtpService %s: refill error %s\n", iSvc, err.Error())
+            return fErr, nil
+         }
+         if !aChg { break }
+         aFn = func(c *ClientState) []string {
+            if c.getThread() == iHead.SubHead.ThreadId { return aResult }
+            return nil
+         }
+         aResult = []string{"al"}
+         break
+      }
+      if iHead.SubHead.Receipt != nil {
+         var aChg bool
+         aChg, err = storeReceiptDlv(iSvc, iHead, iR)
+         if err != nil {
+            fmt.Fprintf(os.Stderr, "HandleTmtpService %s: receipt error %s\n", iSvc, err.Error())
+            return fErr, nil
+         }
+         if !aChg { break }
+         aFn = func(c *ClientState) []string {
+            if c.getThread() == iHead.SubHead.ThreadId { return aResult }
+            return nil
+         }
+         aResult = []string{"ml"}
+         break
+      }
       aGot := "thread"
       if iHead.Notify > 0 {
          err = storeFwdReceivedThread(iSvc, iHead, iR)
       } else {
          aGot, err = storeReceivedThread(iSvc, iHead, iR)
       }
+      if isQuotaError(err) {
+         aToAll = []string{"/v"}
+         break
+      }
       if err != nil {
          fmt.Fprintf(os.Stderr, "HandleTmtpService %s: delivery error %s\n", iSvc, err.Error())
          return fErr, nil
       }
+      if aGot != "" && iHead.Notify == 0 {
+         aTid := iHead.SubHead.ThreadId; if aTid == "" { aTid = iHead.Id }
+         queueReceiptDlv(iSvc, aTid, iHead.Id, eDlvDelivered)
+      }
       if aGot == "thread" {
          aFn, aResult = fAll, []string{"pt", "pf", "fl", "tl", "/v"}
       } else if aGot == "msg" {
@@ -739,6 +937,16 @@ func HandleTmtpService(iSvc string, iHead *Header, iR io.Reader) (
             aFn, aResult = fAll, []string{"_e", iHead.Error}
          }
          dropQueue(iSvc, aQid)
+      case eSrecRcpt:
+         if iHead.Error != "" {
+            fmt.Fprintf(os.Stderr, "HandleTmtpService %s: receipt error %s\n", iSvc, iHead.Error)
+         }
+         dropQueue(iSvc, aQid)
+      case eSrecResend, eSrecRefill:
+         if iHead.Error != "" {
+            fmt.Fprintf(os.Stderr, "HandleTmtpService %s: delta error %s\n", iSvc, iHead.Error)
+         }
+         dropQueue(iSvc, aQid)
       default:
          quit(tError("bad SendRecord " + aQid))
       }
@@ -803,12 +1011,12 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
    switch iUpdt.Op {
    case "open":
       aResult = []string{"cf", "cn", "of", "ot", "ps", "pt", "pf", "gl",
-                         "fl", "tl", "cs", "cl", "al", "_t", "ml", "mo",
-                         "/v", "/t", "/f", "/g", "/l",
+                         "sl", "fl", "tl", "cs", "cl", "al", "ar", "_t", "ml", "mo",
+                         "/v", "/t", "/f", "/m", "/g", "/l",
                          "_e", ""}
       aLen := len(aResult) - 2
       if iSvc == "local" {
-         aFn, aResult = fOne, aResult[16:aLen]
+         aFn, aResult = fOne, aResult[18:aLen]
       } else {
          //todo aToAll return []string{"/v"} to update .UnreadN everywhere? (also thread_open & delivery)
          _initUnreadCount(iSvc)
@@ -824,6 +1032,28 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
          err = tError("address requires prefix + or =")
          return fErr, nil
       }
+      switch iUpdt.Config.Receipts {
+      case "", "none", eReceiptDelivered, eReceiptSeen:
+      default:
+         err = tError("receipts must be none, delivered, or seen")
+         return fErr, nil
+      }
+      if iUpdt.Config.E2e != "" && iUpdt.Config.E2e != "on" && iUpdt.Config.E2e != "off" {
+         err = tError("e2e must be on or off")
+         return fErr, nil
+      }
+      if iUpdt.Config.Sign != "" && iUpdt.Config.Sign != "on" && iUpdt.Config.Sign != "off" {
+         err = tError("sign must be on or off")
+         return fErr, nil
+      }
+      if iUpdt.Config.Quota != nil {
+         err = validateQuota(iUpdt.Config.Quota)
+         if err != nil { return fErr, nil }
+      }
+      if iUpdt.log == 0 && iUpdt.Config.Retain != nil {
+         iUpdt.Config.Retain, err = parseRetain(iUpdt.Config.Retain)
+         if err != nil { return fErr, nil }
+      }
       if iUpdt.log == 0 && iUpdt.Config.Alias != "" {
          addQueue(iSvc, eSrecAlias, iUpdt.Config.Alias)
       }
@@ -840,11 +1070,32 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
                cCfg.HistoryLen = iUpdt.Config.HistoryLen
                iState.setHistoryMax(cCfg.HistoryLen)
             }
+            if iUpdt.Config.Receipts != "" {
+               cCfg.Receipts = iUpdt.Config.Receipts
+               if cCfg.Receipts == "none" { cCfg.Receipts = eReceiptNone }
+            }
+            if iUpdt.Config.Retain != nil {
+               cCfg.Retain = iUpdt.Config.Retain
+            }
+            if iUpdt.Config.E2e != "" {
+               cCfg.E2e = iUpdt.Config.E2e == "on"
+            }
+            if iUpdt.Config.Sign != "" {
+               cCfg.Sign = iUpdt.Config.Sign == "on"
+            }
+            if iUpdt.Config.Quota != nil {
+               cCfg.Quota = iUpdt.Config.Quota
+               if *cCfg.Quota == (tQuota{}) { cCfg.Quota = nil }
+            }
             return nil
          })
          return nil
       })
       aFn, aResult = fAll, []string{"cf"}
+   case "retain_preview":
+      aFn, aResult = fOne, []string{"rp"}
+   case "usage_report":
+      aFn, aResult = fOne, []string{"us"}
    case "ohi_add", "ohi_drop":
       editOhi(iSvc, iUpdt)
       aFn, aResult = fAll, []string{"ot"}
@@ -855,8 +1106,10 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       deleteDraftAdrsbk(iSvc, iUpdt.Ping.To, iUpdt.Ping.Gid)
       aFn, aResult = fAll, []string{"ps"}
    case "ping_send":
-      addQueue(iSvc, eSrecPing, iUpdt.Ping.Qid)
-      aFn, aResult = fAll, []string{"ps"}
+      aSched, err := _sendLaterService(iSvc, eSrecPing, iUpdt.Ping.Qid, iUpdt.Ping.SendAt)
+      if err != nil { return fErr, nil }
+      aFn, aResult = fAll, []string{"ps", "sl"}
+      if !aSched { aResult = aResult[:1] }
    case "accept_send":
       addQueue(iSvc, eSrecAccept, iUpdt.Accept.Qid)
       aFn, aResult = fAll, []string{"pf"}
@@ -874,11 +1127,27 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       })
       if err != nil { return fErr, nil }
       aToAll = []string{"/v"}
+   case "notice_accept":
+      err = acceptKeyNotice(iSvc, iUpdt)
+      if err != nil { return fErr, nil }
+      aToAll = []string{"/v"}
+   case "thread_restore", "thread_quote":
+      if iUpdt.Op == "thread_quote" {
+         err = setupQuoteThread(iSvc, iState, iUpdt)
+      } else {
+         err = setupRestoreThread(iSvc, iUpdt)
+      }
+      if err != nil { return fErr, nil }
+      fallthrough
    case "thread_save":
       const ( _ int8 = iota; eNewThread; eNewReply )
       if iUpdt.Thread.New > 0 {
          aTid := ""; if iUpdt.Thread.New == eNewReply { aTid = iState.getThread() }
          iUpdt.Thread.Id = makeLocalId(aTid)
+         if iUpdt.Thread.Template != "" {
+            err = applyTemplate(iSvc, aTid, iUpdt)
+            if err != nil { return fErr, nil }
+         }
       }
       aInclTl := storeDraftThread(iSvc, iUpdt)
       if iUpdt.Thread.New == eNewThread {
@@ -914,6 +1183,10 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       }
    case "thread_discard":
       deleteDraftThread(iSvc, iUpdt)
+      aSched := hasSchedQueue(iSvc, string(eSrecThread) + iUpdt.Thread.Id)
+      if aSched {
+         syncSchedQueue(iSvc, &UpdateSched{Id: string(eSrecThread) + iUpdt.Thread.Id})
+      }
       aTid := iState.getThread()
       if iUpdt.Thread.Id[0] == '_' {
          aFn = func(c *ClientState) []string {
@@ -930,17 +1203,109 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
          }
          aResult = []string{"tl", "al", "ml"}
       }
+      if aSched {
+         fDiscard := aFn
+         aFn = func(c *ClientState) []string { return append(append([]string{}, fDiscard(c)...), "sl") }
+      }
    case "thread_send":
       if iUpdt.Thread.Id == "" { break }
-      err = validateDraftThread(iSvc, iUpdt)
+      err = validateDraftThread(iSvc, iUpdt.Thread.Id)
       if err != nil { return fErr, nil }
       aTid := iState.getThread()
       aFn = func(c *ClientState) []string {
          if c.getThread() == aTid { return aResult }
+         return aResult[1:]
+      }
+      aResult = []string{"ml", "sl"}
+      aSched, err := _sendLaterService(iSvc, eSrecThread, iUpdt.Thread.Id, iUpdt.Thread.SendAt)
+      if err != nil { return fErr, nil }
+      if !aSched { aResult = aResult[:1] }
+   case "thread_delete":
+      syncUpdtNode(iSvc, iUpdt, iState, func() error {
+         err = deleteThread(iSvc, iUpdt)
+         return err
+      })
+      if err != nil { return fErr, nil }
+      aTid := iUpdt.Touch.ThreadId
+      aFn = func(c *ClientState) []string {
+         defer c.discardThread(aTid)
+         if c.getThread() == aTid { return aResult }
+         return aResult[:1]
+      }
+      aResult = []string{"tl", "cs", "cl", "al", "_t", "ml", "mo"}
+   case "msg_delete":
+      syncUpdtNode(iSvc, iUpdt, iState, func() error {
+         err = deleteMsgThread(iSvc, iUpdt)
+         return err
+      })
+      if err != nil { return fErr, nil }
+      aFn = func(c *ClientState) []string {
+         if c.getThread() == iUpdt.Touch.ThreadId { return aResult }
+         return aResult[:1]
+      }
+      aResult = []string{"tl", "al", "ml", "mo"}
+   case "thread_snooze":
+      if iUpdt.log == 0 {
+         if iUpdt.Touch.ThreadId == "" || iUpdt.Touch.ThreadId[0] == '_' {
+            err = tError("invalid thread id")
+            return fErr, nil
+         }
+         if iUpdt.Touch.Until != "" {
+            var aAt time.Time
+            aAt, err = time.Parse(time.RFC3339, iUpdt.Touch.Until)
+            if err != nil {
+               err = tError("until not RFC3339")
+               return fErr, nil
+            }
+            iUpdt.Touch.Until = aAt.UTC().Format(time.RFC3339)
+         }
+      }
+      syncUpdtNode(iSvc, iUpdt, iState, func() error {
+         setSnooze(iSvc, iUpdt.Touch.ThreadId, iUpdt.Touch.Until)
          return nil
+      })
+      aFn, aResult = fAll, []string{"tl"}
+   case "snooze_wake": // from wakeSnooze on another node, or a retry
+      if iUpdt.log == 0 {
+         err = tError("not a client op")
+         return fErr, nil
+      }
+      aChg := false
+      syncUpdtNode(iSvc, iUpdt, iState, func() error {
+         aChg = applyWakeSnooze(iSvc, iUpdt.Touch.ThreadId)
+         if !aChg { return tError("") } // no sync
+         return nil
+      })
+      if !aChg { break }
+      aFn = func(c *ClientState) []string {
+         if c.getThread() == iUpdt.Touch.ThreadId { return aResult }
+         return aResult[:1]
+      }
+      aResult = []string{"tl", "ml"}
+      aToAll = []string{"/v"}
+   case "accept_codec": // from addAcceptCodec on another node, or a retry
+      if iUpdt.log == 0 {
+         err = tError("not a client op")
+         return fErr, nil
+      }
+      syncUpdtNode(iSvc, iUpdt, iState, func() error {
+         if !setAcceptCodec(iSvc, iUpdt.Codec.Uid, iUpdt.Codec.Accept) { return tError("") } // no sync
+         return nil
+      })
+   case "thread_unsend":
+      aTid := iState.getThread()
+      aFn = func(c *ClientState) []string {
+         if c.getThread() == aTid { return aResult }
+         return aResult[1:]
       }
       aResult = []string{"ml"}
-      addQueue(iSvc, eSrecThread, iUpdt.Thread.Id)
+      if hasSchedQueue(iSvc, string(eSrecThread) + iUpdt.Thread.Id) {
+         syncSchedQueue(iSvc, &UpdateSched{Id: string(eSrecThread) + iUpdt.Thread.Id})
+         aResult = append(aResult, "sl")
+         break
+      }
+      err = unsendQueue(iSvc, eSrecThread, iUpdt.Thread.Id)
+      if err != nil { return fErr, nil }
    case "thread_open":
       if iUpdt.log == 0 && iUpdt.Touch.ThreadId != iState.getThread() {
          err = tError("thread id out of sync")
@@ -955,6 +1320,9 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
          return nil
       })
       if !aChg { break }
+      if iUpdt.log == 0 {
+         queueReceiptDlv(iSvc, iUpdt.Touch.ThreadId, iUpdt.Touch.MsgId, eDlvSeen)
+      }
       aFn = func(c *ClientState) []string {
          if c.getThread() == iUpdt.Touch.ThreadId { return aResult }
          return aResult[:2]
@@ -1004,12 +1372,38 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       }
       aResult = []string{"cl"}
    case "forward_send":
+      if GetConfigService(iSvc).E2e {
+         err = tError("forwarding unavailable with end-to-end encryption")
+         return fErr, nil
+      }
       aFn = func(c *ClientState) []string {
          if c.getThread() == iUpdt.Forward.ThreadId { return aResult }
-         return nil
+         return aResult[1:]
       }
-      aResult = []string{"cl"}
-      addQueue(iSvc, eSrecFwd, iUpdt.Forward.Qid)
+      aResult = []string{"cl", "sl"}
+      aSched, err := _sendLaterService(iSvc, eSrecFwd, iUpdt.Forward.Qid, iUpdt.Forward.SendAt)
+      if err != nil { return fErr, nil }
+      if !aSched { aResult = aResult[:1] }
+   case "sched_edit":
+      if iUpdt.log == 0 {
+         if !hasSchedQueue(iSvc, iUpdt.Sched.Id) {
+            err = tError("not scheduled")
+            return fErr, nil
+         }
+         iUpdt.Sched.Node, iUpdt.Sched.Release = "", false
+         if iUpdt.Sched.SendAt != "" {
+            iUpdt.Sched.SendAt, err = _parseSendAt(iUpdt.Sched.SendAt)
+            if err != nil { return fErr, nil }
+         }
+      }
+      iUpdt.LogOp = "sched_sync"
+      fallthrough
+   case "sched_sync":
+      syncUpdtNode(iSvc, iUpdt, iState, func() error {
+         applySchedQueue(iSvc, iUpdt)
+         return nil
+      })
+      aFn, aResult = fAll, []string{"sl"}
    case "tag_add":
       if iUpdt.log == 0 {
          iUpdt.Tag.Id = makeIdTag()
@@ -1036,6 +1430,10 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       aFn = fOne
       aResult = []string{"cs", "mo"}; if aDiff { aResult = []string{"cs", "cl", "al", "_t", "ml", "mo"} }
    case "tab_add":
+      if aT := iUpdt.Tab.Term; aT != "" && aT[0] != '&' && aT[0] != ':' && _isQuerySearch(aT) {
+         _, err = makeQuerySearch(iUpdt.Tab.Term)
+         if err != nil { return fErr, nil }
+      }
       iState.addTab(iUpdt.Tab.Type, iUpdt.Tab.Term)
       aAlt := "tl"; if iUpdt.Tab.Type == eTabThread { aAlt = "mo" }
       aFn, aResult = fOne, []string{"cs", aAlt}
@@ -1062,8 +1460,13 @@ func HandleUpdtService(iSvc string, iState *ClientState, iUpdt *Update) (
       aAlt := "tl"; if iUpdt.Tab.Type == eTabThread { aAlt = "mo" }
       aFn, aResult = fOne, []string{"cs", aAlt}
    case "sort_select":
+      if iUpdt.Sort.Type == "tl" && kSearchSort[iUpdt.Sort.Field] == nil {
+         err = tError("unknown sort "+ iUpdt.Sort.Field)
+         return fErr, nil
+      }
       iState.setSort(iUpdt.Sort.Type, iUpdt.Sort.Field)
       aFn, aResult = fOne, []string{"cs"}
+      if iUpdt.Sort.Type == "tl" { aResult = []string{"cs", "tl"} }
    case "node_add":
       aNd := _findNode(iSvc, iUpdt.Node.Newnode)
       aIsNew := aNd == nil
@@ -0,0 +1,242 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "bytes"
+   "crypto/ed25519"
+   "crypto/rand"
+   "crypto/sha256"
+   "encoding/base64"
+   "encoding/binary"
+   "encoding/hex"
+   "encoding/json"
+   "fmt"
+   "hash"
+   "io"
+   "os"
+)
+
+// Message signing: each node has an Ed25519 keypair. While the Sign option is set, its public
+// key goes in the sub-header of pings, and sent messages carry a signature over the sub-header
+// bytes as sent, the body, and the attachments as sent. Keys are learned only from pings &
+// invites, i.e. the address book; the first key of a uid is pinned, and a different one is
+// held in a notice until the user accepts it.
+
+const kNoticeKeySign = "sign:" // prefix of tNoticeEl.MsgId for a changed key
+
+const (
+   eSignNone = ""                 // unsigned, and sender has no keys
+   eSignVerified = "verified"     // signed with a key of the sender
+   eSignUnverified = "unverified" // signed with a key not on record, or sender has keys but msg unsigned
+   eSignMismatch = "mismatch"     // bad signature, or signed with a key not of the sender
+)
+
+type tSignHead struct {
+   Key string // signer's node key
+   Sig []byte `json:",omitempty"`
+}
+
+type tSignKeyfile struct {
+   Private []byte
+}
+
+// _getKeySign returns this node's private key and public key, creating them if necessary
+func _getKeySign(iSvc string) (ed25519.PrivateKey, string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   if aSvc.signKey == nil {
+      var aKf tSignKeyfile
+      err := readJsonFile(&aKf, fileSignKey(iSvc))
+      if err != nil {
+         if !os.IsNotExist(err) { quit(err) }
+         _, aKf.Private, err = ed25519.GenerateKey(rand.Reader)
+         if err != nil { quit(err) }
+         aTemp := fileSignKey(iSvc) + ".tmp"
+         err = os.Remove(aTemp)
+         if err != nil && !os.IsNotExist(err) { quit(err) }
+         err = writeJsonFile(aTemp, &aKf)
+         if err != nil { quit(err) }
+         err = os.Rename(aTemp, fileSignKey(iSvc))
+         if err != nil { quit(err) }
+         err = syncDir(dirSvc(iSvc))
+         if err != nil { quit(err) }
+      }
+      aSvc.signKey = aKf.Private
+   }
+   aPub := aSvc.signKey.Public().(ed25519.PublicKey)
+   return aSvc.signKey, base64.StdEncoding.EncodeToString(aPub)
+}
+
+// pubKeySign returns this node's public key if the Sign option is set
+func pubKeySign(iSvc string) string {
+   if !GetConfigService(iSvc).Sign {
+      return ""
+   }
+   _, aPub := _getKeySign(iSvc)
+   return aPub
+}
+
+// addPeerSign records the first key of a uid, unless it's this node's key.
+// A different key is held in a notice until the user accepts it; see pinPeerSign().
+func addPeerSign(iSvc string, iUid string, iPub string) {
+   if iPub == "" {
+      return
+   }
+   aRaw, err := base64.StdEncoding.DecodeString(iPub)
+   if err != nil || len(aRaw) != ed25519.PublicKeySize {
+      fmt.Fprintf(os.Stderr, "addPeerSign %s: uid %s invalid key\n", iSvc, iUid)
+      return
+   }
+   if iPub == pubKeySign(iSvc) {
+      return
+   }
+   aSvc := getService(iSvc)
+   aSvc.Lock()
+   aPinned := len(aSvc.signPeer[iUid]) > 0
+   for _, aK := range aSvc.signPeer[iUid] {
+      if aK == iPub {
+         aSvc.Unlock()
+         return
+      }
+   }
+   if !aPinned {
+      aSvc.signPeer[iUid] = []string{iPub}
+      err = storeFile(fileSignPeer(iSvc), aSvc.signPeer)
+      if err != nil { quit(err) }
+   }
+   aSvc.Unlock()
+   if aPinned {
+      fmt.Fprintf(os.Stderr, "addPeerSign %s: uid %s key changed\n", iSvc, iUid)
+      aSum := sha256.Sum256(aRaw)
+      addKeyNotice(iSvc, kNoticeKeySign + hex.EncodeToString(aSum[:8]), iUid, iPub, "new signing key")
+   }
+}
+
+// pinPeerSign adds a key accepted by the user; it replaces a contact's key, but not our
+// other nodes' keys
+func pinPeerSign(iSvc string, iUid string, iPub string) {
+   aUid := GetConfigService(iSvc).Uid // takes aSvc.RLock()
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   if iUid == aUid {
+      aSvc.signPeer[iUid] = append(aSvc.signPeer[iUid], iPub)
+   } else {
+      aSvc.signPeer[iUid] = []string{iPub}
+   }
+   err := storeFile(fileSignPeer(iSvc), aSvc.signPeer)
+   if err != nil { quit(err) }
+}
+
+// _getPeerSign returns the keys of a uid; for our uid, those of our other nodes
+func _getPeerSign(iSvc string, iUid string) []string {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   return aSvc.signPeer[iUid]
+}
+
+// _digestSign starts the hash of a message, which covers the sub-header bytes as sent,
+// with a zero signature
+func _digestSign(iSub []byte) hash.Hash {
+   aH := sha256.New()
+   aLen := make([]byte, 8)
+   binary.BigEndian.PutUint64(aLen, uint64(len(iSub)))
+   aH.Write(aLen)
+   aH.Write(iSub)
+   return aH
+}
+
+// _swapSign replaces signature iFrom with iTo in sub-header bytes; returns nil if iFrom
+// doesn't occur exactly once
+func _swapSign(iSub []byte, iFrom, iTo []byte) []byte {
+   fSig := func(c []byte) []byte {
+      return []byte(`"Sig":"`+ base64.StdEncoding.EncodeToString(c) +`"`)
+   }
+   aFrom := fSig(iFrom)
+   if bytes.Count(iSub, aFrom) != 1 {
+      return nil
+   }
+   return bytes.Replace(iSub, aFrom, fSig(iTo), 1)
+}
+
+// signMsg sets iSubHead.Sign for a draft, reading its body and attachments from iFd, which
+// it leaves at the same position; returns the sub-header to send
+func signMsg(iSvc string, iSubHead *tHeader2, iId tLocalId, iFd *tFile, iBodyLen int64) []byte {
+   aPriv, aPub := _getKeySign(iSvc)
+   aZero := make([]byte, ed25519.SignatureSize)
+   iSubHead.Sign = &tSignHead{Key: aPub, Sig: aZero}
+   aSub, err := json.Marshal(iSubHead)
+   if err != nil { quit(err) }
+   aH := _digestSign(aSub)
+   aPos, err := iFd.Seek(0, io.SeekCurrent)
+   if err != nil { quit(err) }
+   _, err = io.CopyN(aH, iFd, iBodyLen)
+   if err != nil { quit(err) }
+   err = writeDraftAttach(aH, iSvc, iSubHead, iId, iFd)
+   if err != nil { quit(err) }
+   _, err = iFd.Seek(aPos, io.SeekStart)
+   if err != nil { quit(err) }
+   iSubHead.Sign.Sig = ed25519.Sign(aPriv, aH.Sum(nil))
+   return _swapSign(aSub, aZero, iSubHead.Sign.Sig)
+}
+
+// tSignVerifier hashes a received message body as it's read
+type tSignVerifier struct {
+   hash hash.Hash
+   left int64
+   sign *tSignHead
+   bad bool // sub-header bytes lack the signature
+}
+
+// newSignVerifier starts a verifier for the body and attachments; call before any change
+// to iHead.SubHead
+func newSignVerifier(iHead *Header) *tSignVerifier {
+   aV := &tSignVerifier{left: iHead.DataLen, sign: iHead.SubHead.Sign}
+   if aV.sign == nil {
+      return aV
+   }
+   aSub := _swapSign(iHead.SubHead.raw, aV.sign.Sig, make([]byte, ed25519.SignatureSize))
+   aV.bad = aSub == nil
+   aV.hash = _digestSign(aSub)
+   return aV
+}
+
+func (o *tSignVerifier) Write(iBuf []byte) (int, error) {
+   if o.hash == nil {
+      return len(iBuf), nil
+   }
+   aLen := len(iBuf); if int64(aLen) > o.left { aLen = int(o.left) }
+   o.hash.Write(iBuf[:aLen])
+   o.left -= int64(aLen)
+   return len(iBuf), nil
+}
+
+// status gives the value for tIndexElCore.Sign, once the body has been read
+func (o *tSignVerifier) status(iSvc string, iFrom string) string {
+   aKeys := _getPeerSign(iSvc, iFrom)
+   if o.sign == nil {
+      if len(aKeys) == 0 {
+         return eSignNone
+      }
+      return eSignUnverified
+   }
+   aRaw, err := base64.StdEncoding.DecodeString(o.sign.Key)
+   if err != nil || len(aRaw) != ed25519.PublicKeySize || o.bad || o.left != 0 ||
+      !ed25519.Verify(ed25519.PublicKey(aRaw), o.hash.Sum(nil), o.sign.Sig) {
+      return eSignMismatch
+   }
+   for _, aK := range aKeys {
+      if aK == o.sign.Key {
+         return eSignVerified
+      }
+   }
+   if len(aKeys) == 0 {
+      return eSignUnverified
+   }
+   return eSignMismatch
+}
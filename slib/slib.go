@@ -9,6 +9,8 @@ package slib
 
 import (
    "sync/atomic"
+   "crypto/ecdh"
+   "crypto/ed25519"
    "runtime/debug"
    "hash/crc32"
    "fmt"
@@ -29,14 +31,20 @@ const kServiceDir = kStorageDir + "svc/"
 const kStateDir   = kStorageDir + "state/"
 const kUploadDir  = kStorageDir + "upload/"
 const kUploadTmp  = kUploadDir  + "temp/"
+const kUploadThumb = kUploadDir + "thumb/"
+const kUploadPart = kUploadTmp + "part/"
+const kUploadStat = kStorageDir + "uploadstat"
 const kFormDir    = kStorageDir + "form/"
 const kFormRegDir = kStorageDir + "reg-cache/"
+const kTemplateDir = kStorageDir + "template/"
 const kTempDir    = kStorageDir + "temp/"
 
 func fileState(iCli, iSvc string) string { return kStateDir + iCli +"/"+ escapeFile(iSvc) }
 
 func fileUpload(iFil string) string { return kUploadDir + escapeFile(iFil) }
 func fileUptmp (iFil string) string { return kUploadTmp + escapeFile(iFil) }
+func fileUpthumb(iFil string) string { return kUploadThumb + escapeFile(iFil) }
+func fileUppart(iSid string) string { return kUploadPart + iSid }
 
 func fileFormReg(iFfn string) string { return kFormRegDir + escapeFile(iFfn) }
 
@@ -49,6 +57,9 @@ func dirTemp  (iSvc string) string { return dirSvc(iSvc) + "temp/" }
 func dirThread(iSvc string) string { return dirSvc(iSvc) + "thread/" }
 func dirAttach(iSvc string) string { return dirSvc(iSvc) + "attach/" }
 func dirForm  (iSvc string) string { return dirSvc(iSvc) + "form/" }
+func dirBlob  (iSvc string) string { return dirAttach(iSvc) + "blob/" }
+func dirThumb (iSvc string) string { return dirSvc(iSvc) + "thumb/" }
+func dirExtract(iSvc string) string { return dirSvc(iSvc) + "extract/" }
 func fileCfg  (iSvc string) string { return dirSvc(iSvc) + "config" }
 func filePing (iSvc string) string { return dirSvc(iSvc) + "ping-draft" }
 func fileAdrs (iSvc string) string { return dirSvc(iSvc) + "adrsbk" }
@@ -56,14 +67,30 @@ func fileOhi  (iSvc string) string { return dirSvc(iSvc) + "ohi" }
 func fileTag  (iSvc string) string { return dirSvc(iSvc) + "tag" }
 func fileTab  (iSvc string) string { return dirSvc(iSvc) + "tabs" }
 func fileSendq(iSvc string) string { return dirSvc(iSvc) + "sendq" }
+func fileSchedq(iSvc string) string { return dirSvc(iSvc) + "schedq" }
+func fileTomb (iSvc string) string { return dirSvc(iSvc) + "tombstone" }
+func fileDlv  (iSvc string) string { return dirSvc(iSvc) + "delivery" }
+func fileSnooze(iSvc string) string { return dirSvc(iSvc) + "snooze" }
+func fileE2eKey(iSvc string) string { return dirSvc(iSvc) + "e2ekey" } // not replicated to nodes
+func fileE2ePeer(iSvc string) string { return dirSvc(iSvc) + "e2epeer" }
+func fileSignKey(iSvc string) string { return dirSvc(iSvc) + "signkey" } // not replicated to nodes
+func fileSignPeer(iSvc string) string { return dirSvc(iSvc) + "signpeer" }
+func fileAccept(iSvc string) string { return dirSvc(iSvc) + "accept" }
+func fileBlobRef(iSvc string) string { return dirSvc(iSvc) + "blobref" }
+func fileQuarantine(iSvc string) string { return dirSvc(iSvc) + "quarantine" }
 func fileNotc (iSvc string) string { return dirSvc(iSvc) + "notice" }
 func fileIndex(iSvc string) string { return dirSvc(iSvc) + "index.bleve" }
 
 func fileDraft(iSvc, iTid, iLms string) string { return dirThread(iSvc) + iTid +"_"+ iLms }
 func fileFwd  (iSvc, iTid       string) string { return dirThread(iSvc) + iTid + "_forward" }
+func fileHist (iSvc, iTid, iLms string) string { return dirThread(iSvc) + iTid +"_"+ iLms +"_history" }
 
 func fileAtc(iSvc, iSub, iMid, iFil string) string { return dirAttach(iSvc) + iSub +"/"+
                                                             iMid +"_"+ escapeFile(iFil) }
+func fileThumb(iSvc, iSub, iMid, iFil string) string { return dirThumb(iSvc) + iSub +"/"+
+                                                              iMid +"_"+ escapeFile(iFil) }
+func fileExtract(iSvc, iSub, iMid, iFil string) string { return dirExtract(iSvc) + iSub +"/"+
+                                                                iMid +"_"+ escapeFile(iFil) }
 func fileFfn(iSvc, iSub             string) string { return dirAttach(iSvc) + iSub + "/ffnindex" }
 
 func fileForm(iSvc, iFft string) string { return dirForm(iSvc) + escapeFile(iFft) }
@@ -79,6 +106,8 @@ func ftmpFr(iSvc, iTid       string) string { return dirTemp(iSvc) +"fr_"+ iTid
 func ftmpFn(iSvc, iTid       string) string { return dirTemp(iSvc) +"fn_"+ iTid +"___" }
 func ftmpFs(iSvc, iTid, iLms string) string { return dirTemp(iSvc) +"fs_"+ iTid +"__"+ iLms +"_" }
 func ftmpTc(iSvc, iTid, iLms string) string { return dirTemp(iSvc) +"nr_"+ iTid +"__"+ iLms +"_" }
+func ftmpDm(iSvc, iTid, iMid string) string { return dirTemp(iSvc) +"dm_"+ iTid +"_"+ iMid +"__" }
+func ftmpDt(iSvc, iTid       string) string { return dirTemp(iSvc) +"dt_"+ iTid +"_"+ iTid +"__" }
 
 func ftmpFwdS(iSvc, iTid string) string { return dirTemp(iSvc) + iTid +"_fwd.tmp" }
 func ftmpFwdD(iSvc, iTid string) string { return dirTemp(iSvc) +"forward_"+ iTid }
@@ -86,6 +115,10 @@ func ftmpFwdD(iSvc, iTid string) string { return dirTemp(iSvc) +"forward_"+ iTid
 func ftmpAtc(iSvc, iMid, iFil string) string { return dirTemp(iSvc) +
                                                       iMid +"_"+ escapeFile(iFil) +"_atc.tmp" }
 
+// this ends with ".tmp", so it's dropped at startup
+func ftmpWire(iSvc, iLms, iFil string) string { return dirTemp(iSvc) +"wire_"+ iLms +"_"+
+                                                       escapeFile(iFil) +".tmp" }
+
 func ftmpFfn   (iSvc, iTid       string) string { return dirTemp(iSvc) +"ffnindex_"+ iTid }
 func ftmpAdrsbk(iSvc, iPos, iQid string) string { return dirTemp(iSvc) +"adrsbk_"+ iPos +"_"+
                                                          escapeFile(iQid) }
@@ -119,6 +152,19 @@ type tService struct {
    config tSvcConfig
    sendQ []*tQueueEl
    sendQPost func(...*SendRecord)
+   schedQ []*tSchedEl
+   schedTimer *time.Timer
+   tombstone map[string]string // deleted msgid or thread id -> date
+   delivery map[string]tDlvSet // sent msgid -> recipient status
+   snooze map[string]string // thread id -> wake date
+   snoozeTimer *time.Timer
+   e2eKey *ecdh.PrivateKey // of node; see _getKeyE2e()
+   e2ePeer map[string][]string // uid -> public keys
+   signKey ed25519.PrivateKey // see _getKeySign()
+   signPeer map[string][]string // uid -> public keys, from pings
+   accept map[string][]string // uid -> codecs
+   blobRef tBlobRef
+   quarantine tQuarantine
    notice []tNoticeEl
    fromOhi tOhi
    tabs []tTermEl
@@ -163,7 +209,14 @@ type tHeader2 struct {
    ConfirmId string `json:",omitempty"`
    ConfirmPosted string `json:",omitempty"`
    NodeSync bool `json:",omitempty"`
+   Receipt *tReceipt `json:",omitempty"`
+   E2e *tE2eHead `json:",omitempty"`
+   Sign *tSignHead `json:",omitempty"`
+   Accept []string `json:",omitempty"` // codecs; not stored
+   Resend *tRefill `json:",omitempty"` // request for attachment lacking delta base
+   Refill *tRefill `json:",omitempty"` // reply to Resend
    noAttachSize bool
+   raw []byte // bytes as received, if signed; see newSignVerifier()
 }
 
 type tHeader2Attach struct {
@@ -173,6 +226,19 @@ type tHeader2Attach struct {
    FfKey string `json:",omitempty"` // only in draft
    IsNew bool   `json:",omitempty"` // only in draft
    AllowAnyData bool `json:",omitempty"` // for testing
+   Codec string `json:",omitempty"` // only on wire
+   WireSize int64 `json:",omitempty"` // only on wire, if Codec
+   Base string `json:",omitempty"` // only in draft; "msgid_name" to send a delta against
+   Delta *tDeltaAttach `json:",omitempty"` // only on wire, if Codec delta
+}
+
+func (o *tHeader2) UnmarshalJSON(iBuf []byte) error {
+   type tPlain tHeader2 // lacks this method
+   err := json.Unmarshal(iBuf, (*tPlain)(o))
+   if err == nil && o.Sign != nil && o.Sign.Sig != nil {
+      o.raw = append([]byte{}, iBuf...)
+   }
+   return err
 }
 
 func (o *tHeader2) setupDraft(iThreadId string, i *Update, iSvc string) {
@@ -187,6 +253,9 @@ func (o *tHeader2) setupDraft(iThreadId string, i *Update, iSvc string) {
 func (o *tHeader2) setupSent(iThreadId string) {
    o.ThreadId = iThreadId
    o.noAttachSize = true
+   for a := range o.Attach {
+      o.Attach[a].Base = ""
+   }
 }
 
 func (o *Header) Check() bool {
@@ -212,6 +281,11 @@ type Update struct {
       Addr string
       Alias string
       LoginPeriod int
+      Receipts string // "none", "delivered", "seen", or empty for no change
+      Retain []tRetainEl // nil for no change
+      E2e string // "on", "off", or empty for no change
+      Sign string // "on", "off", or empty for no change
+      Quota *tQuota // nil for no change; all zero for no limits
    } `json:",omitempty"`
    Thread *struct {
       Id string
@@ -222,12 +296,17 @@ type Update struct {
       Attach []tHeader2Attach
       FormFill map[string]string
       New int8
+      Rev int `json:",omitempty"` // for thread_restore
+      SendAt string `json:",omitempty"` // for thread_send
+      Template string `json:",omitempty"` // for thread_save with New
+      Quote string `json:",omitempty"` // for thread_quote, msgid or msgid.start-end
    } `json:",omitempty"`
    Touch *UpdateTouch `json:",omitempty"`
    Forward *struct {
       ThreadId string
       Cc []tCcEl
       Qid string
+      SendAt string `json:",omitempty"`
    } `json:",omitempty"`
    Ping *struct {
       Alias string
@@ -235,6 +314,7 @@ type Update struct {
       Text string
       Gid string
       Qid string
+      SendAt string `json:",omitempty"`
    } `json:",omitempty"`
    Accept *struct {
       Qid string
@@ -274,6 +354,8 @@ type Update struct {
       Pin string
       Newnode string
    } `json:",omitempty"`
+   Sched *UpdateSched `json:",omitempty"`
+   Codec *UpdateCodec `json:",omitempty"`
    Test *UpdateTest `json:",omitempty"`
 }
 
@@ -284,6 +366,19 @@ type UpdateTouch struct { //todo move into Update when draft sync'd
    TagId string
    TagName string `json:",omitempty"`
    Act int8
+   Until string `json:",omitempty"` // for thread_snooze; empty to wake
+}
+
+type UpdateSched struct {
+   Id string // SendRecord.Id
+   SendAt string // empty to unschedule
+   Node string `json:",omitempty"` // set when first scheduled
+   Release bool `json:",omitempty"` // move to sendQ
+}
+
+type UpdateCodec struct {
+   Uid string
+   Accept []string // nil to drop
 }
 
 type UpdateTest struct {
@@ -299,6 +394,7 @@ const (
    eSrecThread = 't'; eSrecFwd = 'f'; eSrecCfm = 'c'
    eSrecPing = 'p'; eSrecOhi = 'o'; eSrecAccept = 'a'
    eSrecAlias = 'l'; eSrecNode = 'n'; eSrecSync = 's'
+   eSrecRcpt = 'r'; eSrecResend = 'q'; eSrecRefill = 'g'
 )
 
 type Msg map[string]interface{}
@@ -306,12 +402,14 @@ type Msg map[string]interface{}
 
 func Init(iStart func(string), iMts func(string, *Header), iCrash func(string, string)) {
    sCrashFn = iCrash
-   for _, aDir := range [...]string{kUploadTmp, kServiceDir, kStateDir, kFormDir, kFormRegDir, kTempDir} {
+   for _, aDir := range [...]string{kUploadPart, kUploadThumb, kServiceDir, kStateDir, kFormDir, kFormRegDir,
+                                    kTemplateDir, kTempDir} {
       err := os.MkdirAll(aDir, 0700)
       if err != nil { quit(err) }
    }
    initUpload()
    initForms()
+   initTemplates()
    initStates()
    initServices(iStart, iMts)
    startAllService()
@@ -400,7 +498,7 @@ func storeFile(iPath string, iData interface{}) error {
 }
 
 func readJsonFile(iObj interface{}, iPath string) error {
-   aFd, err := os.Open(iPath)
+   aFd, err := openFile(iPath)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
       return err
@@ -414,7 +512,7 @@ func readJsonFile(iObj interface{}, iPath string) error {
 }
 
 func writeJsonFile(iPath string, iData interface{}) error {
-   aFd, err := os.OpenFile(iPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+   aFd, err := openFileFlags(iPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { return err }
    defer aFd.Close()
    err = json.NewEncoder(aFd).Encode(iData)
@@ -424,7 +522,7 @@ func writeJsonFile(iPath string, iData interface{}) error {
 }
 
 func writeStreamFile(iPath string, iSrc io.Reader) error {
-   aFd, err := os.OpenFile(iPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+   aFd, err := openFileFlags(iPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aFd.Close()
    _, err = io.Copy(aFd, iSrc)
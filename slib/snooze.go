@@ -0,0 +1,113 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "time"
+)
+
+func getSnooze(iSvc string, iTid string) string {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   return aSvc.snooze[iTid]
+}
+
+func getListSnooze(iSvc string) []string {
+   aSvc := getService(iSvc)
+   aSvc.RLock(); defer aSvc.RUnlock()
+   aList := make([]string, 0, len(aSvc.snooze))
+   for aK := range aSvc.snooze {
+      aList = append(aList, aK)
+   }
+   return aList
+}
+
+// setSnooze hides a thread until iUntil (RFC3339 UTC); empty iUntil wakes it
+func setSnooze(iSvc string, iTid string, iUntil string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   if aSvc.snooze[iTid] == iUntil {
+      return
+   }
+   if iUntil == "" {
+      delete(aSvc.snooze, iTid)
+   } else {
+      aSvc.snooze[iTid] = iUntil
+   }
+   err := storeFile(fileSnooze(iSvc), aSvc.snooze)
+   if err != nil { quit(err) }
+   _armSnooze(iSvc, aSvc)
+}
+
+func initSnooze(iSvc string) {
+   aSvc := getService(iSvc)
+   aSvc.Lock(); defer aSvc.Unlock()
+   _armSnooze(iSvc, aSvc)
+}
+
+// _armSnooze sets a timer for the earliest wakeup; caller holds aSvc.Lock
+func _armSnooze(iSvc string, iService *tService) {
+   if iService.snoozeTimer != nil {
+      iService.snoozeTimer.Stop()
+      iService.snoozeTimer = nil
+   }
+   aNext := ""
+   for _, aUntil := range iService.snooze {
+      if aNext == "" || aUntil < aNext {
+         aNext = aUntil
+      }
+   }
+   if aNext == "" {
+      return
+   }
+   aAt, err := time.Parse(time.RFC3339, aNext)
+   if err != nil { quit(err) }
+   iService.snoozeTimer = time.AfterFunc(time.Until(aAt), func() {
+      sMsgToSelfFn(iSvc, &Header{Op:"_snooze"})
+   })
+}
+
+// wakeSnooze wakes the due threads and replicates that to other nodes; every node runs
+// its own timer, so a thread already woken by a sync from another node is skipped
+func wakeSnooze(iSvc string) []string {
+   aSvc := getService(iSvc)
+   aSvc.updt.RLock(); defer aSvc.updt.RUnlock()
+   aNow := dateRFC3339()
+   var aDue, aWoken []string
+   aSvc.RLock()
+   for aK, aUntil := range aSvc.snooze {
+      if aUntil <= aNow {
+         aDue = append(aDue, aK)
+      }
+   }
+   aSvc.RUnlock()
+   for _, aTid := range aDue {
+      aUpdt := Update{Op: "snooze_wake", Touch: &UpdateTouch{ThreadId: aTid}}
+      aState := ClientState{id: "wakeSnooze", History: []string{""}}
+      syncUpdtNode(iSvc, &aUpdt, &aState, func() error {
+         if !applyWakeSnooze(iSvc, aTid) { return tError("") } // no sync
+         aWoken = append(aWoken, aTid)
+         return nil
+      })
+   }
+   return aWoken
+}
+
+// applyWakeSnooze marks a snoozed thread unread and posts a notice; false if it's awake
+func applyWakeSnooze(iSvc string, iTid string) bool {
+   if getSnooze(iSvc, iTid) == "" {
+      return false
+   }
+   aIdx := getIndexThread(iSvc, iTid)
+   if aIdx != nil {
+      touchThread(iSvc, &Update{Touch: &UpdateTouch{ThreadId: iTid, Act: 'n'}})
+      addThreadNotice(iSvc, iTid, aIdx[0].Subject)
+   }
+   setSnooze(iSvc, iTid, "")
+   return true
+}
@@ -15,7 +15,7 @@ import (
    "sync"
 )
 
-var kSortDefault = tSummarySort{Cc:"Who", Atc:"Date", Upload:"Date", Form:"Date"}
+var kSortDefault = tSummarySort{Cc:"Who", Atc:"Date", Upload:"Date", Form:"Date", List:"LastDate"}
 var kSvcTabsDefault = []tTermEl{{"All",""}, {"Unread",""}, {"#Todo",""}}
 var kThreadTabsDefault = []tTermEl{{"Open",""}, {"All",""}}
 var kTabsStdService, kTabsStdThread string
@@ -65,7 +65,7 @@ func OpenState(iClientId, iSvc string) *ClientState {
                           SvcTabs: tTabs{Terms:[]tTermEl{}},
                           historyMax: GetConfigService(iSvc).HistoryLen,
                           id: iClientId, svc: iSvc, filePath: fileState(iClientId, iSvc)}
-   aFd, err := os.Open(aState.filePath)
+   aFd, err := openFile(aState.filePath)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
       err = os.Symlink("new_state", aState.filePath)
@@ -91,6 +91,7 @@ type ClientState struct {
    Thread map[string]*tThreadState // key thread id
    SvcTabs tTabs
    UploadSort, FormSort string `json:",omitempty"`
+   ListSort string `json:",omitempty"`
 }
 
 type tThreadState struct {
@@ -165,6 +166,7 @@ type tSummarySort struct {
    Atc    string `json:"al"`
    Upload string `json:"t"`
    Form   string `json:"f"`
+   List   string `json:"tl,omitempty"`
 }
 
 type tSummaryTabs struct {
@@ -183,6 +185,7 @@ func (o *ClientState) GetSummary() interface{} {
                     SvcTabs: tSummaryTabs{Type: eTabService, tTabs: *o.SvcTabs.copy(), Pinned: &aPinned} }
    if o.UploadSort != "" { aS.Sort.Upload = o.UploadSort }
    if o.FormSort   != "" { aS.Sort.Form   = o.FormSort }
+   if o.ListSort   != "" { aS.Sort.List   = o.ListSort }
 
    if o.Hpos >= 0 {
       aTs := o.Thread[o.History[o.Hpos]]
@@ -445,6 +448,7 @@ func (o *ClientState) setSort(iType string, iField string) {
    switch iType {
    case "t":  o.UploadSort                        = iField
    case "f":  o.FormSort                          = iField
+   case "tl": o.ListSort                          = iField
    case "cl": o.Thread[o.History[o.Hpos]].CcSort  = iField
    case "al": o.Thread[o.History[o.Hpos]].AtcSort = iField
    default:
@@ -454,6 +458,14 @@ func (o *ClientState) setSort(iType string, iField string) {
    if err != nil { quit(err) }
 }
 
+func (o *ClientState) getListSort() string {
+   o.RLock(); defer o.RUnlock()
+   if o.ListSort == "" {
+      return kSortDefault.List
+   }
+   return o.ListSort
+}
+
 func (o *ClientState) goLink(iLabel string, iThreadId, iMsgId string) {
    o.Lock(); defer o.Unlock()
    if o.Hpos < 0 || o.History[o.Hpos] != iThreadId {
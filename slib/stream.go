@@ -0,0 +1,230 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "fmt"
+   "io"
+   "net/http"
+   "os"
+   "path"
+   "sort"
+   "strconv"
+   "strings"
+   "sync"
+   "time"
+)
+
+// Audio & video attachments are registered while their message is received, so a client
+// can play one from its temp file. A reader waits for data until the file is complete.
+// Not done if a Scanner is set, as the file must be checked first.
+
+const kStreamPoll = 100 * time.Millisecond
+const kStreamKeep = 10 * time.Minute // after receipt ends, in case it's not stored or removed
+
+var kMediaType = map[string]string{
+   ".mp3":"audio/mpeg", ".m4a":"audio/mp4", ".aac":"audio/aac", ".flac":"audio/flac", ".wav":"audio/wav",
+   ".ogg":"audio/ogg", ".oga":"audio/ogg", ".opus":"audio/ogg", ".weba":"audio/webm",
+   ".mp4":"video/mp4", ".m4v":"video/mp4", ".webm":"video/webm", ".ogv":"video/ogg",
+   ".mov":"video/quicktime", ".mkv":"video/x-matroska",
+}
+
+var sStreamDoor sync.Mutex
+var sStreams = make(map[string]*tStream) // svc/msgid_file
+var sStreamFn func(string) // notifies clients of a service
+
+type tStream struct {
+   MsgId, ThreadId, Alias, Name, Type string
+   Size int64
+   Received int64 // set by GetIdxStream
+   svc, path string
+   done int8 // 0 receiving, 1 complete, -1 failed
+   ended time.Time
+}
+
+func SetNotifyStream(i func(string)) { sStreamFn = i }
+
+func _mediaType(iName string) string {
+   return kMediaType[strings.ToLower(path.Ext(iName))]
+}
+
+// beginStream registers an attachment about to be received, if it's media
+func beginStream(iSvc string, iHead *Header, iFile *tHeader2Attach, iPath string) *tStream {
+   aType := _mediaType(iFile.Name)
+   if aType == "" || sScanner != nil {
+      return nil
+   }
+   aTid := iHead.SubHead.ThreadId; if aTid == "" { aTid = iHead.Id }
+   aS := &tStream{MsgId: iHead.Id, ThreadId: aTid, Alias: iHead.SubHead.Alias, Name: iFile.Name,
+                  Type: aType, Size: iFile.Size, svc: iSvc, path: iPath}
+   sStreamDoor.Lock()
+   for aK, aOld := range sStreams {
+      if aOld.done != 0 && time.Since(aOld.ended) > kStreamKeep { delete(sStreams, aK) }
+   }
+   sStreams[iSvc +"/"+ iHead.Id +"_"+ escapeFile(iFile.Name)] = aS
+   sStreamDoor.Unlock()
+   if sStreamFn != nil {
+      sStreamFn(iSvc)
+   }
+   return aS
+}
+
+// endStream marks the end of receipt
+func endStream(iS *tStream, iOk bool) {
+   if iS == nil {
+      return
+   }
+   sStreamDoor.Lock()
+   iS.done = -1; if iOk { iS.done = 1 }
+   iS.ended = time.Now()
+   sStreamDoor.Unlock()
+   if sStreamFn != nil {
+      sStreamFn(iS.svc)
+   }
+}
+
+// storeStream points the attachments of a message to their stored paths, for readers
+// which started before the message was stored
+func storeStream(iSvc string, iRec tComplete) {
+   sStreamDoor.Lock(); defer sStreamDoor.Unlock()
+   for aK, aS := range sStreams {
+      if strings.HasPrefix(aK, iSvc +"/"+ iRec.mid() +"_") {
+         aS.path = fileAtc(iSvc, iRec.tid(), iRec.mid(), aS.Name)
+      }
+   }
+}
+
+// dropStream unregisters the attachments of a message which was removed
+func dropStream(iSvc string, iMsgId string) {
+   sStreamDoor.Lock(); defer sStreamDoor.Unlock()
+   for aK := range sStreams {
+      if strings.HasPrefix(aK, iSvc +"/"+ iMsgId +"_") { delete(sStreams, aK) }
+   }
+}
+
+func GetIdxStream(iSvc string) interface{} {
+   sStreamDoor.Lock(); defer sStreamDoor.Unlock()
+   aList := []tStream{}
+   for aK, aS := range sStreams {
+      if !strings.HasPrefix(aK, iSvc +"/") || aS.done != 0 { continue }
+      aEl := *aS
+      if aFi, err := os.Stat(aS.path); err == nil {
+         aEl.Received = sizeFile(aS.path, aFi)
+      }
+      aList = append(aList, aEl)
+   }
+   sort.Slice(aList, func(cA, cB int)bool { return aList[cA].MsgId +aList[cA].Name <
+                                                   aList[cB].MsgId +aList[cB].Name })
+   return aList
+}
+
+// ServeStreamAttach serves a stored attachment, or one being received, with range support
+func ServeStreamAttach(iResp http.ResponseWriter, iReq *http.Request, iSvc string, iState *ClientState,
+                       iMsgId string, iFile string) {
+   sStreamDoor.Lock()
+   aS := sStreams[iSvc +"/"+ iMsgId +"_"+ escapeFile(iFile)]
+   var aDone int8
+   var aPath string
+   if aS != nil { aDone, aPath = aS.done, aS.path }
+   sStreamDoor.Unlock()
+   var aFd *tFile
+   var err error
+   if aS != nil {
+      aFd, err = openFile(aPath)
+      if err != nil && !os.IsNotExist(err) { quit(err) }
+   }
+   if aFd == nil { // stored, or not found
+      aPath := GetPathAttach(iSvc, iState, iMsgId, iFile)
+      if aPath == "" {
+         http.NotFound(iResp, iReq)
+         return
+      }
+      ServeFile(iResp, iReq, aPath)
+      return
+   }
+   defer aFd.Close()
+   if aDone == 1 {
+      aFi, err := aFd.Stat()
+      if err != nil { quit(err) }
+      iResp.Header().Set("Content-Type", aS.Type)
+      http.ServeContent(iResp, iReq, path.Base(aPath), aFi.ModTime(), aFd)
+      return
+   }
+   aStart, aEnd, aOk := _parseRangeStream(iReq.Header.Get("Range"), aS.Size)
+   if !aOk {
+      iResp.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", aS.Size))
+      http.Error(iResp, "invalid range", http.StatusRequestedRangeNotSatisfiable)
+      return
+   }
+   iResp.Header().Set("Content-Type", aS.Type)
+   iResp.Header().Set("Accept-Ranges", "bytes")
+   iResp.Header().Set("Content-Length", strconv.FormatInt(aEnd - aStart, 10))
+   if aEnd - aStart < aS.Size {
+      iResp.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", aStart, aEnd-1, aS.Size))
+      iResp.WriteHeader(http.StatusPartialContent)
+   }
+   _, err = aFd.Seek(aStart, io.SeekStart)
+   if err != nil { quit(err) }
+   aBuf := make([]byte, 32 * 1024)
+   for aPos := aStart; aPos < aEnd; {
+      aLen, err := aFd.Read(aBuf[:_minStream(int64(len(aBuf)), aEnd - aPos)])
+      if aLen > 0 {
+         _, err = iResp.Write(aBuf[:aLen])
+         if err != nil { return } // client gone
+         aPos += int64(aLen)
+         continue
+      }
+      if err != nil && err != io.EOF { quit(err) }
+      sStreamDoor.Lock(); aDone = aS.done; sStreamDoor.Unlock()
+      if aDone < 0 || (aDone > 0 && _sizeStream(aFd) <= aPos) {
+         return // receipt failed, or file shorter than Size; client sees a short response
+      }
+      if aF, ok := iResp.(http.Flusher); ok { aF.Flush() }
+      select {
+      case <-iReq.Context().Done(): return
+      case <-time.After(kStreamPoll):
+      }
+   }
+}
+
+func _sizeStream(iFd *tFile) int64 {
+   aFi, err := iFd.Stat()
+   if err != nil { quit(err) }
+   return aFi.Size()
+}
+
+func _minStream(iA, iB int64) int64 { if iA < iB { return iA }; return iB }
+
+// _parseRangeStream handles a single "bytes=start-[end]" or "bytes=-suffix" range
+func _parseRangeStream(iRange string, iSize int64) (int64, int64, bool) {
+   if iRange == "" {
+      return 0, iSize, true
+   }
+   if !strings.HasPrefix(iRange, "bytes=") || strings.IndexByte(iRange, ',') >= 0 {
+      return 0, 0, false
+   }
+   aPair := strings.SplitN(iRange[6:], "-", 2)
+   if len(aPair) != 2 {
+      return 0, 0, false
+   }
+   aStart, errStart := strconv.ParseInt(strings.TrimSpace(aPair[0]), 10, 64)
+   aEnd, errEnd := strconv.ParseInt(strings.TrimSpace(aPair[1]), 10, 64)
+   switch {
+   case aPair[0] == "" && errEnd == nil: // suffix
+      if aEnd > iSize { aEnd = iSize }
+      return iSize - aEnd, iSize, aEnd > 0
+   case errStart != nil:
+      return 0, 0, false
+   case aPair[1] == "":
+      aEnd = iSize - 1
+   case errEnd != nil || aEnd < aStart:
+      return 0, 0, false
+   }
+   if aEnd >= iSize { aEnd = iSize - 1 }
+   return aStart, aEnd + 1, aStart < iSize
+}
@@ -0,0 +1,43 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "testing"
+)
+
+func TestParseRangeStream(i *testing.T) {
+   for _, aEl := range []struct {
+      rng string; size int64
+      start, end int64; ok bool
+   }{
+      {"",               100,   0, 100, true},
+      {"bytes=0-9",      100,   0,  10, true},
+      {"bytes=90-",      100,  90, 100, true},
+      {"bytes=95-200",   100,  95, 100, true},
+      {"bytes=99-99",    100,  99, 100, true},
+      {"bytes= 5 - 9",   100,   5,  10, true},
+      {"bytes=-10",      100,  90, 100, true},
+      {"bytes=-200",     100,   0, 100, true},
+      {"bytes=-0",       100, 100, 100, false},
+      {"bytes=100-",     100, 100, 100, false},
+      {"bytes=0-",         0,   0,   0, false},
+      {"bytes=5-2",      100,   0,   0, false},
+      {"bytes=0-1,5-6",  100,   0,   0, false},
+      {"items=0-1",      100,   0,   0, false},
+      {"bytes=x-1",      100,   0,   0, false},
+      {"bytes=1-x",      100,   0,   0, false},
+      {"bytes=1",        100,   0,   0, false},
+      {"bytes=-",        100,   0,   0, false},
+   } {
+      aStart, aEnd, aOk := _parseRangeStream(aEl.rng, aEl.size)
+      if aOk != aEl.ok || aOk && (aStart != aEl.start || aEnd != aEl.end) {
+         i.Errorf("_parseRangeStream(%q, %d) = %d, %d, %v", aEl.rng, aEl.size, aStart, aEnd, aOk)
+      }
+   }
+}
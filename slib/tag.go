@@ -52,6 +52,14 @@ func GetIdTag(iName string) string {
    return aVal
 }
 
+func hasIdTag(iId string) bool {
+   sTagsDoor.RLock(); defer sTagsDoor.RUnlock()
+   for _, aV := range sTags {
+      if aV == iId { return true }
+   }
+   return false
+}
+
 func makeIdTag() string {
    return dateRFC3339() //todo more robust unique id
 }
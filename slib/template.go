@@ -0,0 +1,174 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "io"
+   "encoding/json"
+   "os"
+   "sort"
+   "strings"
+   "time"
+   "net/url"
+)
+
+const kTemplateMax = 256 * 1024
+
+type tGlobalTemplate struct{} // implements GlobalSet
+var Template tGlobalTemplate
+
+type tTemplate struct {
+   Subject string
+   Body string // markdown; placeholders {{alias}}, {{subject}}, {{date}}
+   Attach []string `json:",omitempty"` // "upload/name" or "form/name"
+}
+
+type tTemplateEl struct {
+   Name string
+   Subject string
+   Date string
+}
+
+func initTemplates() {
+   aDir, err := readDirNames(kTemplateDir)
+   if err != nil { quit(err) }
+   for _, aFn := range aDir {
+      if strings.HasSuffix(aFn, ".tmp") {
+         err = os.Remove(kTemplateDir + aFn)
+         if err != nil { quit(err) }
+      } else if strings.HasSuffix(aFn, ".tok") {
+         aFn = aFn[:len(aFn)-4]
+         err = os.Remove(kTemplateDir + aFn)
+         if err != nil && !os.IsNotExist(err) { quit(err) }
+         err = os.Rename(kTemplateDir + aFn + ".tok", kTemplateDir + aFn)
+         if err != nil { quit(err) }
+      }
+   }
+}
+
+func (tGlobalTemplate) GetIdx() interface{} {
+   aDir, err := readDirFis(kTemplateDir)
+   if err != nil { quit(err) }
+   aList := make([]tTemplateEl, 0, len(aDir))
+   for _, aFi := range aDir {
+      if strings.ContainsRune(aFi.Name(), '.') { continue } // .tmp or .tok
+      var aTpl tTemplate
+      err = readJsonFile(&aTpl, kTemplateDir + aFi.Name())
+      if err != nil {
+         if os.IsNotExist(err) { continue } // dropped
+         quit(err)
+      }
+      aList = append(aList, tTemplateEl{Name:aFi.Name(), Subject:aTpl.Subject,
+                                        Date:aFi.ModTime().UTC().Format(time.RFC3339)})
+   }
+   sort.Slice(aList, func(cA, cB int) bool { return aList[cA].Name < aList[cB].Name })
+   return aList
+}
+
+func (tGlobalTemplate) GetPath(iName string) string {
+   return kTemplateDir + iName
+}
+
+func (tGlobalTemplate) Add(iName, iDupe string, iR io.Reader) error {
+   var err error
+   if iDupe != "" {
+      iName, iDupe = iDupe, iName
+   }
+   if !_validTemplate(iName) || iDupe != "" && !_validTemplate(iDupe) {
+      return tError("invalid template name")
+   }
+   var aTpl tTemplate
+   if iDupe != "" {
+      err = readJsonFile(&aTpl, kTemplateDir + iDupe)
+      if err != nil { return tError("source not found") }
+   } else {
+      err = json.NewDecoder(io.LimitReader(iR, kTemplateMax)).Decode(&aTpl)
+      if err != nil { return tError("invalid template: "+ err.Error()) }
+   }
+   for _, aAtc := range aTpl.Attach {
+      if !strings.HasPrefix(aAtc, "upload/") && !strings.HasPrefix(aAtc, "form/") {
+         return tError("template attachment must be upload/ or form/: "+ aAtc)
+      }
+   }
+   aPath := kTemplateDir + iName
+   aTemp := aPath + ".tmp"
+   aTempOk := aPath + ".tok"
+
+   err = writeJsonFile(aTemp, &aTpl)
+   if err != nil { quit(err) }
+   err = os.Rename(aTemp, aTempOk)
+   if err != nil { quit(err) }
+   err = syncDir(kTemplateDir)
+   if err != nil { quit(err) }
+   err = os.Remove(aPath)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   err = os.Rename(aTempOk, aPath)
+   if err != nil { quit(err) }
+   return nil
+}
+
+func (tGlobalTemplate) Drop(iName string) error {
+   if !_validTemplate(iName) {
+      return tError("invalid template name")
+   }
+   err := os.Remove(kTemplateDir + iName)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return tError("template not found: "+ iName)
+   }
+   return nil
+}
+
+// _validTemplate checks that a template name can't reach outside kTemplateDir
+func _validTemplate(iName string) bool {
+   return iName != "" && iName == url.QueryEscape(iName) && !strings.ContainsRune(iName, '.')
+}
+
+// applyTemplate fills iUpdt.Thread from a template for thread_save; iTid empty for new thread
+func applyTemplate(iSvc string, iTid string, iUpdt *Update) error {
+   if !_validTemplate(iUpdt.Thread.Template) {
+      return tError("invalid template name")
+   }
+   var aTpl tTemplate
+   err := readJsonFile(&aTpl, kTemplateDir + iUpdt.Thread.Template)
+   if err != nil { return tError("template not found: "+ iUpdt.Thread.Template) }
+
+   aAlias, aSubject := "", aTpl.Subject
+   if iTid != "" {
+      aIdx := getIndexThread(iSvc, iTid)
+      if aIdx == nil { return tError("thread not found") }
+      aSubject = aIdx[0].Subject
+      aUid := GetConfigService(iSvc).Uid
+      for a := len(aIdx)-1; a >= 0; a-- {
+         if aIdx[a].From != "" && aIdx[a].From != aUid {
+            aAlias = aIdx[a].Alias
+            break
+         }
+      }
+   } else {
+      if iUpdt.Thread.Subject != "" {
+         aSubject = iUpdt.Thread.Subject
+      }
+      for _, aCc := range iUpdt.Thread.Cc {
+         if aCc.Who != iUpdt.Thread.Alias {
+            aAlias = aCc.Who
+            break
+         }
+      }
+   }
+   aRp := strings.NewReplacer("{{alias}}", aAlias, "{{subject}}", aSubject,
+                              "{{date}}", time.Now().Format("2006-01-02"))
+   if iTid == "" {
+      iUpdt.Thread.Subject = aRp.Replace(aSubject)
+   }
+   iUpdt.Thread.Data = aRp.Replace(aTpl.Body)
+   for _, aAtc := range aTpl.Attach {
+      iUpdt.Thread.Attach = append(iUpdt.Thread.Attach, tHeader2Attach{Name: aAtc})
+   }
+   return nil
+}
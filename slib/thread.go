@@ -18,6 +18,8 @@ import (
    "strconv"
    "strings"
    "sync"
+   "time"
+   "unicode/utf8"
 )
 
 const kCcNoteMaxLen = 1024
@@ -37,6 +39,8 @@ type tIndexElCore struct {
    Seen string // mutable
    Tags []string `json:",omitempty"` // mutable
    ForwardBy string `json:",omitempty"` // mutable
+   E2e string `json:",omitempty"` // eE2eOk or kE2eFailed + reason, if received encrypted
+   Sign string `json:",omitempty"` // eSign*
 }
 
 const eSeenClear, eSeenLocal string = "!", "."
@@ -66,7 +70,7 @@ type tFwdEl struct {
 }
 
 func GetIdxThread(iSvc string, iState *ClientState) interface{} {
-   aIdx := []struct{ tIndexElCore; Queued bool }{}
+   aIdx := []struct{ tIndexElCore; Queued bool; Delivery tDlvSet `json:",omitempty"` }{}
    aTid := iState.getThread()
    if aTid == "" { return aIdx }
    func() {
@@ -74,7 +78,7 @@ func GetIdxThread(iSvc string, iState *ClientState) interface{} {
       cDoor.RLock(); defer cDoor.RUnlock()
       if cDoor.renamed { return }
 
-      cFd, err := os.Open(dirThread(iSvc) + aTid)
+      cFd, err := openFile(dirThread(iSvc) + aTid)
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
          return
@@ -85,6 +89,8 @@ func GetIdxThread(iSvc string, iState *ClientState) interface{} {
    for a, _ := range aIdx {
       if aIdx[a].From == "" {
          aIdx[a].Queued = hasQueue(iSvc, eSrecThread, aIdx[a].Id)
+      } else {
+         aIdx[a].Delivery = getDlv(iSvc, aIdx[a].Id)
       }
    }
    for a1, a2 := 0, len(aIdx)-1; a1 < a2; a1, a2 = a1+1, a2-1 {
@@ -109,7 +115,7 @@ func GetCcThread(iSvc string, iState *ClientState) interface{} {
       cDoor.RLock(); defer cDoor.RUnlock()
       if cDoor.renamed { return false }
 
-      cFd, err := os.Open(dirThread(iSvc) + aTid)
+      cFd, err := openFile(dirThread(iSvc) + aTid)
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
          return false
@@ -165,7 +171,7 @@ func WriteMessagesThread(iW io.Writer, iSvc string, iState *ClientState, iId str
    aDoor.RLock(); defer aDoor.RUnlock()
    if aDoor.renamed { return tError("thread name changed") }
 
-   aFd, err := os.Open(dirThread(iSvc) + aTid)
+   aFd, err := openFile(dirThread(iSvc) + aTid)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
       return tError("thread not found")
@@ -195,13 +201,13 @@ func WriteMessagesThread(iW io.Writer, iSvc string, iState *ClientState, iId str
          aBodyTotal += aIdx[a].Size - int64(4+aUi+1)
          if !aFound.hasTermBefore(aBodyTotal) { continue }
       } else if !iState.isOpen(aIdx[a].Id) { continue }
-      var aXd *os.File
+      var aXd *tFile
       if aIdx[a].Offset >= 0 {
          _, err = aFd.Seek(aIdx[a].Offset, io.SeekStart)
          if err != nil { quit(err) }
          aXd = aFd
       } else {
-         aXd, err = os.Open(dirThread(iSvc) + aIdx[a].Id)
+         aXd, err = openFile(dirThread(iSvc) + aIdx[a].Id)
          if err != nil { quit(err) }
          defer aXd.Close()
       }
@@ -229,7 +235,7 @@ func getAttachThread(iSvc string, iTid string, iIdx *[]tIndexElCore, iDir *[]os.
    if len(*iDir) == 0 {
       return os.ErrNotExist
    }
-   aFd, err := os.Open(dirThread(iSvc) + iTid)
+   aFd, err := openFile(dirThread(iSvc) + iTid)
    if err != nil { quit(err) }
    _readIndex(aFd, iIdx, nil)
    aFd.Close()
@@ -237,7 +243,7 @@ func getAttachThread(iSvc string, iTid string, iIdx *[]tIndexElCore, iDir *[]os.
 }
 
 func sendDraftThread(iW io.Writer, iSvc string, iDraftId, iId string) error {
-   aFd, err := os.Open(dirThread(iSvc) + iDraftId)
+   aFd, err := openFile(dirThread(iSvc) + iDraftId)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
       fmt.Fprintf(os.Stderr, "sendDraftThread %s: draft file was cleared %s\n", iSvc, iDraftId)
@@ -247,20 +253,32 @@ func sendDraftThread(iW io.Writer, iSvc string, iDraftId, iId string) error {
 
    aId := parseLocalId(iDraftId)
    aMh := _readMsgHead(aFd)
-   aCc := aMh.SubHead.Cc
-   if aCc == nil {
-      aDoor := _getThreadDoor(iSvc, aId.tid())
-      aDoor.RLock()
-      var aOfd *os.File
-      aOfd, err = os.Open(dirThread(iSvc) + aId.tid())
+   aCc := _getDraftCc(iSvc, aId, aMh)
+
+   sizeDraftAttach(iSvc, &aMh.SubHead, aId) // revs subhead
+   aMh.SubHead.Accept = kCodecAccept
+   defer dropWireAttach(iSvc, &aMh.SubHead, aId)
+   if !GetConfigService(iSvc).E2e {
+      deltaDraftAttach(iSvc, &aMh.SubHead, aId, aCc)
+   }
+   compressDraftAttach(iSvc, &aMh.SubHead, aId, aCc)
+   aAttachLen := totalAttach(&aMh.SubHead)
+   var aBuf1 []byte
+   if GetConfigService(iSvc).Sign {
+      aBuf1 = signMsg(iSvc, &aMh.SubHead, aId, aFd, aMh.Size)
+   } else {
+      aBuf1, err = json.Marshal(aMh.SubHead)
       if err != nil { quit(err) }
-      _readCc(aOfd, &aCc)
-      aOfd.Close(); aDoor.RUnlock()
    }
-
-   aAttachLen := sizeDraftAttach(iSvc, &aMh.SubHead, aId) // revs subhead
-   aBuf1, err := json.Marshal(aMh.SubHead)
-   if err != nil { quit(err) }
+   var aSeal *tE2eWriter
+   if GetConfigService(iSvc).E2e {
+      aBuf1, aSeal, err = sealE2e(iSvc, iW, aCc, &aMh.SubHead, aBuf1, aMh.Size)
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "sendDraftThread %s: %s cancelled, %v\n", iSvc, iDraftId, err)
+         return tSendError{tError("draft not sent: "+ err.Error())}
+      }
+      aAttachLen += sizeE2e(&aMh.SubHead, aMh.Size)
+   }
    aUid := GetConfigService(iSvc).Uid
    aFor := make([]tHeaderFor, 0, len(aCc)-1)
    for a := range aCc {
@@ -275,12 +293,48 @@ func sendDraftThread(iW io.Writer, iSvc string, iDraftId, iId string) error {
 
    err = writeHeaders(iW, aBuf0, aBuf1)
    if err != nil { return err }
-   _, err = io.CopyN(iW, aFd, aMh.Size) //todo only return network errors
+   var aW io.Writer = iW
+   if aSeal != nil { aW = aSeal }
+   _, err = io.CopyN(aW, aFd, aMh.Size) //todo only return network errors
    if err != nil { return err }
-   err = writeDraftAttach(iW, iSvc, &aMh.SubHead, aId, aFd)
+   err = writeDraftAttach(aW, iSvc, &aMh.SubHead, aId, aFd)
+   if err == nil && aSeal != nil {
+      err = aSeal.close()
+   }
    return err
 }
 
+// _getDraftCc returns the Cc of a draft, which is the thread's Cc for a reply
+func _getDraftCc(iSvc string, iId tLocalId, iMh *tMsgHead) []tCcEl {
+   aCc := iMh.SubHead.Cc
+   if aCc == nil {
+      aDoor := _getThreadDoor(iSvc, iId.tid())
+      aDoor.RLock(); defer aDoor.RUnlock()
+      aFd, err := openFile(dirThread(iSvc) + iId.tid())
+      if err != nil { quit(err) }
+      _readCc(aFd, &aCc)
+      aFd.Close()
+   }
+   return aCc
+}
+
+// getIndexThread returns the index of a thread, or nil if not found
+func getIndexThread(iSvc string, iTid string) []tIndexEl {
+   aDoor := _getThreadDoor(iSvc, iTid)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   if aDoor.renamed { return nil }
+
+   aFd, err := openFile(dirThread(iSvc) + iTid)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return nil
+   }
+   defer aFd.Close()
+   var aIdx []tIndexEl
+   _readIndex(aFd, &aIdx, nil)
+   return aIdx
+}
+
 func loadThread(iSvc string, iId string) tOpenState {
    if iId[0] == '_' {
       return tOpenState{iId:true}
@@ -290,7 +344,7 @@ func loadThread(iSvc string, iId string) tOpenState {
    if aDoor.renamed { quit(tError("unreachable")) }
 
    var aIdx []tIndexEl
-   aFd, err := os.Open(dirThread(iSvc) + iId)
+   aFd, err := openFile(dirThread(iSvc) + iId)
    if err != nil { quit(err) }
    defer aFd.Close()
    _ = _readIndex(aFd, &aIdx, nil)
@@ -308,6 +362,18 @@ func loadThread(iSvc string, iId string) tOpenState {
 
 func storeReceivedThread(iSvc string, iHead *Header, iR io.Reader) (string, error) {
    var err error
+   var aE2e *tE2eReader
+   if iHead.SubHead.E2e != nil && iHead.SubHead.E2e.Head != nil {
+      aE2e, err = openE2e(iSvc, iHead, iR) // revs iHead
+      if err != nil { return "", err }
+      iR = aE2e
+   }
+   aVerify := newSignVerifier(iHead)
+   iR = io.TeeReader(iR, aVerify)
+   if iHead.SubHead.Accept != nil {
+      addAcceptCodec(iSvc, iHead.From, iHead.SubHead.Accept)
+      iHead.SubHead.Accept = nil
+   }
    aThreadId := iHead.SubHead.ThreadId; if aThreadId == "" { aThreadId = iHead.Id }
    aMsgId := iHead.Id
    aOrig := dirThread(iSvc) + aThreadId
@@ -328,8 +394,21 @@ func storeReceivedThread(iSvc string, iHead *Header, iR io.Reader) (string, erro
       fmt.Fprintf(os.Stderr, "storeReceivedThread %s: invalid thread id %s\n", iSvc, aThreadId)
       return "", discardTmtp(iHead, iR)
    }
+   if hasTombService(iSvc, aThreadId) || hasTombService(iSvc, aMsgId) {
+      fmt.Fprintf(os.Stderr, "storeReceivedThread %s: msg %s was deleted\n", iSvc, aMsgId)
+      return "", discardTmtp(iHead, iR)
+   }
+   if iHead.From != GetConfigService(iSvc).Uid { // own sent copies aren't refused
+      err = checkQuota(iSvc, iHead.SubHead.Attach, iHead.DataLen - totalAttach(iHead.SubHead))
+      if err != nil {
+         fmt.Fprintf(os.Stderr, "storeReceivedThread %s: msg %s refused, %v\n", iSvc, aMsgId, err)
+         addQuotaNotice(iSvc, aMsgId, iHead.SubHead.Alias, iHead.SubHead.Subject, err.Error())
+         if errDc := discardTmtp(iHead, iR); errDc != nil { return "", errDc }
+         return "", err
+      }
+   }
 
-   var aTd, aFd *os.File
+   var aTd, aFd *tFile
    aIdx, aCc := []tIndexEl{{}}, []tCcEl{}
    var aPos, aCopyLen int64
    aEl := tIndexEl{tIndexElCore:tIndexElCore{Seen:eSeenClear}}
@@ -339,7 +418,7 @@ func storeReceivedThread(iSvc string, iHead *Header, iR io.Reader) (string, erro
    if iHead.From == GetConfigService(iSvc).Uid {
       aEl.Seen = eSeenLocal
    }
-   aTd, err = os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+   aTd, err = openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aTd.Close()
    fClean := func() {
@@ -365,6 +444,10 @@ func storeReceivedThread(iSvc string, iHead *Header, iR io.Reader) (string, erro
       fClean()
       return "", err
    }
+   if aE2e != nil {
+      aEl.E2e = aE2e.status()
+   }
+   aEl.Sign = aVerify.status(iSvc, iHead.From)
    aIncrUnread := aEl.Seen == ""
    if aThreadId == aMsgId {
       if aNewCc != nil { //todo handle invalid/missing SubHead.Cc
@@ -375,7 +458,7 @@ func storeReceivedThread(iSvc string, iHead *Header, iR io.Reader) (string, erro
    } else {
       aDoor := _getThreadDoor(iSvc, aThreadId)
       aDoor.Lock(); defer aDoor.Unlock()
-      aFd, err = os.OpenFile(aOrig, os.O_RDWR, 0600)
+      aFd, err = openFileFlags(aOrig, os.O_RDWR, 0600)
       if err != nil {
          fmt.Fprintf(os.Stderr, "storeReceivedThread %s: thread %s not found\n", iSvc, aThreadId)
          fClean()
@@ -448,11 +531,17 @@ func storeReceivedThread(iSvc string, iHead *Header, iR io.Reader) (string, erro
    if aIncrUnread {
       incrUnreadService(iSvc)
    }
+   if aCid == "" {
+      queueResendDelta(iSvc, iHead, aThreadId)
+   }
+   if aEl.Sign == eSignMismatch && aCid == "" {
+      addSignNotice(iSvc, aMsgId, iHead.SubHead.Alias, iHead.SubHead.Subject)
+   }
    aKind := "msg"; if aThreadId == aMsgId { aKind = "thread" }
    return aKind, nil
 }
 
-func _completeStoreConfirm(iSvc string, iTmp string, iFd, iTd *os.File, iHead *tMsgHead, iIdx []tIndexEl) {
+func _completeStoreConfirm(iSvc string, iTmp string, iFd, iTd *tFile, iHead *tMsgHead, iIdx []tIndexEl) {
    sCrashFn(iSvc, "store-confirm-thread")
 
    aRec := _parseFtmp(iTmp)
@@ -485,7 +574,7 @@ func _completeStoreConfirm(iSvc string, iTmp string, iFd, iTd *os.File, iHead *t
    if err != nil { quit(err) }
 }
 
-func _completeStoreReceived(iSvc string, iTmp string, iFd, iTd *os.File, iHead *tMsgHead, iCc []tCcEl) {
+func _completeStoreReceived(iSvc string, iTmp string, iFd, iTd *tFile, iHead *tMsgHead, iCc []tCcEl) {
    sCrashFn(iSvc, "store-received-thread")
 
    var err error
@@ -501,7 +590,7 @@ func _completeStoreReceived(iSvc string, iTmp string, iFd, iTd *os.File, iHead *
       if err != nil && !os.IsExist(err) { quit(err) }
       err = syncDir(dirThread(iSvc))
       if err != nil { quit(err) }
-      iFd, err = os.Open(dirThread(iSvc) + aRec.tid())
+      iFd, err = openFile(dirThread(iSvc) + aRec.tid())
       if err != nil { quit(err) }
       defer iFd.Close()
    } else {
@@ -529,12 +618,12 @@ func touchThread(iSvc string, iUpdt *Update) bool {
    if aDoor.renamed { return false }
 
    var err error
-   var aTd, aFd *os.File
+   var aTd, aFd *tFile
    aIdx, aCc := []tIndexEl{}, []tCcEl{}
    aIdxN := -1
    var aPos int64
 
-   aFd, err = os.OpenFile(aOrig, os.O_RDWR, 0600)
+   aFd, err = openFileFlags(aOrig, os.O_RDWR, 0600)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
       fmt.Printf("touchThread %s: threadid not found %s\n", iSvc, iUpdt.Touch.ThreadId)
@@ -545,11 +634,14 @@ func touchThread(iSvc string, iUpdt *Update) bool {
    for aIdxN = 0; aIdxN < len(aIdx); aIdxN++ {
       if aIdx[aIdxN].Id == iUpdt.Touch.MsgId { break }
    }
+   if iUpdt.Touch.Act == 'n' && iUpdt.Touch.MsgId == "" { // latest non-draft
+      for aIdxN = len(aIdx)-1; aIdxN > 0 && aIdx[aIdxN].From == ""; aIdxN-- {}
+   }
    if aIdxN == len(aIdx) {
       fmt.Printf("touchThread %s: msgid not found %s\n", iSvc, iUpdt.Touch.MsgId)
       return false
    }
-   aDecrUnread := false
+   aDecrUnread, aIncrUnread := false, false
    switch iUpdt.Touch.Act {
    case 's':
       if aIdx[aIdxN].Seen != "" {
@@ -563,6 +655,18 @@ func touchThread(iSvc string, iUpdt *Update) bool {
           }
       }
       aIdx[aIdxN].Seen = dateRFC3339()
+   case 'n':
+      if aIdx[aIdxN].Seen == "" {
+         return false
+      }
+      aIncrUnread = true
+      for a := range aIdx {
+          if aIdx[a].Seen == "" {
+             aIncrUnread = false
+             break
+          }
+      }
+      aIdx[aIdxN].Seen = ""
    case 't':
       for _, aTag := range aIdx[aIdxN].Tags {
          if aTag == iUpdt.Touch.TagId {
@@ -580,11 +684,11 @@ func touchThread(iSvc string, iUpdt *Update) bool {
       }
       aIdx[aIdxN].Tags = aIdx[aIdxN].Tags[:a + copy(aIdx[aIdxN].Tags[a:], aIdx[aIdxN].Tags[a+1:])]
    default:
-      quit(tError("unknown Update.Touch.Act: "+ string(iUpdt.Touch.Act)))
+      quit(tError("unknown Update.Touch.Act: "+ string(rune(iUpdt.Touch.Act))))
    }
    aTempOk += fmt.Sprint(aPos)
 
-   aTd, err = os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+   aTd, err = openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aTd.Close()
    _writeIndex(aTd, aIdx, aCc)
@@ -595,11 +699,13 @@ func touchThread(iSvc string, iUpdt *Update) bool {
    _completeTouch(iSvc, path.Base(aTempOk), aFd, aTd)
    if aDecrUnread {
       decrUnreadService(iSvc)
+   } else if aIncrUnread {
+      incrUnreadService(iSvc)
    }
    return true
 }
 
-func _completeTouch(iSvc string, iTmp string, iFd, iTd *os.File) {
+func _completeTouch(iSvc string, iTmp string, iFd, iTd *tFile) {
    sCrashFn(iSvc, "touch-thread")
 
    aRec := _parseFtmp(iTmp)
@@ -630,7 +736,7 @@ func storeSentThread(iSvc string, iHead *Header, iQid string) {
    aTempOk := ftmpSs(iSvc, aTid, iHead.MsgId, aId.lms())
    aTemp := aTempOk + ".tmp"
 
-   aSd, err := os.Open(aDraft)
+   aSd, err := openFile(aDraft)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
       fmt.Fprintf(os.Stderr, "storeSentThread %s: draft file was cleared %s\n", iSvc, iHead.Id)
@@ -646,7 +752,7 @@ func storeSentThread(iSvc string, iHead *Header, iQid string) {
       aDoor.renamed = true
    }
 
-   var aTd, aFd *os.File
+   var aTd, aFd *tFile
    aIdx, aCc := []tIndexEl{}, []tCcEl{}
    var aPos int64
    aEl := tIndexEl{}
@@ -666,7 +772,7 @@ func storeSentThread(iSvc string, iHead *Header, iQid string) {
       aCc = aHeadCc
       _revCc(aCc, iHead)
    } else {
-      aFd, err = os.OpenFile(aOrig, os.O_RDWR, 0600)
+      aFd, err = openFileFlags(aOrig, os.O_RDWR, 0600)
       if err != nil { quit(err) }
       defer aFd.Close()
       aPos = _readIndex(aFd, &aIdx, &aCc)
@@ -684,7 +790,7 @@ func storeSentThread(iSvc string, iHead *Header, iQid string) {
    aIdx = append(aIdx, *_setupIndexEl(&aEl, &aHead, aPos))
    aTempOk += fmt.Sprint(aPos)
 
-   aTd, err = os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+   aTd, err = openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aTd.Close()
    aMh, err = _writeMsg(aTd, &aHead, aSd, &aIdx[len(aIdx)-1])
@@ -698,7 +804,7 @@ func storeSentThread(iSvc string, iHead *Header, iQid string) {
    _completeStoreSent(iSvc, path.Base(aTempOk), aFd, aTd, aMh, aHeadCc, aIdx)
 }
 
-func _completeStoreSent(iSvc string, iTmp string, iFd, iTd *os.File, iHead *tMsgHead,
+func _completeStoreSent(iSvc string, iTmp string, iFd, iTd *tFile, iHead *tMsgHead,
                         iCc []tCcEl, iIdx []tIndexEl) { //todo drop iIdx when draft sync'd
    sCrashFn(iSvc, "store-sent-thread")
 
@@ -707,8 +813,18 @@ func _completeStoreSent(iSvc string, iTmp string, iFd, iTd *os.File, iHead *tMsg
    resolveReceivedAdrsbk(iSvc, iHead.Posted, iCc, aRec.tid(), nil)
    storeSentAttach(iSvc, &iHead.SubHead, aRec)
 
+   var aThreadCc []tCcEl
+   aTdPos, err := iTd.Seek(0, io.SeekCurrent)
+   if err != nil { quit(err) }
+   _readCc(iTd, &aThreadCc)
+   _, err = iTd.Seek(aTdPos, io.SeekStart)
+   if err != nil { quit(err) }
+   addSentDlv(iSvc, aRec.mid(), aThreadCc, iHead.Posted)
+
    aTid := ""; if aRec.tid() != aRec.mid() { aTid = aRec.tid() }
-   err := os.Remove(fileDraft(iSvc, aTid, aRec.lms()))
+   err = os.Remove(fileDraft(iSvc, aTid, aRec.lms()))
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   err = os.Remove(fileHist(iSvc, aTid, aRec.lms()))
    if err != nil && !os.IsNotExist(err) { quit(err) }
    if aTid == "" {
       deleteThreadSearch(iSvc, "_"+ aRec.lms())
@@ -721,18 +837,22 @@ func _completeStoreSent(iSvc string, iTmp string, iFd, iTd *os.File, iHead *tMsg
    _completeStoreReceived(iSvc, iTmp, iFd, iTd, &tMsgHead{}, nil)
 }
 
-func validateDraftThread(iSvc string, iUpdt *Update) error {
-   aId := parseLocalId(iUpdt.Thread.Id)
-   aFd, err := os.Open(fileDraft(iSvc, aId.tid(), aId.lms()))
+func validateDraftThread(iSvc string, iId string) error {
+   aId := parseLocalId(iId)
+   aFd, err := openFile(fileDraft(iSvc, aId.tid(), aId.lms()))
    if err != nil { quit(err) }
    defer aFd.Close()
    aMh := _readMsgHead(aFd)
    if aMh.SubHead.Subject == "" && aId.tid() == "" {
       return tError("subject missing")
    }
+   if GetConfigService(iSvc).E2e {
+      err = checkCcE2e(iSvc, _getDraftCc(iSvc, aId, aMh))
+      if err != nil { return err }
+   }
    _, err = aFd.Seek(aMh.Size, io.SeekCurrent)
    if err != nil { quit(err) }
-   err = validateDraftAttach(iSvc, &aMh.SubHead, aId, aFd)
+   err = validateDraftAttach(iSvc, &aMh.SubHead, aId, aFd, aMh.Size)
    return err
 }
 
@@ -751,7 +871,7 @@ func storeDraftThread(iSvc string, iUpdt *Update) bool {
    aDoor.Lock(); defer aDoor.Unlock()
    if aDoor.renamed { quit(tError("unexpected rename")) }
 
-   var aTd, aFd *os.File
+   var aTd, aFd *tFile
    aIdx, aCc := []tIndexEl{}, []tCcEl{}
    aIdxN := -1
    var aPos int64
@@ -760,8 +880,8 @@ func storeDraftThread(iSvc string, iUpdt *Update) bool {
 
    if aId.tid() == "" {
       iUpdt.Thread.Cc = _updateCc(iSvc, iUpdt.Thread.Cc, false)
-      var aSd *os.File
-      aSd, err = os.Open(aDraft)
+      var aSd *tFile
+      aSd, err = openFile(aDraft)
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
          aEl.Tags = []string{"Todo"}
@@ -773,7 +893,7 @@ func storeDraftThread(iSvc string, iUpdt *Update) bool {
       }
       aCc = iUpdt.Thread.Cc
    } else {
-      aFd, err = os.OpenFile(aOrig, os.O_RDWR, 0600)
+      aFd, err = openFileFlags(aOrig, os.O_RDWR, 0600)
       if err != nil { quit(err) }
       defer aFd.Close()
       aPos = _readIndex(aFd, &aIdx, &aCc)
@@ -794,7 +914,7 @@ func storeDraftThread(iSvc string, iUpdt *Update) bool {
    }
    aTempOk += fmt.Sprint(aPos)
 
-   aTd, err = os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+   aTd, err = openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aTd.Close()
    aHead := Header{Id:iUpdt.Thread.Id, From:"self", Posted:"draft", DataLen:int64(aData.Len()),
@@ -812,7 +932,7 @@ func storeDraftThread(iSvc string, iUpdt *Update) bool {
    return aNewSubjCc
 }
 
-func _completeStoreDraft(iSvc string, iTmp string, iFd, iTd *os.File, iHead *tMsgHead) {
+func _completeStoreDraft(iSvc string, iTmp string, iFd, iTd *tFile, iHead *tMsgHead) {
    sCrashFn(iSvc, "store-draft-thread")
 
    var err error
@@ -821,11 +941,14 @@ func _completeStoreDraft(iSvc string, iTmp string, iFd, iTd *os.File, iHead *tMs
    aTempOk := dirTemp(iSvc) + iTmp
 
    var aSubHeadOld *tHeader2
-   aSd, err := os.Open(aDraft)
+   aSd, err := openFile(aDraft)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
    } else {
       aSubHeadOld = &_readMsgHead(aSd).SubHead
+      if aRec.op() == "ws" {
+         _storeRevThread(iSvc, aRec, aSd, iTd)
+      }
       aSd.Close()
    }
    updateDraftAttach(iSvc, aSubHeadOld, &iHead.SubHead, aRec)
@@ -835,6 +958,9 @@ func _completeStoreDraft(iSvc string, iTmp string, iFd, iTd *os.File, iHead *tMs
    if aRec.op() == "ws" {
       err = os.Link(aTempOk, aDraft)
       if err != nil { quit(err) }
+   } else {
+      err = os.Remove(fileHist(iSvc, aRec.tid(), aRec.lms()))
+      if err != nil && !os.IsNotExist(err) { quit(err) }
    }
    err = syncDir(dirThread(iSvc))
    if err != nil { quit(err) }
@@ -872,12 +998,12 @@ func deleteDraftThread(iSvc string, iUpdt *Update) {
    aDoor.Lock(); defer aDoor.Unlock()
    if aDoor.renamed { quit(tError("unexpected rename")) }
 
-   var aTd, aFd *os.File
+   var aTd, aFd *tFile
    aIdx, aCc := []tIndexEl{}, []tCcEl{}
    var aPos int64
 
    if aId.tid() != "" {
-      aFd, err = os.OpenFile(aOrig, os.O_RDWR, 0600)
+      aFd, err = openFileFlags(aOrig, os.O_RDWR, 0600)
       if err != nil { quit(err) }
       defer aFd.Close()
       aPos = _readIndex(aFd, &aIdx, &aCc)
@@ -892,7 +1018,7 @@ func deleteDraftThread(iSvc string, iUpdt *Update) {
    }
    aTempOk += fmt.Sprint(aPos)
 
-   aTd, err = os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+   aTd, err = openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aTd.Close()
    _writeIndex(aTd, aIdx, aCc)
@@ -903,12 +1029,473 @@ func deleteDraftThread(iSvc string, iUpdt *Update) {
    _completeDeleteDraft(iSvc, path.Base(aTempOk), aFd, aTd)
 }
 
-func _completeDeleteDraft(iSvc string, iTmp string, iFd, iTd *os.File) {
+func _completeDeleteDraft(iSvc string, iTmp string, iFd, iTd *tFile) {
    sCrashFn(iSvc, "delete-draft-thread")
 
    _completeStoreDraft(iSvc, iTmp, iFd, iTd, &tMsgHead{})
 }
 
+// deleteMsgThread removes a sent or received message; returns nil if previously deleted
+func deleteMsgThread(iSvc string, iUpdt *Update) error {
+   aTid, aMid := iUpdt.Touch.ThreadId, iUpdt.Touch.MsgId
+   if aTid == "" || aTid[0] == '_' || aMid == aTid {
+      return tError("use thread_delete or thread_discard")
+   }
+   aOrig := dirThread(iSvc) + aTid
+   aTempOk := ftmpDm(iSvc, aTid, aMid)
+   aTemp := aTempOk + ".tmp"
+   var err error
+
+   aDoor := _getThreadDoor(iSvc, aTid)
+   aDoor.Lock(); defer aDoor.Unlock()
+   if aDoor.renamed { return tError("thread not found") }
+
+   var aTd, aFd *tFile
+   aIdx, aCc := []tIndexEl{}, []tCcEl{}
+   var aPos int64
+
+   aFd, err = openFileFlags(aOrig, os.O_RDWR, 0600)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      if iUpdt.log == 0 && !hasTombService(iSvc, aTid) { return tError("thread not found") }
+      addTombService(iSvc, aMid) // thread may arrive later from another node
+      return nil
+   }
+   defer aFd.Close()
+   aPos = _readIndex(aFd, &aIdx, &aCc)
+   aIdxN := -1
+   for a := range aIdx {
+      if aIdx[a].Id == aMid { aIdxN = a; break }
+   }
+   if aIdxN < 0 {
+      if iUpdt.log == 0 && !hasTombService(iSvc, aMid) { return tError("msgid not found") }
+      addTombService(iSvc, aMid) // msg may arrive later from another node
+      return nil
+   }
+   aEl := aIdx[aIdxN]
+   if aEl.Offset < 0 {
+      return tError("use thread_discard")
+   }
+   aDecrUnread := aEl.Seen == ""
+   for a := range aIdx {
+      if a != aIdxN && aIdx[a].Seen == "" { aDecrUnread = false }
+   }
+   addTombService(iSvc, aMid)
+
+   aTd, err = openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+   if err != nil { quit(err) }
+   defer aTd.Close()
+   _, err = aFd.Seek(aEl.Offset + aEl.Size, io.SeekStart)
+   if err != nil { quit(err) }
+   _, err = io.CopyN(aTd, aFd, aPos - aEl.Offset - aEl.Size)
+   if err != nil { quit(err) }
+   aIdx = aIdx[:aIdxN + copy(aIdx[aIdxN:], aIdx[aIdxN+1:])]
+   for a := range aIdx {
+      if aIdx[a].Offset > aEl.Offset {
+         aIdx[a].Offset -= aEl.Size
+      }
+   }
+   _writeIndex(aTd, aIdx, aCc)
+   aTempOk += fmt.Sprint(aEl.Offset)
+   err = os.Rename(aTemp, aTempOk)
+   if err != nil { quit(err) }
+   err = syncDir(dirTemp(iSvc))
+   if err != nil { quit(err) }
+   _, err = aFd.Seek(aEl.Offset, io.SeekStart)
+   if err != nil { quit(err) }
+   _completeDeleteMsg(iSvc, path.Base(aTempOk), aFd, aTd)
+   if aDecrUnread {
+      decrUnreadService(iSvc)
+   }
+   return nil
+}
+
+func _completeDeleteMsg(iSvc string, iTmp string, iFd, iTd *tFile) {
+   sCrashFn(iSvc, "delete-msg-thread")
+
+   aRec := _parseFtmp(iTmp)
+   aTempOk := dirTemp(iSvc) + iTmp
+
+   var err error
+   err = iFd.Truncate(aRec.pos())
+   if err != nil { quit(err) }
+   _, err = io.Copy(iFd, iTd) // iFd has correct pos from caller
+   if err != nil { quit(err) }
+   err = iFd.Sync()
+   if err != nil { quit(err) }
+   deleteMsgAttach(iSvc, aRec.tid(), aRec.mid())
+   blankRowsFilledForm(iSvc, []string{aRec.mid()})
+   dropThreadDlv(iSvc, []string{aRec.mid()})
+   _updateSearchDoc(iSvc, nil, aRec.tid(), iFd, nil)
+   err = os.Remove(aTempOk)
+   if err != nil { quit(err) }
+}
+
+// deleteThread removes a thread with its drafts; returns nil if previously deleted
+func deleteThread(iSvc string, iUpdt *Update) error {
+   aTid := iUpdt.Touch.ThreadId
+   if aTid == "" || aTid[0] == '_' {
+      return tError("use thread_discard")
+   }
+   aTempOk := ftmpDt(iSvc, aTid) + "0"
+   aTemp := aTempOk + ".tmp"
+   var err error
+
+   aDoor := _getThreadDoor(iSvc, aTid)
+   aDoor.Lock(); defer aDoor.Unlock()
+   if aDoor.renamed { return tError("thread not found") }
+
+   var aIdx []tIndexEl
+   aFd, err := openFile(dirThread(iSvc) + aTid)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      if iUpdt.log == 0 && !hasTombService(iSvc, aTid) { return tError("thread not found") }
+      addTombService(iSvc, aTid) // thread may arrive later from another node
+      return nil
+   }
+   _ = _readIndex(aFd, &aIdx, nil)
+   aFd.Close()
+   aMids := make([]string, 0, len(aIdx))
+   aDecrUnread := false
+   for a := range aIdx {
+      if aIdx[a].Offset >= 0 {
+         aMids = append(aMids, aIdx[a].Id)
+      }
+      aDecrUnread = aDecrUnread || aIdx[a].Seen == ""
+   }
+   addTombService(iSvc, aTid)
+
+   err = writeJsonFile(aTemp, aMids)
+   if err != nil { quit(err) }
+   err = os.Rename(aTemp, aTempOk)
+   if err != nil { quit(err) }
+   err = syncDir(dirTemp(iSvc))
+   if err != nil { quit(err) }
+   aDoor.renamed = true
+   aTd, err := openFile(aTempOk)
+   if err != nil { quit(err) }
+   defer aTd.Close()
+   _completeDeleteThread(iSvc, path.Base(aTempOk), aTd)
+   if aDecrUnread {
+      decrUnreadService(iSvc)
+   }
+   return nil
+}
+
+func _completeDeleteThread(iSvc string, iTmp string, iTd *tFile) {
+   sCrashFn(iSvc, "delete-thread")
+
+   aRec := _parseFtmp(iTmp)
+   aTempOk := dirTemp(iSvc) + iTmp
+
+   var err error
+   var aMids []string
+   err = json.NewDecoder(iTd).Decode(&aMids)
+   if err != nil { quit(err) }
+   aDir, err := readDirNames(dirThread(iSvc))
+   if err != nil { quit(err) }
+   for _, aFile := range aDir {
+      if aFile == aRec.tid() || strings.HasPrefix(aFile, aRec.tid() +"_") { // drafts, forward, history
+         err = os.Remove(dirThread(iSvc) + aFile)
+         if err != nil { quit(err) }
+      }
+   }
+   err = syncDir(dirThread(iSvc))
+   if err != nil { quit(err) }
+   deleteThreadAttach(iSvc, aRec.tid())
+   blankRowsFilledForm(iSvc, aMids)
+   dropThreadDlv(iSvc, aMids)
+   setSnooze(iSvc, aRec.tid(), "")
+   deleteThreadSearch(iSvc, aRec.tid())
+   err = os.Remove(aTempOk)
+   if err != nil { quit(err) }
+}
+
+const kDraftRevMax = 32
+
+type tDraftRev struct {
+   Date string // when the prior text was saved
+   Subject string
+   Checksum uint32 // of newer subject & text, to which Diff applies
+   Diff []tDiffEl
+}
+
+func GetRevsThread(iSvc string, iId string) interface{} {
+   type tRevEl struct { Rev int; Date, Subject string }
+   aList := []tRevEl{}
+   if !_checkDraftId(iId) {
+      return aList
+   }
+   aId := parseLocalId(iId)
+   aDoor := _getDraftDoor(iSvc, aId)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   if aDoor.renamed { return aList }
+
+   for a, aRev := range _loadRevThread(iSvc, aId) {
+      aList = append(aList, tRevEl{Rev:a, Date:aRev.Date, Subject:aRev.Subject})
+   }
+   return aList
+}
+
+func GetRevDiffThread(iSvc string, iIdRev string) (interface{}, error) {
+   aDot := strings.LastIndexByte(iIdRev, '.')
+   if aDot < 0 {
+      return nil, tError("missing revision")
+   }
+   aN, err := strconv.Atoi(iIdRev[aDot+1:])
+   if err != nil {
+      return nil, tError("invalid revision")
+   }
+   aMh, aRev, aText, err := _getRevThread(iSvc, iIdRev[:aDot], aN)
+   if err != nil {
+      return nil, err
+   }
+   aOld := splitLines(aText)
+   aNow, _ := _readDraftText(aMh)
+   return &struct { Rev int; Date, Subject, SubjectNow string; Diff []string }{
+             aN, aRev.Date, aRev.Subject, aMh.SubHead.Subject,
+             formatDiff(aOld, diffLines(aOld, splitLines(aNow))) }, nil
+}
+
+// GetQuoteThread takes msgid or msgid.start-end, with byte offsets into the message text
+func GetQuoteThread(iSvc string, iState *ClientState, iIdRange string) (interface{}, error) {
+   aText, err := _quoteMsgThread(iSvc, iState.getThread(), iIdRange)
+   if err != nil {
+      return nil, err
+   }
+   return &struct { Quote string }{aText}, nil
+}
+
+func setupQuoteThread(iSvc string, iState *ClientState, iUpdt *Update) error {
+   aText, err := _quoteMsgThread(iSvc, iState.getThread(), iUpdt.Thread.Quote)
+   if err != nil {
+      return err
+   }
+   iUpdt.Thread.New = 2 // reply
+   iUpdt.Thread.Cc = nil // from thread
+   iUpdt.Thread.Subject = ""
+   iUpdt.Thread.Data = aText + "\n\n" + iUpdt.Thread.Data
+   return nil
+}
+
+func _quoteMsgThread(iSvc string, iTid string, iIdRange string) (string, error) {
+   if iTid == "" || iTid[0] == '_' {
+      return "", tError("no sent thread open")
+   }
+   aMid, aStart, aEnd := iIdRange, 0, -1
+   if aDot := strings.IndexByte(iIdRange, '.'); aDot >= 0 {
+      aMid = iIdRange[:aDot]
+      _, err := fmt.Sscanf(iIdRange[aDot+1:], "%d-%d", &aStart, &aEnd)
+      if err != nil || aStart < 0 || aEnd < aStart {
+         return "", tError("invalid range")
+      }
+   }
+   aDoor := _getThreadDoor(iSvc, iTid)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   if aDoor.renamed { return "", tError("thread name changed") }
+
+   aFd, err := openFile(dirThread(iSvc) + iTid)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return "", tError("thread not found")
+   }
+   defer aFd.Close()
+   var aIdx []tIndexEl
+   _readIndex(aFd, &aIdx, nil)
+   a := 0
+   for a = 0; a < len(aIdx) && aIdx[a].Id != aMid; a++ {}
+   if a == len(aIdx) {
+      return "", tError("msg not found")
+   }
+   if aIdx[a].Offset < 0 {
+      return "", tError("cannot quote a draft")
+   }
+   _, err = aFd.Seek(aIdx[a].Offset, io.SeekStart)
+   if err != nil { quit(err) }
+   aMh := _readMsgHead(aFd)
+   aBuf := make([]byte, aMh.Size)
+   _, err = io.ReadFull(aFd, aBuf)
+   if err != nil { quit(err) }
+   if aEnd >= 0 {
+      if aEnd > len(aBuf) {
+         return "", tError("range exceeds message")
+      }
+      for aStart < aEnd && !utf8.RuneStart(aBuf[aStart]) { aStart++ }
+      for aEnd < len(aBuf) && !utf8.RuneStart(aBuf[aEnd]) { aEnd++ }
+      aBuf = aBuf[aStart:aEnd]
+   }
+   aWho := aIdx[a].Alias; if aWho == "" { aWho = aIdx[a].From }
+   aDate := aIdx[a].Date
+   if aT, err := time.Parse(time.RFC3339, aDate); err == nil {
+      aDate = aT.Local().Format("2006-01-02 15:04")
+   }
+   aLines := strings.Split(strings.TrimRight(string(aBuf), "\n"), "\n")
+   for a := range aLines {
+      if aLines[a] == "" || aLines[a][0] == '>' {
+         aLines[a] = ">" + aLines[a]
+      } else {
+         aLines[a] = "> " + aLines[a]
+      }
+   }
+   return fmt.Sprintf("On %s, %s wrote:\n%s", aDate, aWho, strings.Join(aLines, "\n")), nil
+}
+
+func setupRestoreThread(iSvc string, iUpdt *Update) error {
+   aMh, aRev, aText, err := _getRevThread(iSvc, iUpdt.Thread.Id, iUpdt.Thread.Rev)
+   if err != nil {
+      return err
+   }
+   _, aFill := _readDraftText(aMh)
+   iUpdt.Thread.New = 0
+   iUpdt.Thread.Alias = aMh.SubHead.Alias
+   iUpdt.Thread.Cc = aMh.SubHead.Cc
+   iUpdt.Thread.Subject = aRev.Subject
+   iUpdt.Thread.Data = aText
+   iUpdt.Thread.Attach = aMh.SubHead.Attach
+   iUpdt.Thread.FormFill = aFill
+   return nil
+}
+
+func _getRevThread(iSvc string, iId string, iN int) (*tDraftMsg, *tDraftRev, string, error) {
+   if !_checkDraftId(iId) {
+      return nil, nil, "", tError("invalid draft id")
+   }
+   aId := parseLocalId(iId)
+   aDoor := _getDraftDoor(iSvc, aId)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   if aDoor.renamed { return nil, nil, "", tError("draft was sent") }
+
+   aFd, err := openFile(fileDraft(iSvc, aId.tid(), aId.lms()))
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return nil, nil, "", tError("draft not found")
+   }
+   defer aFd.Close()
+   aMh := _readDraftMsg(aFd)
+   aRevs := _loadRevThread(iSvc, aId)
+   if iN < 0 || iN >= len(aRevs) {
+      return nil, nil, "", tError("revision not found")
+   }
+   aText, err := _walkRevThread(aMh.SubHead.Subject, aMh.text, aRevs[:iN+1])
+   if err != nil {
+      return nil, nil, "", err
+   }
+   return aMh, &aRevs[iN], aText, nil
+}
+
+// _walkRevThread applies revisions from newest to oldest, checking each against the text it
+// applies to; returns the oldest text
+func _walkRevThread(iSubject, iText string, iRevs []tDraftRev) (string, error) {
+   aLines := splitLines(iText)
+   for a := range iRevs {
+      if aLines == nil || _sumRev(iSubject, iText) != iRevs[a].Checksum {
+         return "", tError("revision history damaged")
+      }
+      aLines = patchLines(aLines, iRevs[a].Diff)
+      iSubject, iText = iRevs[a].Subject, strings.Join(aLines, "")
+   }
+   if aLines == nil {
+      return "", tError("revision history damaged")
+   }
+   return iText, nil
+}
+
+// _newRevThread makes the revision which restores an old subject & text from a new one
+func _newRevThread(iDate string, iOldSubject, iOldText, iNewSubject, iNewText string) tDraftRev {
+   return tDraftRev{Date: iDate, Subject: iOldSubject, Checksum: _sumRev(iNewSubject, iNewText),
+                    Diff: diffLines(splitLines(iNewText), splitLines(iOldText))}
+}
+
+func _storeRevThread(iSvc string, iRec tComplete, iSd, iTd *tFile) {
+   aOld := _readDraftMsg(iSd)
+   aNew := _readDraftMsg(iTd)
+   _, err := iTd.Seek(0, io.SeekStart)
+   if err != nil { quit(err) }
+   if aOld.text == aNew.text && aOld.SubHead.Subject == aNew.SubHead.Subject {
+      return
+   }
+   aSum := _sumRev(aNew.SubHead.Subject, aNew.text)
+   aPath := fileHist(iSvc, iRec.tid(), iRec.lms())
+   err = resolveTmpFile(aPath + ".tmp")
+   if err != nil { quit(err) }
+   var aRevs []tDraftRev
+   err = readJsonFile(&aRevs, aPath)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      err = os.Symlink("empty", aPath)
+      if err != nil && !os.IsExist(err) { quit(err) }
+   } else if len(aRevs) > 0 && aRevs[0].Checksum == aSum {
+      return // stored before crash
+   }
+   aFi, err := iSd.Stat()
+   if err != nil { quit(err) }
+   aRev := _newRevThread(aFi.ModTime().UTC().Format(time.RFC3339), aOld.SubHead.Subject, aOld.text,
+                         aNew.SubHead.Subject, aNew.text)
+   aRevs = append([]tDraftRev{aRev}, aRevs...)
+   if len(aRevs) > kDraftRevMax {
+      aRevs = aRevs[:kDraftRevMax]
+   }
+   err = storeFile(aPath, aRevs)
+   if err != nil { quit(err) }
+}
+
+func _loadRevThread(iSvc string, iId tLocalId) []tDraftRev {
+   var aRevs []tDraftRev
+   err := readJsonFile(&aRevs, fileHist(iSvc, iId.tid(), iId.lms()))
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   return aRevs
+}
+
+func _sumRev(iSubject, iText string) uint32 {
+   return crc32.Checksum([]byte(iSubject +"\x00"+ iText), kCrc32c)
+}
+
+func _checkDraftId(iId string) bool {
+   return len(iId) >= 13 && iId[len(iId)-13] == '_' && !strings.ContainsAny(iId, "/\\.")
+}
+
+func _getDraftDoor(iSvc string, iId tLocalId) *tThreadDoor {
+   aTid := iId.tid(); if aTid == "" { aTid = "_" + iId.lms() }
+   return _getThreadDoor(iSvc, aTid)
+}
+
+type tDraftMsg struct {
+   tMsgHead
+   text string
+   fill []byte // form fill data follows text
+}
+
+func _readDraftMsg(iFd *tFile) *tDraftMsg {
+   _, err := iFd.Seek(0, io.SeekStart)
+   if err != nil { quit(err) }
+   aMh := tDraftMsg{tMsgHead: *_readMsgHead(iFd)}
+   aBuf := make([]byte, aMh.Size)
+   _, err = io.ReadFull(iFd, aBuf)
+   if err != nil { quit(err) }
+   aMh.text = string(aBuf)
+   var aLen int64
+   for _, aFile := range aMh.SubHead.Attach {
+      if _isFormFill(aFile.Name) { aLen += aFile.Size }
+   }
+   if aLen > 0 {
+      aMh.fill = make([]byte, aLen)
+      _, err = io.ReadFull(iFd, aMh.fill)
+      if err != nil { quit(err) }
+   }
+   return &aMh
+}
+
+func _readDraftText(iMh *tDraftMsg) (string, map[string]string) {
+   aFill := map[string]string{}
+   var aPos int64
+   for _, aFile := range iMh.SubHead.Attach {
+      if !_isFormFill(aFile.Name) { continue }
+      aFill[aFile.FfKey] = string(iMh.fill[aPos:aPos+aFile.Size])
+      aPos += aFile.Size
+   }
+   return iMh.text, aFill
+}
+
 func sendFwdConfirmThread(iW io.Writer, iSvc string, iDraftId, iId string) error {
    const ( eTid = iota; eMid; eDate; eByUid )
    aRec := strings.SplitN(iDraftId, "_", eByUid+1)
@@ -916,7 +1503,7 @@ func sendFwdConfirmThread(iW io.Writer, iSvc string, iDraftId, iId string) error
    aDoor := _getThreadDoor(iSvc, aRec[eTid])
    aDoor.RLock(); defer aDoor.RUnlock()
 
-   aFd, err := os.Open(dirThread(iSvc) + aRec[eTid])
+   aFd, err := openFile(dirThread(iSvc) + aRec[eTid])
    if err != nil { quit(err) }
    defer aFd.Close()
 
@@ -995,7 +1582,7 @@ func sendFwdDraftThread(iW io.Writer, iSvc string, iDraftId, iId string) error {
    aDoor = _getThreadDoor(iSvc, aId.tid())
    aDoor.RLock(); defer aDoor.RUnlock()
 
-   aFd, err := os.Open(dirThread(iSvc) + aId.tid())
+   aFd, err := openFile(dirThread(iSvc) + aId.tid())
    if err != nil { quit(err) }
    defer aFd.Close()
 
@@ -1056,8 +1643,13 @@ func storeFwdReceivedThread(iSvc string, iHead *Header, iR io.Reader) error {
                              iSvc, iHead.SubHead.ThreadId)
       return discardTmtp(iHead, iR)
    }
+   if hasTombService(iSvc, iHead.SubHead.ThreadId) {
+      fmt.Fprintf(os.Stderr, "storeFwdReceivedThread %s: thread %s was deleted\n",
+                             iSvc, iHead.SubHead.ThreadId)
+      return discardTmtp(iHead, iR)
+   }
 
-   aTd, err := os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+   aTd, err := openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aTd.Close()
    _, err = io.CopyN(aTd, iR, iHead.DataLen)
@@ -1083,7 +1675,7 @@ func storeFwdReceivedThread(iSvc string, iHead *Header, iR io.Reader) error {
    return nil
 }
 
-func _completeStoreFwdReceived(iSvc string, iTmp string, iTd *os.File) {
+func _completeStoreFwdReceived(iSvc string, iTmp string, iTd *tFile) {
    sCrashFn(iSvc, "store-fwd-received-thread")
 
    aRec := _parseFtmp(iTmp)
@@ -1113,14 +1705,14 @@ func storeFwdNotifyThread(iSvc string, iHead *Header, iR io.Reader) error {
       return nil
    }
 
-   var aTd, aFd *os.File
+   var aTd, aFd *tFile
    aCc := []tCcEl{}
    var aPos, aLenIdx int64
 
    aDoor := _getThreadDoor(iSvc, iHead.SubHead.ThreadId)
    aDoor.Lock(); defer aDoor.Unlock()
 
-   aFd, err = os.OpenFile(aOrig, os.O_RDWR, 0600)
+   aFd, err = openFileFlags(aOrig, os.O_RDWR, 0600)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
       fmt.Fprintf(os.Stderr, "storeFwdNotifyThread %s: threadid %s not found, postid %s\n",
@@ -1132,7 +1724,7 @@ func storeFwdNotifyThread(iSvc string, iHead *Header, iR io.Reader) error {
    _, err = aFd.Seek(aPos, io.SeekStart)
    if err != nil { quit(err) }
 
-   aTd, err = os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+   aTd, err = openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aTd.Close()
    _revCc(iHead.SubHead.Cc, iHead)
@@ -1148,7 +1740,7 @@ func storeFwdNotifyThread(iSvc string, iHead *Header, iR io.Reader) error {
    return nil
 }
 
-func _completeStoreFwdNotify(iSvc string, iTmp string, iFd, iTd *os.File, iCc []tCcEl) {
+func _completeStoreFwdNotify(iSvc string, iTmp string, iFd, iTd *tFile, iCc []tCcEl) {
    sCrashFn(iSvc, "store-fwd-notify-thread")
 
    aRec := _parseFtmp(iTmp)
@@ -1204,18 +1796,18 @@ func storeFwdSentThread(iSvc string, iHead *Header, iQid string) {
    aDoor = _getThreadDoor(iSvc, aId.tid())
    aDoor.Lock(); defer aDoor.Unlock()
 
-   var aTd, aFd *os.File
+   var aTd, aFd *tFile
    aCc := []tCcEl{}
    var aPos, aLenIdx int64
 
-   aFd, err = os.OpenFile(aOrig, os.O_RDWR, 0600)
+   aFd, err = openFileFlags(aOrig, os.O_RDWR, 0600)
    if err != nil { quit(err) }
    defer aFd.Close()
    aPos, aLenIdx = _readCc(aFd, &aCc)
    _, err = aFd.Seek(aPos, io.SeekStart)
    if err != nil { quit(err) }
 
-   aTd, err = os.OpenFile(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+   aTd, err = openFileFlags(aTemp, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
    if err != nil { quit(err) }
    defer aTd.Close()
    _revCc(aFwd[0].Cc, iHead)
@@ -1230,7 +1822,7 @@ func storeFwdSentThread(iSvc string, iHead *Header, iQid string) {
    _completeStoreFwdSent(iSvc, path.Base(aTempOk), aFd, aTd, aCc, len(aFwd)-1)
 }
 
-func _completeStoreFwdSent(iSvc string, iTmp string, iFd, iTd *os.File, iCc []tCcEl, iFwdN int) {
+func _completeStoreFwdSent(iSvc string, iTmp string, iFd, iTd *tFile, iCc []tCcEl, iFwdN int) {
    sCrashFn(iSvc, "store-fwd-sent-thread")
 
    aRec := _parseFtmp(iTmp)
@@ -1260,7 +1852,7 @@ func _completeStoreFwdSent(iSvc string, iTmp string, iFd, iTd *os.File, iCc []tC
    _finishStoreFwd(iSvc, iTmp, iFd, iTd, iCc)
 }
 
-func _finishStoreFwd(iSvc string, iTmp string, iFd, iTd *os.File, iCc []tCcEl) {
+func _finishStoreFwd(iSvc string, iTmp string, iFd, iTd *tFile, iCc []tCcEl) {
    aRec := _parseFtmp(iTmp)
    var err error
 
@@ -1312,7 +1904,7 @@ func storeFwdDraftThread(iSvc string, iUpdt *Update) {
    var aCcOrig []tCcEl
    aDoor := _getThreadDoor(iSvc, iUpdt.Forward.ThreadId)
    aDoor.RLock()
-   aFd, err := os.Open(dirThread(iSvc) + iUpdt.Forward.ThreadId)
+   aFd, err := openFile(dirThread(iSvc) + iUpdt.Forward.ThreadId)
    if err != nil { quit(err) }
    _readCc(aFd, &aCcOrig)
    aFd.Close(); aDoor.RUnlock()
@@ -1350,7 +1942,7 @@ func _getFwd(iSvc string, iTid string, iOpt string) []tFwdEl {
       iOpt = ""
    }
    var aFwd []tFwdEl
-   aFd, err := os.Open(aPath)
+   aFd, err := openFile(aPath)
    if err != nil {
       if iOpt == "exist" || !os.IsNotExist(err) { quit(err) }
       if iOpt == "" {
@@ -1409,7 +2001,7 @@ func _revCc(iCc []tCcEl, iHead *Header) {
    }
 }
 
-/*func _updateUnread(iSvc string, iTid string, iFd *os.File) {
+/*func _updateUnread(iSvc string, iTid string, iFd *tFile) {
    var aIdx []tIndexEl
    _readIndex(iFd, &aIdx, nil)
    aUnread := false
@@ -1419,7 +2011,22 @@ func _revCc(iCc []tCcEl, iHead *Header) {
    updateUnreadSearch(iSvc, iTid, aUnread)
 }*/
 
-func _updateSearchDoc(iSvc string, iCfg *tSvcConfig, iTid string, iFd *os.File, iI tIndexer) {
+// indexThread updates the search index for a thread, e.g. after its attachments are scanned
+func indexThread(iSvc string, iTid string) {
+   aDoor := _getThreadDoor(iSvc, iTid)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   if aDoor.renamed { return }
+
+   aFd, err := openFile(dirThread(iSvc) + iTid)
+   if err != nil {
+      if os.IsNotExist(err) { return }
+      quit(err)
+   }
+   defer aFd.Close()
+   _updateSearchDoc(iSvc, nil, iTid, aFd, nil)
+}
+
+func _updateSearchDoc(iSvc string, iCfg *tSvcConfig, iTid string, iFd *tFile, iI tIndexer) {
    if iCfg == nil {
       iCfg = GetConfigService(iSvc)
    }
@@ -1427,7 +2034,7 @@ func _updateSearchDoc(iSvc string, iCfg *tSvcConfig, iTid string, iFd *os.File,
    var aIdx []tIndexEl
    var aCc []tCcEl
    _readIndex(iFd, &aIdx, &aCc)
-   aDoc := &tSearchDoc{id: iTid, OrigDate: aIdx[0].Date, OrigAuthor: aIdx[0].Alias}
+   aDoc := &tSearchDoc{id: iTid, uid: iCfg.Uid, OrigDate: aIdx[0].Date, OrigAuthor: aIdx[0].Alias}
    if aIdx[0].From == "" {
       aDoc.OrigAuthor = iCfg.Alias
    }
@@ -1462,21 +2069,134 @@ func _updateSearchDoc(iSvc string, iCfg *tSvcConfig, iTid string, iFd *os.File,
       aDoc.LastSubjectN = a
       break
    }
+   aDoc.SubjectKey = strings.ToLower(aSubj)
    aDoc.bodyStream = _newThreadStream(iSvc, aIdx, iFd)
    indexThreadSearch(iSvc, aDoc, iI)
 }
 
+type tSnippet struct {
+   MsgId string
+   Parts []string // alternating plain & matched text
+}
+
+const kSnippetMax = 3 // per thread
+const kSnippetPad = 48 // bytes of context on each side
+
+// snippetThread extracts text around term sites in the thread body seen by the search index,
+// given as sorted [start, end) offsets, as read by _newThreadStream
+func snippetThread(iSvc string, iTid string, iSites [][2]int64) []tSnippet {
+   aDoor := _getThreadDoor(iSvc, iTid)
+   aDoor.RLock(); defer aDoor.RUnlock()
+   if aDoor.renamed { return nil }
+
+   aFd, err := openFile(dirThread(iSvc) + iTid)
+   if err != nil {
+      if os.IsNotExist(err) { return nil }
+      quit(err)
+   }
+   defer aFd.Close()
+   var aIdx []tIndexEl
+   _readIndex(aFd, &aIdx, nil)
+   if len(aIdx) == 1 && aIdx[0].Offset < 0 {
+      aIdx[0].Offset = 0
+   }
+   sort.SliceStable(aIdx, func(cA, cB int) bool { return aIdx[cA].Offset >= 0 && aIdx[cB].Offset < 0 })
+   aList := []tSnippet{}
+   aBuf := make([]byte, 4)
+   var aEnd int64 // body end within stream
+   for a := range aIdx {
+      if len(iSites) == 0 || len(aList) == kSnippetMax {
+         break
+      }
+      aMd, aPos := aFd, aIdx[a].Offset
+      if aPos < 0 {
+         aMd, err = openFile(dirThread(iSvc) + aIdx[a].Id)
+         if err != nil { quit(err) }
+         defer aMd.Close()
+         aPos = 0
+      }
+      _, err = aMd.Seek(aPos, io.SeekStart)
+      if err != nil { quit(err) }
+      _, err = io.ReadFull(aMd, aBuf)
+      if err != nil { quit(err) }
+      aUi, _ := strconv.ParseUint(string(aBuf), 16, 0)
+      aHeadLen := 4 + int64(aUi) + 1
+      aStart := aEnd
+      aEnd += aIdx[a].Size - aHeadLen
+      fRead := func(cFrom, cTo int64) []byte {
+         cText := make([]byte, cTo - cFrom)
+         _, err = aMd.Seek(aPos + aHeadLen + cFrom - aStart, io.SeekStart)
+         if err != nil { quit(err) }
+         _, err = io.ReadFull(aMd, cText)
+         if err != nil { quit(err) }
+         return cText
+      }
+      aList = append(aList, _snippetBody(aIdx[a].Id, aStart, aEnd, &iSites, kSnippetMax - len(aList), fRead)...)
+   }
+   return aList
+}
+
+// _snippetBody extracts up to iMax snippets for the sites in a message body at [iStart, iEnd)
+// of the stream, consuming sites through iEnd; iRead returns the body text at [from, to)
+func _snippetBody(iMsgId string, iStart, iEnd int64, iSites *[][2]int64, iMax int,
+                  iRead func(int64, int64) []byte) []tSnippet {
+   aSites := *iSites
+   var aList []tSnippet
+   for len(aSites) > 0 && aSites[0][0] < iEnd && len(aList) < iMax {
+      aFrom := aSites[0][0] - kSnippetPad; if aFrom < iStart { aFrom = iStart }
+      aTo := aSites[0][1] + kSnippetPad; if aTo > iEnd { aTo = iEnd }
+      aText := iRead(aFrom, aTo)
+      aSn := tSnippet{MsgId: iMsgId}
+      aAt := aFrom
+      for len(aSites) > 0 && aSites[0][1] <= aTo {
+         if aSites[0][0] < aAt { // overlaps prior site
+            aSites = aSites[1:]
+            continue
+         }
+         aSn.Parts = append(aSn.Parts, string(aText[aAt-aFrom : aSites[0][0]-aFrom]),
+                                       string(aText[aSites[0][0]-aFrom : aSites[0][1]-aFrom]))
+         aAt = aSites[0][1]
+         aSites = aSites[1:]
+      }
+      aSn.Parts = append(aSn.Parts, string(aText[aAt-aFrom:]))
+      aHead, aTail := &aSn.Parts[0], &aSn.Parts[len(aSn.Parts)-1]
+      if aS := strings.IndexAny(*aHead, " \t\n"); aFrom > iStart && aS >= 0 {
+         *aHead = (*aHead)[aS+1:] // drop partial word
+      }
+      if aS := strings.LastIndexAny(*aTail, " \t\n"); aTo < iEnd && aS >= 0 {
+         *aTail = (*aTail)[:aS]
+      }
+      *aHead, *aTail = strings.ToValidUTF8(*aHead, ""), strings.ToValidUTF8(*aTail, "")
+      aList = append(aList, aSn)
+      for len(aSites) > 0 && aSites[0][0] < aAt { // overlaps last fragment
+         aSites = aSites[1:]
+      }
+   }
+   for len(aSites) > 0 && aSites[0][0] < iEnd { // beyond iMax
+      aSites = aSites[1:]
+   }
+   *iSites = aSites
+   return aList
+}
+
 type tThreadStream struct {
    bufHead []byte
    svc string
    idx []tIndexEl
    a int
-   fd *os.File
+   fd *tFile
    pos int64
    draft *tThreadStream
+   attach bool // a message has attachments
+   atc []tStreamAtc // attachments, except in drafts
+}
+
+type tStreamAtc struct {
+   msgId, from string
+   file tHeader2Attach
 }
 
-func _newThreadStream(iSvc string, iIdx []tIndexEl, iFd *os.File) *tThreadStream {
+func _newThreadStream(iSvc string, iIdx []tIndexEl, iFd *tFile) *tThreadStream {
    o := &tThreadStream{svc: iSvc, idx: iIdx, fd: iFd, bufHead: make([]byte, 4)}
    _, err := iFd.Seek(0, io.SeekStart)
    if err != nil { quit(err) }
@@ -1502,12 +2222,13 @@ func (o *tThreadStream) Read(iBuf []byte) (int, error) { // for io.Reader
       if o.draft == nil {
          o.draft = &tThreadStream{bufHead: o.bufHead, idx: []tIndexEl{o.idx[o.a]}}
          o.draft.idx[0].Offset = 0
-         o.draft.fd, err = os.Open(dirThread(o.svc) + o.idx[o.a].Id)
+         o.draft.fd, err = openFile(dirThread(o.svc) + o.idx[o.a].Id)
          if err != nil { quit(err) }
       }
       aLen, err = o.draft.Read(iBuf)
       if err != nil {
          if err != io.EOF { quit(err) }
+         o.attach = o.attach || o.draft.attach
          o.draft.fd.Close()
          o.draft = nil
          o.a++
@@ -1519,7 +2240,17 @@ func (o *tThreadStream) Read(iBuf []byte) (int, error) { // for io.Reader
       _, err = o.fd.Read(o.bufHead)
       if err != nil { quit(err) }
       aUi, _ := strconv.ParseUint(string(o.bufHead), 16, 0)
-      o.pos, err = o.fd.Seek(int64(aUi)+1, io.SeekCurrent)
+      aHead := make([]byte, aUi)
+      _, err = io.ReadFull(o.fd, aHead)
+      if err != nil { quit(err) }
+      var aMh tMsgHead
+      err = json.Unmarshal(aHead, &aMh)
+      if err != nil { quit(err) }
+      for _, aFile := range aMh.SubHead.Attach {
+         o.attach = o.attach || !_isFormFill(aFile.Name)
+         o.atc = append(o.atc, tStreamAtc{msgId: aMh.Id, from: aMh.From, file: aFile})
+      }
+      o.pos, err = o.fd.Seek(1, io.SeekCurrent)
       if err != nil { quit(err) }
    }
    aMax := o.idx[o.a].Offset + o.idx[o.a].Size - o.pos
@@ -1545,7 +2276,7 @@ type tMsgHead struct {
    SubHead tHeader2
 }
 
-func _readMsgHead(iFd *os.File) *tMsgHead {
+func _readMsgHead(iFd *tFile) *tMsgHead {
    var aHead tMsgHead
    aBuf := make([]byte, 65536)
    _, err := iFd.Read(aBuf[:4])
@@ -1565,7 +2296,7 @@ func _readMsgHead(iFd *os.File) *tMsgHead {
    return &aHead
 }
 
-func _readIndex(iFd *os.File, iIdx, iCc interface{}) int64 {
+func _readIndex(iFd *tFile, iIdx, iCc interface{}) int64 {
    aLenIdx, aLenCc := _readTail(iFd)
    aPos, err := iFd.Seek(-16 - aLenIdx - aLenCc, io.SeekEnd)
    if err != nil { quit(err) }
@@ -1589,7 +2320,7 @@ func _readIndex(iFd *os.File, iIdx, iCc interface{}) int64 {
    return aPos
 }
 
-func _readCc(iFd *os.File, iCc interface{}) (int64, int64) {
+func _readCc(iFd *tFile, iCc interface{}) (int64, int64) {
    aLenIdx, aLenCc := _readTail(iFd)
    aBuf := make([]byte, aLenCc)
    aPos, err := iFd.Seek(-16 - aLenCc, io.SeekEnd)
@@ -1601,7 +2332,7 @@ func _readCc(iFd *os.File, iCc interface{}) (int64, int64) {
    return aPos, aLenIdx
 }
 
-func _readTail(iFd *os.File) (int64, int64) {
+func _readTail(iFd *tFile) (int64, int64) {
    aBuf := make([]byte, 16)
    _, err := iFd.Seek(-16, io.SeekEnd)
    if err != nil { quit(err) }
@@ -1615,7 +2346,7 @@ func _readTail(iFd *os.File) (int64, int64) {
    return int64(aLenIdx), int64(aLenCc)
 }
 
-func _writeIndex(iTd *os.File, iIdx []tIndexEl, iCc []tCcEl) {
+func _writeIndex(iTd *tFile, iIdx []tIndexEl, iCc []tCcEl) {
    aBuf, err := json.Marshal(iIdx)
    if err != nil { quit(err) }
    _, err = iTd.Write(aBuf)
@@ -1623,7 +2354,7 @@ func _writeIndex(iTd *os.File, iIdx []tIndexEl, iCc []tCcEl) {
    _writeCc(iTd, iCc, int64(len(aBuf)))
 }
 
-func _writeCc(iTd *os.File, iCc []tCcEl, iLenIdx int64) {
+func _writeCc(iTd *tFile, iCc []tCcEl, iLenIdx int64) {
    aBuf, err := json.Marshal(iCc)
    if err != nil { quit(err) }
    _, err = iTd.Write(append(aBuf, fmt.Sprintf("%08x%08x", iLenIdx, len(aBuf))...))
@@ -1634,7 +2365,7 @@ func _writeCc(iTd *os.File, iCc []tCcEl, iLenIdx int64) {
    if err != nil { quit(err) }
 }
 
-func _writeMsg(iTd *os.File, iHead *Header, iR io.Reader, iEl *tIndexEl) (*tMsgHead, error) {
+func _writeMsg(iTd *tFile, iHead *Header, iR io.Reader, iEl *tIndexEl) (*tMsgHead, error) {
    var err error
    var aCw tCrcWriter
    aTee := io.MultiWriter(iTd, &aCw)
@@ -1643,6 +2374,16 @@ func _writeMsg(iTd *os.File, iHead *Header, iR io.Reader, iEl *tIndexEl) (*tMsgH
       return nil, tError("attachment size total exceeds DataLen for msgid "+ iHead.Id)
    }
    aHead := tMsgHead{Id:iHead.Id, From:iHead.From, Posted:iHead.Posted, Size:aSize, SubHead:*iHead.SubHead}
+   for a := range aHead.SubHead.Attach {
+      if aHead.SubHead.Attach[a].Codec != "" { // drop wire fields
+         aHead.SubHead.Attach = append([]tHeader2Attach{}, aHead.SubHead.Attach...)
+         for a = range aHead.SubHead.Attach {
+            aHead.SubHead.Attach[a].Codec, aHead.SubHead.Attach[a].WireSize = "", 0
+            aHead.SubHead.Attach[a].Delta = nil
+         }
+         break
+      }
+   }
    aBuf, err := json.Marshal(aHead)
    if err != nil { quit(err) }
    aLen, err := aTee.Write([]byte(fmt.Sprintf("%04x", len(aBuf))))
@@ -1672,12 +2413,12 @@ func _writeMsg(iTd *os.File, iHead *Header, iR io.Reader, iEl *tIndexEl) (*tMsgH
 }
 
 type tDraftless struct {
-   fd *os.File
+   fd *tFile
    bufIdx, bufCc []byte
    pos int64
 }
 
-func newDraftlessThread(iFd *os.File) *tDraftless {
+func newDraftlessThread(iFd *tFile) *tDraftless {
    o := tDraftless{fd:iFd}
    var aIdx []tIndexEl
    var aCc []tCcEl
@@ -1743,8 +2484,8 @@ func completeThread(iSvc string, iTempOk string) {
       return
    }
    var err error
-   var aFd, aTd *os.File
-   aTd, err = os.Open(dirTemp(iSvc) + iTempOk)
+   var aFd, aTd *tFile
+   aTd, err = openFile(dirTemp(iSvc) + iTempOk)
    if err != nil {
       if !os.IsNotExist(err) { quit(err) }
       fmt.Printf("complete %s already removed\n", iTempOk)
@@ -1754,7 +2495,7 @@ func completeThread(iSvc string, iTempOk string) {
    fmt.Printf("complete %s\n", iTempOk)
    if aRec.op() == "sc" || aRec.op() == "nr" || aRec.tid() != "" && aRec.tid() != aRec.mid() {
       aTid := aRec.tid(); if aTid == "" { aTid = "_"+ aRec.lms() }
-      aFd, err = os.OpenFile(dirThread(iSvc) + aTid, os.O_RDWR, 0600)
+      aFd, err = openFileFlags(dirThread(iSvc) + aTid, os.O_RDWR, 0600)
       if err != nil { quit(err) }
       defer aFd.Close()
       _, err = aFd.Seek(aRec.pos(), io.SeekStart)
@@ -1795,6 +2536,8 @@ func completeThread(iSvc string, iTempOk string) {
    case "fn": _completeStoreFwdNotify  (iSvc, iTempOk, aFd, aTd, fCc("fwd"))
    case "fs": _completeStoreFwdSent    (iSvc, iTempOk, aFd, aTd, fCc("fwd"), fFwdSent())
    case "nr": _completeTouch           (iSvc, iTempOk, aFd, aTd)
+   case "dm": _completeDeleteMsg       (iSvc, iTempOk, aFd, aTd)
+   case "dt": _completeDeleteThread    (iSvc, iTempOk,      aTd)
    default:
       fmt.Fprintf(os.Stderr, "completeThread: unexpected op %s%s\n", dirTemp(iSvc), iTempOk)
    }
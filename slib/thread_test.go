@@ -0,0 +1,77 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "reflect"
+   "strings"
+   "testing"
+)
+
+func TestSnippetBody(i *testing.T) {
+   const kStart = 100 // body follows another in the stream
+   for _, aEl := range []struct {
+      body string
+      sites [][2]int64 // relative to body
+      max int
+      want [][]string
+      left int // sites not consumed
+   }{
+      {"find the needle here", [][2]int64{{9,15}}, 3,
+       [][]string{{"find the ", "needle", " here"}}, 0},
+      {strings.Repeat("abcd ", 20) +"needle"+ strings.Repeat(" wxyz", 20), [][2]int64{{100,106}}, 3,
+       [][]string{{strings.Repeat("abcd ", 9), "needle", strings.Repeat(" wxyz", 9)}}, 0},
+      {"a needle and a pin", [][2]int64{{2,8}, {4,10}, {15,18}}, 3,
+       [][]string{{"a ", "needle", " and a ", "pin", ""}}, 0},
+      {strings.Repeat("€", 30) +"a"+ "needle", [][2]int64{{91,97}}, 3,
+       [][]string{{strings.Repeat("€", 15) +"a", "needle", ""}}, 0},
+      {strings.Repeat("x ", 200), [][2]int64{{0,1}, {100,101}, {200,201}, {300,301}, {400,401}}, 2,
+       [][]string{{"", "x", strings.Repeat(" x", 23)},
+                  {strings.Repeat("x ", 23), "x", strings.Repeat(" x", 23)}}, 1},
+   } {
+      aBody := []byte(aEl.body)
+      aEnd := kStart + int64(len(aBody))
+      aSites := make([][2]int64, len(aEl.sites))
+      for a := range aEl.sites {
+         aSites[a] = [2]int64{aEl.sites[a][0] + kStart, aEl.sites[a][1] + kStart}
+      }
+      fRead := func(cFrom, cTo int64) []byte {
+         if cFrom < kStart || cTo > aEnd || cFrom > cTo {
+            i.Fatalf("read [%d, %d) outside body [%d, %d)", cFrom, cTo, kStart, aEnd)
+         }
+         return aBody[cFrom-kStart : cTo-kStart]
+      }
+      aList := _snippetBody("m", kStart, aEnd, &aSites, aEl.max, fRead)
+      var aGot [][]string
+      for _, aSn := range aList {
+         if aSn.MsgId != "m" {
+            i.Errorf("snippet MsgId %s", aSn.MsgId)
+         }
+         aGot = append(aGot, aSn.Parts)
+      }
+      if !reflect.DeepEqual(aGot, aEl.want) {
+         i.Errorf("_snippetBody(%.20q...) = %q", aEl.body, aGot)
+      }
+      if len(aSites) != aEl.left {
+         i.Errorf("_snippetBody(%.20q...) left sites %v", aEl.body, aSites)
+      }
+   }
+}
+
+func TestSnippetBodyNext(i *testing.T) {
+   aSites := [][2]int64{{2,5}, {12,15}}
+   aList := _snippetBody("m", 0, 10, &aSites, 3, func(cFrom, cTo int64) []byte {
+      return []byte("0123456789"[cFrom:cTo])
+   })
+   if len(aList) != 1 || !reflect.DeepEqual(aList[0].Parts, []string{"01", "234", "56789"}) {
+      i.Errorf("_snippetBody() = %q", aList)
+   }
+   if len(aSites) != 1 || aSites[0] != [2]int64{12,15} {
+      i.Errorf("_snippetBody() consumed a site of the next message: %v", aSites)
+   }
+}
@@ -0,0 +1,185 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "fmt"
+   "image"
+   "image/gif"
+   "image/jpeg"
+   "image/png"
+   "io"
+   "os"
+   "path"
+   "strings"
+   "sync"
+)
+
+// Thumbnails of image attachments & uploads are cached in thumb/ trees which mirror the
+// attach/ & upload/ trees. They're made when a file is stored, or when requested if missing
+// or older than the file, e.g. on a new node.
+
+const kThumbSize = 160 // pixels, longest side
+const kThumbPixelMax = 40 * 1000 * 1000 // larger images aren't decoded
+
+var kThumbExt = map[string]string{".png":"png", ".jpg":"jpeg", ".jpeg":"jpeg", ".gif":"gif"}
+
+var sThumbDoor sync.Mutex
+
+func _isThumb(iName string) bool {
+   return kThumbExt[strings.ToLower(path.Ext(iName))] != ""
+}
+
+// makeThumbAttach makes thumbnails for the stored attachments of a message
+func makeThumbAttach(iSvc string, iSubHead *tHeader2, iRec tComplete) {
+   for _, aFile := range iSubHead.Attach {
+      if _isFormFill(aFile.Name) || !_isThumb(aFile.Name) { continue }
+      if isQuarantined(iSvc, fileAtc(iSvc, iRec.tid(), iRec.mid(), aFile.Name)) { continue }
+      sThumbDoor.Lock()
+      _makeThumb(fileAtc(iSvc, iRec.tid(), iRec.mid(), aFile.Name),
+                 fileThumb(iSvc, iRec.tid(), iRec.mid(), aFile.Name))
+      sThumbDoor.Unlock()
+   }
+}
+
+// dropThumbAttach removes the thumbnails in thumb/iSub/ starting with iPrefix, or all if empty
+func dropThumbAttach(iSvc string, iSub string, iPrefix string) {
+   if iPrefix == "" {
+      err := os.RemoveAll(dirThumb(iSvc) + iSub)
+      if err != nil { quit(err) }
+      return
+   }
+   aDir, err := readDirNames(dirThumb(iSvc) + iSub)
+   if err != nil {
+      if os.IsNotExist(err) { return }
+      quit(err)
+   }
+   for _, aFn := range aDir {
+      if !strings.HasPrefix(aFn, iPrefix) { continue }
+      err = os.Remove(dirThumb(iSvc) + iSub +"/"+ aFn)
+      if err != nil && !os.IsNotExist(err) { quit(err) }
+   }
+}
+
+func GetPathThumbAttach(iSvc string, iState *ClientState, iMsgId string, iFile string) string {
+   if strings.HasPrefix(iFile, "upload/") {
+      return Upload.GetPathThumb(iFile[7:])
+   }
+   aTid := iState.getThread()
+   if isQuarantined(iSvc, fileAtc(iSvc, aTid, iMsgId, iFile)) {
+      return ""
+   }
+   return _getThumb(fileAtc(iSvc, aTid, iMsgId, iFile), fileThumb(iSvc, aTid, iMsgId, iFile))
+}
+
+func (tGlobalUpload) GetPathThumb(iId string) string {
+   return _getThumb(fileUpload(iId), fileUpthumb(iId))
+}
+
+// _getThumb returns the thumbnail path for a file, making it if needed; "" if none
+func _getThumb(iSrc, iDst string) string {
+   if !_isThumb(iSrc) {
+      return ""
+   }
+   aSi, err := os.Stat(iSrc)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return ""
+   }
+   sThumbDoor.Lock(); defer sThumbDoor.Unlock()
+   aDi, err := os.Stat(iDst)
+   if err == nil && !aDi.ModTime().Before(aSi.ModTime()) {
+      return iDst
+   }
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   if !_makeThumb(iSrc, iDst) {
+      return ""
+   }
+   return iDst
+}
+
+// _makeThumb writes a thumbnail of iSrc to iDst; returns false if iSrc isn't a usable image
+// caller must hold sThumbDoor
+func _makeThumb(iSrc, iDst string) bool {
+   aFd, err := openFile(iSrc)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return false
+   }
+   defer aFd.Close()
+   aCfg, _, err := image.DecodeConfig(aFd)
+   if err == nil && (aCfg.Width < 1 || aCfg.Height < 1 || aCfg.Width * aCfg.Height > kThumbPixelMax) {
+      err = tError(fmt.Sprintf("size %dx%d unsupported", aCfg.Width, aCfg.Height))
+   }
+   var aImg image.Image
+   if err == nil {
+      _, err = aFd.Seek(0, io.SeekStart)
+      if err != nil { quit(err) }
+      aImg, _, err = image.Decode(aFd)
+   }
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "_makeThumb: %s %v\n", iSrc, err)
+      return false
+   }
+   aThumb := _scaleThumb(aImg)
+
+   err = os.MkdirAll(path.Dir(iDst), 0700)
+   if err != nil { quit(err) }
+   aTemp := iDst + ".tmp"
+   err = os.Remove(aTemp)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   aTd, err := openFileFlags(aTemp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+   if err != nil { quit(err) }
+   switch kThumbExt[strings.ToLower(path.Ext(iSrc))] {
+   case "jpeg": err = jpeg.Encode(aTd, aThumb, &jpeg.Options{Quality: 80})
+   case "gif":  err = gif.Encode(aTd, aThumb, nil)
+   default:     err = png.Encode(aTd, aThumb)
+   }
+   if err != nil { quit(err) }
+   err = aTd.Sync()
+   if err != nil { quit(err) }
+   aTd.Close()
+   err = os.Rename(aTemp, iDst)
+   if err != nil { quit(err) }
+   return true
+}
+
+// _scaleThumb shrinks an image to fit kThumbSize by averaging the pixels under each new pixel
+func _scaleThumb(iImg image.Image) *image.NRGBA {
+   aB := iImg.Bounds()
+   aW, aH := aB.Dx(), aB.Dy()
+   aTw, aTh := aW, aH
+   if aW >= aH && aW > kThumbSize {
+      aTw, aTh = kThumbSize, aH * kThumbSize / aW
+   } else if aH > aW && aH > kThumbSize {
+      aTw, aTh = aW * kThumbSize / aH, kThumbSize
+   }
+   if aTw < 1 { aTw = 1 }
+   if aTh < 1 { aTh = 1 }
+   aSum := make([]uint64, aTw * aTh * 5) // premultiplied r, g, b, a, count
+   for aY := 0; aY < aH; aY++ {
+      aRow := aY * aTh / aH * aTw
+      for aX := 0; aX < aW; aX++ {
+         aR, aG, aBl, aA := iImg.At(aB.Min.X + aX, aB.Min.Y + aY).RGBA()
+         aS := aSum[(aRow + aX * aTw / aW) * 5:]
+         aS[0] += uint64(aR); aS[1] += uint64(aG); aS[2] += uint64(aBl); aS[3] += uint64(aA)
+         aS[4]++
+      }
+   }
+   aOut := image.NewNRGBA(image.Rect(0, 0, aTw, aTh))
+   for a := 0; a < aTw * aTh; a++ {
+      aS := aSum[a*5:]
+      if aS[4] == 0 || aS[3] == 0 { continue } // transparent
+      aP := aOut.Pix[a*4:]
+      aP[0] = uint8(aS[0] * 0xff / aS[3])
+      aP[1] = uint8(aS[1] * 0xff / aS[3])
+      aP[2] = uint8(aS[2] * 0xff / aS[3])
+      aP[3] = uint8(aS[3] / aS[4] >> 8)
+   }
+   return aOut
+}
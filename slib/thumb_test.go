@@ -0,0 +1,64 @@
+// Copyright 2019 Liam Breck
+// Published at https://github.com/networkimprov/mnm-hammer
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/
+
+package slib
+
+import (
+   "image"
+   "image/color"
+   "testing"
+)
+
+func TestScaleThumbSize(i *testing.T) {
+   for _, aEl := range []struct { w, h, tw, th int }{
+      {400, 200, kThumbSize, kThumbSize/2},
+      {200, 400, kThumbSize/2, kThumbSize},
+      {kThumbSize, kThumbSize, kThumbSize, kThumbSize},
+      {10, 5, 10, 5},
+      {1000, 1, kThumbSize, 1},
+      {1, 1000, 1, kThumbSize},
+   } {
+      aImg := image.NewNRGBA(image.Rect(0, 0, aEl.w, aEl.h))
+      aB := _scaleThumb(aImg).Bounds()
+      if aB.Dx() != aEl.tw || aB.Dy() != aEl.th {
+         i.Errorf("_scaleThumb(%dx%d) = %dx%d", aEl.w, aEl.h, aB.Dx(), aB.Dy())
+      }
+   }
+}
+
+func TestScaleThumbPixels(i *testing.T) {
+   aRed := color.NRGBA{0xff, 0, 0, 0xff}
+   aImg := image.NewNRGBA(image.Rect(10, 20, 10 + 3*kThumbSize, 20 + kThumbSize)) // offset origin
+   for aY := aImg.Rect.Min.Y; aY < aImg.Rect.Max.Y; aY++ {
+      for aX := aImg.Rect.Min.X; aX < aImg.Rect.Max.X; aX++ {
+         aImg.Set(aX, aY, aRed)
+      }
+   }
+   aOut := _scaleThumb(aImg)
+   for _, aP := range [][2]int{{0, 0}, {kThumbSize-1, kThumbSize/3-1}, {kThumbSize/2, 10}} {
+      if aC := aOut.NRGBAAt(aP[0], aP[1]); aC != aRed {
+         i.Errorf("_scaleThumb() pixel %v = %v", aP, aC)
+      }
+   }
+
+   // columns alternate opaque white & transparent; each result pixel averages a pair
+   aImg = image.NewNRGBA(image.Rect(0, 0, 2*kThumbSize, 2))
+   for aX := 0; aX < 2*kThumbSize; aX += 2 {
+      aImg.Set(aX, 0, color.White)
+      aImg.Set(aX, 1, color.White)
+   }
+   aOut = _scaleThumb(aImg)
+   if aOut.Bounds().Dy() != 1 {
+      i.Fatalf("_scaleThumb() height %d", aOut.Bounds().Dy())
+   }
+   if aC := aOut.NRGBAAt(kThumbSize/2, 0); aC != (color.NRGBA{0xff, 0xff, 0xff, 0x7f}) {
+      i.Errorf("_scaleThumb() blended pixel = %v", aC)
+   }
+   if aC := _scaleThumb(image.NewNRGBA(image.Rect(0, 0, 4, 4))).NRGBAAt(1, 1); aC != (color.NRGBA{}) {
+      i.Errorf("_scaleThumb() transparent pixel = %v", aC)
+   }
+}
@@ -8,9 +8,15 @@
 package slib
 
 import (
+   "crypto/rand"
+   "crypto/sha256"
+   "encoding/hex"
+   "fmt"
    "io"
    "os"
    "sort"
+   "strings"
+   "sync"
    "time"
 )
 
@@ -21,25 +27,72 @@ func initUpload() {
    aFiles, err := readDirNames(kUploadTmp)
    if err != nil { quit(err) }
    for _, aFn := range aFiles {
+      if aFn == "part" { continue }
       err = renameRemove(kUploadTmp + aFn, kUploadDir + aFn)
       if err != nil { quit(err) }
    }
+   _expirePart()
+   err = resolveTmpFile(kUploadStat + ".tmp")
+   if err != nil { quit(err) }
+   err = readJsonFile(&sUploadStat, kUploadStat)
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      err = writeJsonFile(kUploadStat, sUploadStat)
+      if err != nil { quit(err) }
+      err = syncDir(kStorageDir)
+      if err != nil { quit(err) }
+   }
+   time.AfterFunc(kUploadSweepDelay, _runSweepUpload)
+}
+
+// Uploads attached to a sent message, and not attached to a draft, are dropped after
+// sUploadSentExpiry unless pinned. An upload is considered sent when its contents match a blob,
+// which a sent attachment is linked to; the date that's first seen is kept in kUploadStat.
+
+const kUploadSweepDelay = 3 * time.Minute
+const kUploadSweepPeriod = 6 * time.Hour
+
+var sUploadSentExpiry = 30 * 24 * time.Hour // 0 to keep
+var sUploadDoor sync.Mutex
+var sUploadStat = map[string]tUploadStat{} // escaped name
+
+type tUploadStat struct {
+   Sent string `json:",omitempty"`
+   Pinned bool `json:",omitempty"`
+   Sum string `json:",omitempty"` // sha256 of contents, to match blobs
 }
 
+func SetSentExpiryUpload(iPeriod time.Duration) { sUploadSentExpiry = iPeriod }
+
 type tUploadEl struct {
    Name string
    Size int64
    Date string
+   Thumb bool `json:",omitempty"`
+   Status string `json:",omitempty"` // unsent, draft, sent
+   Pinned bool `json:",omitempty"`
+   Expires string `json:",omitempty"`
 }
 
 func (tGlobalUpload) GetIdx() interface{} {
+   aUse := _statusUpload()
    aDir, err := readDirFis(kUploadDir)
    if err != nil { quit(err) }
-   aList := make([]tUploadEl, 0, len(aDir)-1) // omit temp/
+   aList := make([]tUploadEl, 0, len(aDir)-2) // omit temp/ & thumb/
+   sUploadDoor.Lock(); defer sUploadDoor.Unlock()
    for _, aFi := range aDir {
-      if aFi.Name() == "temp" { continue }
-      aList = append(aList, tUploadEl{Name:unescapeFile(aFi.Name()), Size:aFi.Size(),
-                                      Date:aFi.ModTime().UTC().Format(time.RFC3339)})
+      if aFi.Name() == "temp" || aFi.Name() == "thumb" { continue }
+      aEl := tUploadEl{Name:unescapeFile(aFi.Name()), Size:sizeFile(kUploadDir + aFi.Name(), aFi),
+                       Date:aFi.ModTime().UTC().Format(time.RFC3339),
+                       Thumb:_isThumb(aFi.Name()), Status:aUse[aFi.Name()],
+                       Pinned:sUploadStat[aFi.Name()].Pinned}
+      if aEl.Status == "" {
+         aEl.Status = "unsent"
+      }
+      if aExp := _expiresUpload(aFi.Name(), aEl.Status); !aExp.IsZero() {
+         aEl.Expires = aExp.UTC().Format(time.RFC3339)
+      }
+      aList = append(aList, aEl)
    }
    sort.Slice(aList, func(cA, cB int)bool { return aList[cA].Name < aList[cB].Name })
    return aList
@@ -49,8 +102,13 @@ func (tGlobalUpload) GetPath(iId string) string {
    return fileUpload(iId)
 }
 
+// _validUpload checks that a filename doesn't name one of the directories in kUploadDir
+func _validUpload(iId string) bool {
+   return iId != "" && iId != ".." && iId != "." && iId != "temp" && iId != "thumb"
+}
+
 func (tGlobalUpload) Add(iId, iDup string, iR io.Reader) error {
-   if iId == "" || iId == ".." || iId == "." {
+   if !_validUpload(iId) {
       return tError("missing or invalid filename")
    }
    if iDup != "" && iDup[0] != '.' { //todo iDup as base of new name with ext from iId
@@ -66,8 +124,8 @@ func (tGlobalUpload) Add(iId, iDup string, iR io.Reader) error {
       if err != nil { quit(err) }
    }
    if iDup != "" {
-      var aDfd *os.File
-      aDfd, err = os.Open(fileUpload(iId))
+      var aDfd *tFile
+      aDfd, err = openFile(fileUpload(iId))
       if err != nil {
          if !os.IsNotExist(err) { quit(err) }
          return err
@@ -79,19 +137,425 @@ func (tGlobalUpload) Add(iId, iDup string, iR io.Reader) error {
    if err != nil { return err }
    err = syncDir(kUploadTmp)
    if err != nil { quit(err) }
+   if iDup == "" {
+      errScan := scanUpload(aTemp, iId)
+      if errScan != nil {
+         err = os.Remove(aTemp)
+         if err != nil { quit(err) }
+         err = os.Remove(aOrig)
+         if err != nil { quit(err) }
+         err = syncDir(kUploadDir)
+         if err != nil { quit(err) }
+         return errScan
+      }
+   }
    err = os.Remove(aOrig)
    if err != nil { quit(err) }
    err = os.Rename(aTemp, aOrig)
    if err != nil { quit(err) }
+   _resetStatUpload(iId + iDup)
+   if _isThumb(iId + iDup) {
+      sThumbDoor.Lock()
+      _makeThumb(aOrig, fileUpthumb(iId + iDup))
+      sThumbDoor.Unlock()
+   }
    return nil
 }
 
 func (tGlobalUpload) Drop(iId string) error {
-   if iId == "" {
-      return tError("missing filename")
+   if !_validUpload(iId) {
+      return tError("missing or invalid filename")
    }
    err := os.Remove(fileUpload(iId))
    if err != nil && !os.IsNotExist(err) { quit(err) }
+   errThumb := os.Remove(fileUpthumb(iId))
+   if errThumb != nil && !os.IsNotExist(errThumb) { quit(errThumb) }
+   sUploadDoor.Lock()
+   if _, aHas := sUploadStat[escapeFile(iId)]; aHas {
+      delete(sUploadStat, escapeFile(iId))
+      _storeStatUpload()
+   }
+   sUploadDoor.Unlock()
    return err
 }
 
+// Pin keeps an upload from being dropped once sent
+func (tGlobalUpload) Pin(iId string, iPin bool) error {
+   if !_validUpload(iId) {
+      return tError("missing or invalid filename")
+   }
+   _, err := os.Lstat(fileUpload(iId))
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return err
+   }
+   sUploadDoor.Lock(); defer sUploadDoor.Unlock()
+   aStat := sUploadStat[escapeFile(iId)]
+   if aStat.Pinned == iPin {
+      return nil
+   }
+   aStat.Pinned = iPin
+   sUploadStat[escapeFile(iId)] = aStat
+   _storeStatUpload()
+   return nil
+}
+
+// _statusUpload finds the uploads linked to drafts in all services, and those whose contents
+// match a blob, i.e. a sent (or received) attachment, and records the date each is first seen sent
+func _statusUpload() map[string]string {
+   var aSvcs []string
+   sServicesDoor.RLock()
+   for aK := range sServices {
+      aSvcs = append(aSvcs, aK)
+   }
+   sServicesDoor.RUnlock()
+   aUse := map[string]string{} // escaped name -> status
+   aBlobs := map[string]bool{} // sha256
+   for _, aSvc := range aSvcs {
+      aS := getService(aSvc)
+      aS.RLock()
+      for _, aSum := range aS.blobRef {
+         aBlobs[aSum] = true
+      }
+      aS.RUnlock()
+      aList := _getAttachInodes(aSvc)
+      for aStart := 0; aStart < len(aList); {
+         aEnd := aStart + 1
+         for ; aEnd < len(aList) && aList[aEnd].inode == aList[aStart].inode; aEnd++ {}
+         var aUp []string
+         aStatus := ""
+         for _, aEl := range aList[aStart:aEnd] {
+            if strings.HasPrefix(aEl.path, kNodeFlagUpload) {
+               aUp = append(aUp, aEl.path[len(kNodeFlagUpload):])
+            } else if strings.HasPrefix(aEl.path, "blob/") {
+               continue
+            } else if aEl.path[0] == '_' || strings.IndexByte(aEl.path[17:], '_') == 12 {
+               aStatus = "draft"
+            } else if aStatus == "" {
+               aStatus = "sent"
+            }
+         }
+         for _, aFn := range aUp {
+            if aStatus != "" && aUse[aFn] != "draft" { aUse[aFn] = aStatus }
+         }
+         aStart = aEnd
+      }
+   }
+   aDir, err := readDirNames(kUploadDir)
+   if err != nil { quit(err) }
+   aChange := false
+   for _, aFn := range aDir {
+      if aFn == "temp" || aFn == "thumb" || aUse[aFn] != "" { continue }
+      sUploadDoor.Lock()
+      aSum := sUploadStat[aFn].Sum
+      sUploadDoor.Unlock()
+      if aSum == "" {
+         aSum = _sumUpload(aFn)
+         if aSum == "" { continue } // dropped
+         sUploadDoor.Lock()
+         aStat := sUploadStat[aFn]
+         aStat.Sum = aSum
+         sUploadStat[aFn] = aStat
+         sUploadDoor.Unlock()
+         aChange = true
+      }
+      if aBlobs[aSum] {
+         aUse[aFn] = "sent"
+      }
+   }
+   sUploadDoor.Lock(); defer sUploadDoor.Unlock()
+   for aFn, aStatus := range aUse {
+      if aStat := sUploadStat[aFn]; aStatus == "sent" && aStat.Sent == "" {
+         aStat.Sent = dateRFC3339()
+         sUploadStat[aFn] = aStat
+         aChange = true
+      }
+   }
+   for aFn, aStat := range sUploadStat {
+      if aStat.Sent != "" && aUse[aFn] != "sent" { // touched by a draft, or sent copies deleted
+         aStat.Sent = ""
+         sUploadStat[aFn] = aStat
+         aChange = true
+      }
+   }
+   if aChange {
+      _storeStatUpload()
+   }
+   return aUse
+}
+
+// _expiresUpload returns the time an upload may be dropped, or zero
+// caller must hold sUploadDoor
+func _expiresUpload(iFn string, iStatus string) time.Time {
+   aStat := sUploadStat[iFn]
+   if iStatus != "sent" || aStat.Pinned || aStat.Sent == "" || sUploadSentExpiry == 0 {
+      return time.Time{}
+   }
+   aSent, err := time.Parse(time.RFC3339, aStat.Sent)
+   if err != nil { quit(err) }
+   return aSent.Add(sUploadSentExpiry)
+}
+
+func _runSweepUpload() {
+   defer time.AfterFunc(kUploadSweepPeriod, _runSweepUpload)
+   aUse := _statusUpload()
+   var aDrop []string
+   sUploadDoor.Lock()
+   for aFn, aStatus := range aUse {
+      if aExp := _expiresUpload(aFn, aStatus); !aExp.IsZero() && time.Now().After(aExp) {
+         aDrop = append(aDrop, aFn)
+      }
+   }
+   sUploadDoor.Unlock()
+   for _, aFn := range aDrop {
+      fmt.Printf("runSweepUpload: drop %s\n", unescapeFile(aFn))
+      Upload.Drop(unescapeFile(aFn))
+   }
+}
+
+// _sumUpload returns the sha256 of an upload, or "" if it's gone
+func _sumUpload(iFn string) string {
+   aFd, err := openFile(kUploadDir + iFn)
+   if err != nil {
+      if os.IsNotExist(err) { return "" }
+      quit(err)
+   }
+   defer aFd.Close()
+   if aFi, err := aFd.Stat(); err != nil || !aFi.Mode().IsRegular() {
+      return "" // upload_aborted symlink
+   }
+   aH := sha256.New()
+   _, err = io.Copy(aH, aFd)
+   if err != nil { quit(err) }
+   return hex.EncodeToString(aH.Sum(nil))
+}
+
+// _resetStatUpload clears the sent date & sum of a replaced upload
+func _resetStatUpload(iId string) {
+   sUploadDoor.Lock(); defer sUploadDoor.Unlock()
+   aStat, aHas := sUploadStat[escapeFile(iId)]
+   if !aHas || (aStat.Sent == "" && aStat.Sum == "") {
+      return
+   }
+   aStat.Sent, aStat.Sum = "", ""
+   sUploadStat[escapeFile(iId)] = aStat
+   _storeStatUpload()
+}
+
+// caller must hold sUploadDoor
+func _storeStatUpload() {
+   for aFn, aStat := range sUploadStat {
+      if aStat == (tUploadStat{}) { delete(sUploadStat, aFn) }
+   }
+   err := storeFile(kUploadStat, sUploadStat)
+   if err != nil { quit(err) }
+}
+
+
+// Resumable uploads: a client opens a session, writes chunks at offsets, and finishes with
+// the file checksum. Partial data is kept in kUploadPart; sessions idle for
+// sUploadPartExpiry are dropped at startup and when a session opens.
+
+var sUploadPartExpiry = 48 * time.Hour
+var sUploadPartDoor sync.Mutex
+var sUploadPartBusy = make(map[string]bool) // session id
+
+func SetPartExpiryUpload(iPeriod time.Duration) { sUploadPartExpiry = iPeriod }
+
+type tUploadPart struct {
+   Id string
+   Name string
+   Size int64 `json:",omitempty"` // 0 if not given
+   Offset int64
+   Expires string
+}
+
+type tUploadPartMeta struct {
+   Name string
+   Size int64
+   Date string
+}
+
+func (tGlobalUpload) OpenPart(iId string, iSize int64) (interface{}, error) {
+   if !_validUpload(iId) {
+      return nil, tError("missing or invalid filename")
+   }
+   if iSize < 0 {
+      return nil, tError("invalid size")
+   }
+   _expirePart()
+   aBuf := make([]byte, 12)
+   _, err := rand.Read(aBuf)
+   if err != nil { quit(err) }
+   aSid := hex.EncodeToString(aBuf)
+   aFd, err := openFileFlags(fileUppart(aSid), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+   if err != nil { quit(err) }
+   aFd.Close()
+   err = writeJsonFile(fileUppart(aSid) + ".json", tUploadPartMeta{Name: iId, Size: iSize, Date: dateRFC3339()})
+   if err != nil { quit(err) }
+   err = syncDir(kUploadPart)
+   if err != nil { quit(err) }
+   return _getPart(aSid)
+}
+
+func (tGlobalUpload) GetPart(iSid string) (interface{}, error) {
+   aDone, err := _lockPart(iSid)
+   if err != nil { return nil, err }
+   defer aDone()
+   return _getPart(iSid)
+}
+
+// WritePart stores a chunk at iOffset, which may not exceed the current offset
+func (tGlobalUpload) WritePart(iSid string, iOffset int64, iR io.Reader) (interface{}, error) {
+   aDone, err := _lockPart(iSid)
+   if err != nil { return nil, err }
+   defer aDone()
+   var aMeta tUploadPartMeta
+   err = readJsonFile(&aMeta, fileUppart(iSid) + ".json")
+   if err != nil { quit(err) }
+   aFd, err := openFileFlags(fileUppart(iSid), os.O_WRONLY, 0)
+   if err != nil { quit(err) }
+   defer aFd.Close()
+   aFi, err := aFd.Stat()
+   if err != nil { quit(err) }
+   if iOffset < 0 || iOffset > aFi.Size() {
+      return nil, tError(fmt.Sprintf("offset %d beyond %d", iOffset, aFi.Size()))
+   }
+   if iOffset < aFi.Size() {
+      err = aFd.Truncate(iOffset)
+      if err != nil { quit(err) }
+   }
+   _, err = aFd.Seek(iOffset, io.SeekStart)
+   if err != nil { quit(err) }
+   if aMeta.Size > 0 {
+      iR = io.LimitReader(iR, aMeta.Size - iOffset + 1)
+   }
+   aLen, errCopy := io.Copy(aFd, iR)
+   if aMeta.Size > 0 && iOffset + aLen > aMeta.Size {
+      err = aFd.Truncate(iOffset)
+      if err != nil { quit(err) }
+      errCopy = tError(fmt.Sprintf("data exceeds size %d", aMeta.Size))
+   }
+   err = aFd.Sync()
+   if err != nil { quit(err) }
+   if errCopy != nil { //todo only return network errors
+      return nil, errCopy // written part is kept
+   }
+   return _getPart(iSid)
+}
+
+// FinishPart checks the data against its sha256 sum and moves it into the upload area
+func (tGlobalUpload) FinishPart(iSid string, iSum string) error {
+   aDone, err := _lockPart(iSid)
+   if err != nil { return err }
+   defer aDone()
+   var aMeta tUploadPartMeta
+   err = readJsonFile(&aMeta, fileUppart(iSid) + ".json")
+   if err != nil { quit(err) }
+   aFd, err := openFile(fileUppart(iSid))
+   if err != nil { quit(err) }
+   aHash := sha256.New()
+   aLen, err := io.Copy(aHash, aFd)
+   aFd.Close()
+   if err != nil { quit(err) }
+   if aMeta.Size > 0 && aLen != aMeta.Size {
+      return tError(fmt.Sprintf("size %d incomplete, expected %d", aLen, aMeta.Size))
+   }
+   if !strings.EqualFold(iSum, hex.EncodeToString(aHash.Sum(nil))) {
+      return tError("checksum mismatch")
+   }
+   errScan := scanUpload(fileUppart(iSid), aMeta.Name)
+   if errScan != nil {
+      _dropPart(iSid)
+      return errScan
+   }
+   aOrig := fileUpload(aMeta.Name)
+   aTemp := fileUptmp(aMeta.Name)
+   err = os.Rename(fileUppart(iSid), aTemp)
+   if err != nil { quit(err) }
+   err = syncDir(kUploadTmp)
+   if err != nil { quit(err) }
+   _dropPart(iSid)
+   err = os.Remove(aOrig)
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   err = os.Rename(aTemp, aOrig)
+   if err != nil { quit(err) }
+   err = syncDir(kUploadDir)
+   if err != nil { quit(err) }
+   _resetStatUpload(aMeta.Name)
+   if _isThumb(aMeta.Name) {
+      sThumbDoor.Lock()
+      _makeThumb(aOrig, fileUpthumb(aMeta.Name))
+      sThumbDoor.Unlock()
+   }
+   return nil
+}
+
+func (tGlobalUpload) DropPart(iSid string) error {
+   aDone, err := _lockPart(iSid)
+   if err != nil { return err }
+   defer aDone()
+   _dropPart(iSid)
+   return nil
+}
+
+// _lockPart reserves a session; caller must invoke the returned func when done
+func _lockPart(iSid string) (func(), error) {
+   if iSid == "" || strings.ContainsAny(iSid, "./") {
+      return nil, tError("invalid session id")
+   }
+   sUploadPartDoor.Lock(); defer sUploadPartDoor.Unlock()
+   _, err := os.Lstat(fileUppart(iSid) + ".json")
+   if err != nil {
+      if !os.IsNotExist(err) { quit(err) }
+      return nil, tError("session not found")
+   }
+   if sUploadPartBusy[iSid] {
+      return nil, tError("session busy")
+   }
+   sUploadPartBusy[iSid] = true
+   return func() {
+      sUploadPartDoor.Lock(); defer sUploadPartDoor.Unlock()
+      delete(sUploadPartBusy, iSid)
+   }, nil
+}
+
+func _getPart(iSid string) (interface{}, error) {
+   var aMeta tUploadPartMeta
+   err := readJsonFile(&aMeta, fileUppart(iSid) + ".json")
+   if err != nil { quit(err) }
+   aFi, err := os.Lstat(fileUppart(iSid))
+   if err != nil { quit(err) }
+   return tUploadPart{Id: iSid, Name: aMeta.Name, Size: aMeta.Size, Offset: sizeFile(fileUppart(iSid), aFi),
+                      Expires: aFi.ModTime().Add(sUploadPartExpiry).UTC().Format(time.RFC3339)}, nil
+}
+
+// _dropPart removes a session's files; the meta file goes last, see _expirePart()
+func _dropPart(iSid string) {
+   err := os.Remove(fileUppart(iSid))
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   err = os.Remove(fileUppart(iSid) + ".json")
+   if err != nil && !os.IsNotExist(err) { quit(err) }
+   err = syncDir(kUploadPart)
+   if err != nil { quit(err) }
+}
+
+func _expirePart() {
+   aDir, err := readDirFis(kUploadPart)
+   if err != nil { quit(err) }
+   aMtime := make(map[string]time.Time, len(aDir))
+   aData := make(map[string]bool, len(aDir))
+   for _, aFi := range aDir {
+      aSid := strings.TrimSuffix(aFi.Name(), ".json")
+      aData[aSid] = aData[aSid] || aSid == aFi.Name()
+      if aFi.ModTime().After(aMtime[aSid]) {
+         aMtime[aSid] = aFi.ModTime()
+      }
+   }
+   sUploadPartDoor.Lock(); defer sUploadPartDoor.Unlock()
+   for aSid, aTime := range aMtime {
+      if sUploadPartBusy[aSid] { continue }
+      if aData[aSid] && time.Since(aTime) < sUploadPartExpiry { continue } // no data if interrupted
+      _dropPart(aSid)
+   }
+}
@@ -28,6 +28,8 @@ list=(
    'Blue end.z            1 drop-sync-node            Blue thread_tag.a'
    'Gold poll_delivery.b  1 store-received-thread     Blue thread_send.a'
    'Gold forward_send.a   1 store-fwd-sent-thread'
+   'Gold thread_delete.a  1 delete-thread'
+   'Gold msg_delete.a     1 delete-msg-thread'
 )
 
 if [ $# -eq 2 ]; then
@@ -57,6 +57,7 @@ type tTestClient struct {
    SvcId string
    Cfg struct {
       Name, Alias string
+      Receipts string `json:",omitempty"`
       Addr string // for internal use; json value ignored
    }
    Files []struct {
@@ -67,6 +68,11 @@ type tTestClient struct {
       Ffn string         `json:"ffn,omitempty"`
       Fields interface{} `json:"fields,omitempty"`
    }
+   Templates []struct {
+      Name string
+      Subject, Body string
+      Attach []string `json:",omitempty"`
+   }
    Orders []struct {
       Updt pSl.Update
       Poll int
@@ -110,6 +116,24 @@ func (o *tTestSteppedRead) Read(iBuf []byte) (int, error) {
    return copy(iBuf, aStep), nil
 }
 
+// tTestScanner flags received attachments containing the EICAR test string; uploads
+// (names without an x: tag) pass, so a test can send such a file
+type tTestScanner struct{}
+
+func (tTestScanner) Scan(iR io.Reader, iName string) (string, string) {
+   if len(iName) < 2 || iName[1] != ':' {
+      return pSl.ScanClean, ""
+   }
+   aBuf, err := ioutil.ReadAll(iR)
+   if err != nil {
+      return pSl.ScanError, err.Error()
+   }
+   if bytes.Contains(aBuf, []byte("EICAR-STANDARD-ANTIVIRUS-TEST-FILE")) {
+      return pSl.ScanInfected, "Eicar-Test-Signature"
+   }
+   return pSl.ScanClean, ""
+}
+
 type tTestContext struct {
    svcId string
    lastId tTestLastId
@@ -149,6 +173,7 @@ func crashTest(iSvc string, iOp string) {
 
 func test() int {
    pSl.SetSyncPeriodNode(1 * time.Second)
+   pSl.SetScanner(tTestScanner{})
    sTestWebAddr = sHttpSrvr.Addr; if sTestWebAddr[0] == ':' { sTestWebAddr = "localhost"+ sTestWebAddr }
    aDir := "test-run/" + sTestDate[1:]
    var err error
@@ -334,6 +359,12 @@ func _setupTestDir(iDir string, iClients []tTestClient) bool {
             if err != nil { goto ReturnErr }
          }
       }
+      for a1 := range aTc.Templates {
+         err = aEnc.Encode(aTc.Templates[a1])
+         if err != nil { quit(err) }
+         err = pSl.Template.Add(aTc.Templates[a1].Name, "", &aBuf)
+         if err != nil { goto ReturnErr }
+      }
       if aTc.Cfg.Name == "" { continue }
       for {
          aCfg := pSl.GetConfigService(aTc.SvcId)
@@ -513,6 +544,13 @@ func _runTestClient(iTc *tTestClient, iWg *sync.WaitGroup) {
       err = json.Unmarshal(aBuf, &aOps)
       if err != nil { quit(err) }
       if aOps[0] == "_e" {
+         if aExpect, ok := iTc.Orders[a].Result["_e"]; ok { // order expects an error
+            if aName, aMis := _hasExpected("_e", aExpect, aOps[1]); aName != "" {
+               fmt.Fprintf(os.Stderr, "%s mismatch\n  expect %v\n  got    %s %v\n",
+                                      aPrefix, aExpect, aName, aMis)
+            }
+            continue
+         }
          fmt.Fprintf(os.Stderr, "%s update error %s\n", aPrefix, aOps[1])
          continue
       }
@@ -532,7 +570,7 @@ func _runTestClient(iTc *tTestClient, iWg *sync.WaitGroup) {
                break
             }
             if aOp == "_t" || aOp == "_T" { continue }
-            if aOp == "mn" || aOp == "an" {
+            if aOp == "mn" || aOp == "an" || aOp == "mq" || aOp == "hl" || aOp == "hd" {
                a1++
                aId = aOps[a1]
                if aSum != nil { atomic.AddInt32(aSum, 1) }
@@ -590,7 +628,10 @@ func _prepUpdt(iUpdt *pSl.Update, iCtx *tTestContext, iPrefix string) bool {
       if iUpdt.Node.Pin == "localpin" {
          iUpdt.Node.Pin = sTestNodePin
       }
-   case "thread_save":
+   case "thread_quote":
+      _applyLastId(&iUpdt.Thread.Quote,      &aApply, iCtx.lastId, "ml")
+      fallthrough
+   case "thread_save", "thread_restore":
       if iUpdt.Thread.Alias != "" {
          iUpdt.Thread.Alias += sTestDate
       }
@@ -609,14 +650,21 @@ func _prepUpdt(iUpdt *pSl.Update, iCtx *tTestContext, iPrefix string) bool {
          }
       }
       fallthrough
-   case "thread_send", "thread_discard":
+   case "thread_send", "thread_unsend", "thread_discard":
       _applyLastId(&iUpdt.Thread.Id,         &aApply, iCtx.lastId, "ml")
-   case "thread_open", "thread_close", "thread_tag":
+      if !_applyAfter(&iUpdt.Thread.SendAt, iPrefix) {
+         return false
+      }
+   case "thread_open", "thread_close", "thread_tag", "thread_delete", "msg_delete",
+        "thread_snooze":
       _applyLastId(&iUpdt.Touch.MsgId,       &aApply, iCtx.lastId, "ml")
       _applyLastId(&iUpdt.Touch.ThreadId,    &aApply, iCtx.lastId, "tl")
       if iUpdt.Touch.TagId != "" {
          iUpdt.Touch.TagId = pSl.GetIdTag(iUpdt.Touch.TagId)
       }
+      if !_applyAfter(&iUpdt.Touch.Until, iPrefix) {
+         return false
+      }
    case "forward_save":
       for a := range iUpdt.Forward.Cc {
          iUpdt.Forward.Cc[a].Who += sTestDate
@@ -628,6 +676,15 @@ func _prepUpdt(iUpdt *pSl.Update, iCtx *tTestContext, iPrefix string) bool {
    case "forward_send":
       _applyLastId(&iUpdt.Forward.ThreadId,  &aApply, iCtx.lastId, "tl")
       _applyLastId(&iUpdt.Forward.Qid,       &aApply, iCtx.lastId, "cl")
+   case "sched_edit":
+      if len(iUpdt.Sched.Id) > 1 { // type prefix, then last or 2ndlast
+         aId := iUpdt.Sched.Id[1:]
+         _applyLastId(&aId,                  &aApply, iCtx.lastId, "ml")
+         iUpdt.Sched.Id = iUpdt.Sched.Id[:1] + aId
+      }
+      if !_applyAfter(&iUpdt.Sched.SendAt, iPrefix) {
+         return false
+      }
    case "adrsbk_search":
       if iUpdt.Adrsbk.Term == "td" {
          iUpdt.Adrsbk.Term = sTestDate[1:3]
@@ -656,16 +713,20 @@ func _prepUpdt(iUpdt *pSl.Update, iCtx *tTestContext, iPrefix string) bool {
       _applyLastId(&iUpdt.Navigate.ThreadId, &aApply, iCtx.lastId, "ml")
       _applyLastId(&iUpdt.Navigate.MsgId,    &aApply, iCtx.lastId, "ml")
    case "navigate_history",
-        "notice_seen",
+        "notice_seen", "notice_accept",
         "tag_add",
         "tab_add", "tab_pin", "tab_drop", "tab_select",
         "sort_select",
+        "retain_preview", "usage_report",
         "open":
       // nothing to do
    case "test":
       if len(iUpdt.Test.Request) >= 2 {
-         if iUpdt.Test.Request[0] == "mn" { // assume Request[1] is valid
-            _applyLastId(&iUpdt.Test.Request[1], &aApply, iCtx.lastId, "ml")
+         switch iUpdt.Test.Request[0] {
+         case "mn", "mq", "hl", "hd": // assume Request[1] is valid
+            aId := strings.SplitN(iUpdt.Test.Request[1], ".", 2) // hd takes id.rev
+            _applyLastId(&aId[0], &aApply, iCtx.lastId, "ml")
+            iUpdt.Test.Request[1] = strings.Join(aId, ".")
          }
       } else if iUpdt.Test.Notice != nil {
          aNow := time.Now().UTC()
@@ -714,6 +775,20 @@ func _applyLastId(iField, iMsg *string, iLastId tTestLastId, iType string) {
    *iMsg += aAmp + *iField
 }
 
+// _applyAfter converts a count of seconds from now to a date
+func _applyAfter(iField *string, iPrefix string) bool {
+   if *iField == "" {
+      return true
+   }
+   aN, err := strconv.Atoi(*iField)
+   if err != nil {
+      fmt.Fprintf(os.Stderr, "%s date offset %s\n", iPrefix, err)
+      return false
+   }
+   *iField = time.Now().UTC().Add(time.Duration(aN) * time.Second).Format(time.RFC3339)
+   return true
+}
+
 func _verifyNameList(iList []string, iExpect interface{}, iPrefix string) {
    aGot := make([]interface{}, len(iList))
    for a := range iList { aGot[a] = iList[a] }
@@ -762,8 +837,12 @@ func _runTestService(iCtx *tTestContext, iOp, iId string, iExpect interface{},
       err = json.Unmarshal(aResult.Bytes(), &aClPair)
       if err != nil { return }
       *iCtx.lastId[iOp] = aClPair[0]
-   } else if iOp == "tl" && aResult.Bytes()[0] == '{' {
-      // nothing to do
+   } else if iOp == "tl" {
+      if !bytes.HasPrefix(aResult.Bytes(), []byte(`{"Ffn"`)) {
+         aPage := struct{ List *tTestAnyId }{iCtx.lastId[iOp]}
+         err = json.Unmarshal(aResult.Bytes(), &aPage)
+         if err != nil { return }
+      }
    } else if iCtx.lastId[iOp] != nil {
       err = json.Unmarshal(aResult.Bytes(), iCtx.lastId[iOp])
       if err != nil { return }
@@ -900,6 +979,12 @@ func _hasExpected(iName string, iExpect, iGot interface{}) (string, interface{})
    case map[string]interface{}:
       aGot, ok := iGot.(map[string]interface{})
       if !ok { return iName, iGot }
+      if aVal, has := aExpect["*uid"]; has && len(aExpect) == 1 && len(aGot) == 1 { // keyed by uid
+         for a := range aGot {
+            if aName, _ := _hasExpected(iName, "*uid", a); aName != "" { return iName +"+"+ a, aGot[a] }
+            aExpect = map[string]interface{}{a: aVal}
+         }
+      }
       for a := range aGot {
          if _, ok = aExpect[a]; !ok { return iName +"+"+ a, aGot[a] }
       }
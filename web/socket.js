@@ -28,6 +28,14 @@
       _wsSend({op:'config_update', config:iObj})
    };
 
+   mnm.RetainPreview = function() {
+      _wsSend({op:'retain_preview'})
+   };
+
+   mnm.UsageReport = function() {
+      _wsSend({op:'usage_report'})
+   };
+
    mnm.OhiAdd = function(iAliasTo, iUid) {
       _wsSend({op:'ohi_add', ohi:{alias:iAliasTo, uid:iUid}})
    };
@@ -41,8 +49,8 @@
    mnm.PingDiscard = function(iObj) { // with to, gid
       _wsSend({op:'ping_discard', ping:iObj})
    };
-   mnm.PingSend = function(i) {
-      _wsSend({op:'ping_send', ping:{qid:i}})
+   mnm.PingSend = function(i, iSendAt) { // (sendAt) is RFC3339
+      _wsSend({op:'ping_send', ping:{qid:i, sendAt:iSendAt}})
    };
    mnm.InviteAccept = function(i) {
       _wsSend({op:'accept_send', accept:{qid:i}})
@@ -61,6 +69,9 @@
    mnm.NoticeSeen = function(iMsgId) {
       _wsSend({op:'notice_seen', notice:{msgid:iMsgId}})
    };
+   mnm.NoticeAccept = function(iMsgId) {
+      _wsSend({op:'notice_accept', notice:{msgid:iMsgId}})
+   };
 
    mnm.NavigateThread = function(i) {
       _wsSend({op:'navigate_thread', navigate:{threadId:i}})
@@ -75,31 +86,49 @@
       _wsSend({op:'navigate_link', navigate:{label:iLabel, threadId:aPair[0], msgId:aPair[1] || aPair[0]}})
    };
 
-   mnm.ThreadNew = function(iObj) { // with alias, (cc), (data), (attach), (formFill)
+   mnm.ThreadNew = function(iObj) { // with alias, (cc), (data), (attach), (formFill), (template)
       iObj.new = 1;
       _wsSend({op:'thread_save', thread:iObj})
    };
-   mnm.ThreadReply = function(iObj) { // with alias, (data), (attach), (formFill)
+   mnm.ThreadReply = function(iObj) { // with alias, (data), (attach), (formFill), (template)
       iObj.new = 2;
       _wsSend({op:'thread_save', thread:iObj})
    };
+   mnm.ThreadQuote = function(iObj) { // with alias, quote (msgid or msgid.start-end), (data)
+      _wsSend({op:'thread_quote', thread:iObj})
+   };
    mnm.ThreadSave = function(iObj) { // with id, alias, (cc), (data), (attach), (formFill)
       delete iObj.new // just in case
       _wsSend({op:'thread_save', thread:iObj})
    };
-   mnm.ThreadSend = function(iId) {
-      _wsSend({op:'thread_send', thread:{id:iId}})
+   mnm.ThreadSend = function(iId, iSendAt) { // (sendAt) is RFC3339
+      _wsSend({op:'thread_send', thread:{id:iId, sendAt:iSendAt}})
+   };
+   mnm.ThreadUnsend = function(iId) {
+      _wsSend({op:'thread_unsend', thread:{id:iId}})
    };
    mnm.ThreadDiscard = function(iId) {
       _wsSend({op:'thread_discard', thread:{id:iId}})
    };
 
+   mnm.ThreadListMore = function(iCursor) {
+      _xhr('tl', iCursor)
+   };
    mnm.ThreadOpen = function(iId) {
       _xhr('mn', iId, null, true) // sends thread_open from onload
    };
    mnm.ThreadClose = function(iId) {
       _wsSend({op:'thread_close', touch:{msgid:iId}})
    };
+   mnm.ThreadDelete = function(iId) {
+      _wsSend({op:'thread_delete', touch:{threadid:iId}})
+   };
+   mnm.ThreadSnooze = function(iId, iUntil) { // (until) is RFC3339, empty to wake
+      _wsSend({op:'thread_snooze', touch:{threadid:iId, until:iUntil}})
+   };
+   mnm.MsgDelete = function(iThreadId, iMsgId) {
+      _wsSend({op:'msg_delete', touch:{threadid:iThreadId, msgid:iMsgId}})
+   };
    mnm.ThreadTag = function(iId, iTag) {
       _wsSend({op:'thread_tag', touch:{msgid:iId, act:sTouchTag, tagid:iTag}})
    };
@@ -110,8 +139,12 @@
    mnm.ForwardSave = function(iId, iCc) {
       _wsSend({op:'forward_save', forward:{threadId:iId, cc:iCc}})
    };
-   mnm.ForwardSend = function(iId, iQid) {
-      _wsSend({op:'forward_send', forward:{threadId:iId, qid:iQid}})
+   mnm.ForwardSend = function(iId, iQid, iSendAt) { // (sendAt) is RFC3339
+      _wsSend({op:'forward_send', forward:{threadId:iId, qid:iQid, sendAt:iSendAt}})
+   };
+
+   mnm.SchedEdit = function(iId, iSendAt) { // empty sendAt unschedules
+      _wsSend({op:'sched_edit', sched:{id:iId, sendAt:iSendAt}})
    };
 
    mnm.TagAdd = function(iName) {
@@ -146,6 +179,10 @@
       _xhr('/tb', iId, iCb);
    };
 
+   mnm.MsgQuote = function(iIdRange, iCb) { // msgid or msgid.start-end
+      _xhr('mq', iIdRange, iCb);
+   };
+
    mnm.AttachForm = function(iId, iCb) {
       _xhr('ant', iId, iCb);
    };